@@ -0,0 +1,1050 @@
+package dhcpmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket names of the bolt database
+var (
+	boltAllocationsBucket = []byte("allocations")
+	boltRevisionsBucket   = []byte("revisions")
+	boltLookupBucket      = []byte("lookup")
+	boltMACsBucket        = []byte("macs")
+	boltClaimsBucket      = []byte("claims")
+	boltEventsBucket      = []byte("events")
+	boltMetaBucket        = []byte("meta")
+	boltNodesBucket       = []byte("nodes")
+
+	boltRevisionKey = []byte("revision")
+	boltLeaderKey   = []byte("leader")
+)
+
+const (
+	// boltEventHistory is the number of events kept in the database for
+	// watchers to catch up with
+	boltEventHistory = 1024
+
+	// boltExpiryInterval is the interval in which expired allocations are removed
+	boltExpiryInterval = time.Second
+
+	// boltElectionTTL is the time after which the leadership of an
+	// unresponsive controller expires
+	boltElectionTTL = 10 * time.Second
+
+	boltEventPut    = "put"
+	boltEventDelete = "delete"
+)
+
+// boltStateManager implements the StateManager interface on top of a bolt
+// database file. The database is kept open until the state manager is
+// stopped, and bolt's file lock keeps other processes from opening it in the
+// meantime. Every modification is recorded in an event log, from which
+// watchers are served after being woken up by the modifying transaction to
+// reproduce the watch semantics of etcd.
+type boltStateManager struct {
+	db          *bolt.DB
+	electionTTL time.Duration
+
+	// changed is closed and replaced after every modification to wake up
+	// the watchers
+	mu      sync.Mutex
+	changed chan struct{}
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// boltEvent is a single entry in the event log
+type boltEvent struct {
+	Revision     uint64
+	Bucket       string
+	Type         string
+	Key          string
+	Value        []byte `json:",omitempty"`
+	PrevValue    []byte `json:",omitempty"`
+	PrevRevision uint64 `json:",omitempty"`
+}
+
+// boltLeader is the leadership record in the meta bucket
+type boltLeader struct {
+	Identity string
+	Expire   time.Time
+}
+
+// NewBoltStateManager creates a new StateManager backed by the bolt database
+// at path. The database is created if it does not exist. Allocations with
+// expired leases are removed until the state manager is stopped.
+func NewBoltStateManager(path string, requestTimeout time.Duration) (StateManager, error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: requestTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("Could not open bolt database %s - %s", path, err.Error())
+	}
+
+	s := &boltStateManager{
+		db:          db,
+		electionTTL: boltElectionTTL,
+		changed:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	err = s.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltAllocationsBucket, boltRevisionsBucket, boltLookupBucket,
+			boltMACsBucket, boltClaimsBucket, boltEventsBucket, boltMetaBucket, boltNodesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.expire()
+	return s, nil
+}
+
+// update runs fn in a read-write transaction and wakes up the watchers
+func (s *boltStateManager) update(fn func(*bolt.Tx) error) error {
+	if err := s.db.Update(fn); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+	return nil
+}
+
+// view runs fn in a read-only transaction
+func (s *boltStateManager) view(fn func(*bolt.Tx) error) error {
+	return s.db.View(fn)
+}
+
+// changes returns a channel that is closed with the next modification
+func (s *boltStateManager) changes() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+// MaintainIndices is a no-op, because the IP lookup table is maintained as
+// part of every modification and expired allocations are removed by every
+// component that opened the database
+func (s *boltStateManager) MaintainIndices() {}
+
+// expire removes allocations with expired leases until the state manager is
+// stopped
+func (s *boltStateManager) expire() {
+	ticker := time.NewTicker(boltExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.removeExpired(); err != nil {
+				log.Printf("State: error removing expired allocations [%s]", err.Error())
+			}
+		}
+	}
+}
+
+func (s *boltStateManager) removeExpired() error {
+	now := time.Now()
+	return s.update(func(tx *bolt.Tx) error {
+		expired := make([]*Allocation, 0)
+		err := tx.Bucket(boltAllocationsBucket).ForEach(func(k, v []byte) error {
+			allocation, err := decode(v)
+			if err != nil {
+				return err
+			}
+			if expire, ok := allocation.RecordExpiry(); ok && expire.Before(now) {
+				expired = append(expired, allocation)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, allocation := range expired {
+			if err := removeAllocation(tx, allocation.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Stop stops all watchers and the expiry thread and closes the database
+func (s *boltStateManager) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		if err := s.db.Close(); err != nil {
+			log.Printf("State: error closing bolt database [%s]", err.Error())
+		}
+	})
+}
+
+// Campaign elects identity as leader once no other identity holds an
+// unexpired leadership record. The leader renews its leadership record
+// periodically, which expires after electionTTL if the leader stopped
+// responding.
+func (s *boltStateManager) Campaign(ctx context.Context, identity string) (context.Context, func(), error) {
+
+	for {
+		elected, err := s.acquireLeadership(identity)
+		if err != nil {
+			log.Printf("State: error acquiring leadership [%s]", err.Error())
+		}
+		if elected {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-s.done:
+			return nil, nil, errors.New("State manager stopped")
+		case <-time.After(s.electionTTL / 3):
+		}
+	}
+
+	leaderCtx, cancel := watchContext(ctx, s.done)
+	renewing := make(chan struct{})
+	go func() {
+		defer close(renewing)
+		ticker := time.NewTicker(s.electionTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-leaderCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			if elected, err := s.acquireLeadership(identity); !elected || err != nil {
+				log.Printf("State: leadership of %s lost", identity)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	resign := func() {
+		once.Do(func() {
+			cancel()
+			<-renewing
+			if err := s.releaseLeadership(identity); err != nil {
+				log.Printf("State: error resigning leadership of %s [%s]", identity, err.Error())
+			}
+		})
+	}
+	return leaderCtx, resign, nil
+}
+
+// acquireLeadership records identity as leader if there is no other leader
+// with an unexpired record
+func (s *boltStateManager) acquireLeadership(identity string) (bool, error) {
+	elected := false
+	err := s.update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		now := time.Now()
+		if v := meta.Get(boltLeaderKey); v != nil {
+			leader := &boltLeader{}
+			if err := json.Unmarshal(v, leader); err != nil {
+				return err
+			}
+			if leader.Identity != identity && leader.Expire.After(now) {
+				return nil
+			}
+		}
+		v, err := json.Marshal(&boltLeader{Identity: identity, Expire: now.Add(s.electionTTL)})
+		if err != nil {
+			return err
+		}
+		elected = true
+		return meta.Put(boltLeaderKey, v)
+	})
+	return elected && err == nil, err
+}
+
+// releaseLeadership removes the leadership record if it is held by identity
+func (s *boltStateManager) releaseLeadership(identity string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		leader := &boltLeader{}
+		if v := meta.Get(boltLeaderKey); v == nil || json.Unmarshal(v, leader) != nil || leader.Identity != identity {
+			return nil
+		}
+		return meta.Delete(boltLeaderKey)
+	})
+}
+
+// RegisterNode records node with an expiry time in the database and renews
+// the record until ctx is cancelled. The record expires after electionTTL if
+// the node stopped responding or the state manager has been stopped.
+func (s *boltStateManager) RegisterNode(ctx context.Context, node string) error {
+
+	if err := s.renewNode(node); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.electionTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ctx.Done():
+				err := s.update(func(tx *bolt.Tx) error {
+					return tx.Bucket(boltNodesBucket).Delete([]byte(node))
+				})
+				if err != nil {
+					log.Printf("State: error removing node %s [%s]", node, err.Error())
+				}
+				return
+			case <-ticker.C:
+			}
+			if err := s.renewNode(node); err != nil {
+				log.Printf("State: error renewing node %s [%s]", node, err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// renewNode sets the expiry time of the node record to electionTTL from now
+func (s *boltStateManager) renewNode(node string) error {
+	expire := time.Now().Add(s.electionTTL)
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltNodesBucket).Put([]byte(node), itob(uint64(expire.UnixNano())))
+	})
+}
+
+// Nodes returns the names of all nodes with an unexpired record
+func (s *boltStateManager) Nodes() ([]string, error) {
+	nodes := make([]string, 0)
+	now := uint64(time.Now().UnixNano())
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltNodesBucket).ForEach(func(k, v []byte) error {
+			if btoi(v) > now {
+				nodes = append(nodes, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// WatchEvents reports changes of the allocations selected by filter
+func (s *boltStateManager) WatchEvents(ctx context.Context, filter AllocationFilter) <-chan AllocationEvent {
+	events := make(chan AllocationEvent)
+	w := s.newBoltWatch(boltAllocationsBucket)
+	ctx, cancel := watchContext(ctx, s.done)
+	go func() {
+		defer close(events)
+		defer cancel()
+		w.run(ctx, func(ev *boltEvent) {
+			id, err := uuid.Parse(ev.Key)
+			if err != nil || !filter.matches(id) {
+				return
+			}
+			event, err := ev.allocationEvent()
+			if err != nil {
+				log.Printf("Error decoding allocation from bolt store: %s", err.Error())
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return events
+}
+
+func (ev *boltEvent) allocationEvent() (AllocationEvent, error) {
+	event := AllocationEvent{Type: EventModified, Revision: int64(ev.Revision)}
+	var err error
+	if ev.Type == boltEventDelete {
+		event.Type = EventDeleted
+	} else if event.New, err = decodeRevision(ev.Value, ev.Revision); err != nil {
+		return event, err
+	}
+	if ev.PrevValue == nil {
+		event.Type = EventCreated
+	} else if event.Old, err = decodeRevision(ev.PrevValue, ev.PrevRevision); err != nil {
+		return event, err
+	}
+	return event, nil
+}
+
+func decodeRevision(value []byte, revision uint64) (*Allocation, error) {
+	allocation, err := decode(value)
+	if err != nil {
+		return nil, err
+	}
+	allocation.Revision = int64(revision)
+	return allocation, nil
+}
+
+// WatchMACPoolEvents reports changes of the MAC pool
+func (s *boltStateManager) WatchMACPoolEvents(ctx context.Context) <-chan MACPoolEvent {
+	events := make(chan MACPoolEvent)
+	w := s.newBoltWatch(boltMACsBucket)
+	ctx, cancel := watchContext(ctx, s.done)
+	go func() {
+		defer close(events)
+		defer cancel()
+		w.run(ctx, func(ev *boltEvent) {
+			event := MACPoolEvent{Type: MACPushed, Revision: int64(ev.Revision)}
+			switch {
+			case ev.Type == boltEventDelete:
+				event.Type = MACPopped
+			case ev.PrevValue != nil:
+				// MAC is already in the pool
+				return
+			}
+			mac, err := net.ParseMAC(ev.Key)
+			if err != nil {
+				log.Printf("Error deserialising MAC - %s", err.Error())
+				return
+			}
+			event.MAC = mac
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return events
+}
+
+// WatchAllocation watches state changes of the allocation with the given ID
+func (s *boltStateManager) WatchAllocation(allocationID uuid.UUID, watcher *AllocationWatcher) func() {
+	return watchAllocations(s, AllocationFilter{ID: allocationID}, watcher)
+}
+
+// Watch uses the supplied AllocationWatcher to watch all allocations
+func (s *boltStateManager) Watch(watcher *AllocationWatcher) func() {
+	return watchAllocations(s, AllocationFilter{}, watcher)
+}
+
+// WatchMACPool watches the MAC pool
+func (s *boltStateManager) WatchMACPool(watcher *MACPoolWatcher) func() {
+	return watchMACPool(s, watcher)
+}
+
+// boltEntry is the value of a watched key and the revision of its last
+// modification
+type boltEntry struct {
+	value    []byte
+	revision uint64
+}
+
+// boltWatch follows the event log for the keys of a bucket. It keeps track
+// of the known state of all keys, which allows it to relist the bucket if
+// events it has not seen yet have been trimmed from the log. All
+// differences to the known state are then reported as synthetic events.
+type boltWatch struct {
+	sm       *boltStateManager
+	bucket   []byte
+	revision uint64
+	known    map[string]boltEntry
+}
+
+// newBoltWatch lists the current state of bucket. Following starts from the
+// revision of the listing, so no change after this call is missed.
+func (s *boltStateManager) newBoltWatch(bucket []byte) *boltWatch {
+	w := &boltWatch{
+		sm:     s,
+		bucket: bucket,
+		known:  make(map[string]boltEntry),
+	}
+	err := s.view(func(tx *bolt.Tx) error {
+		w.revision = currentRevision(tx)
+		w.known = listBucket(tx, bucket)
+		return nil
+	})
+	if err != nil {
+		log.Printf("State: error listing %s [%s]", bucket, err.Error())
+	}
+	return w
+}
+
+// listBucket returns the values of all keys in bucket. The revisions are
+// only recorded for allocations.
+func listBucket(tx *bolt.Tx, bucket []byte) map[string]boltEntry {
+	entries := make(map[string]boltEntry)
+	tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+		entries[string(k)] = boltEntry{value: copyBytes(v), revision: allocationRevision(tx, k)}
+		return nil
+	})
+	return entries
+}
+
+// run hands all events for the bucket to handle until ctx is cancelled
+func (w *boltWatch) run(ctx context.Context, handle func(*boltEvent)) {
+
+	for {
+		// Obtain the channel before reading to not miss modifications made
+		// while the events are handled
+		changed := w.sm.changes()
+
+		var events []*boltEvent
+		revision := w.revision
+		err := w.sm.view(func(tx *bolt.Tx) error {
+			var err error
+			events, revision, err = w.read(tx)
+			return err
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("State: error reading events [%s]", err.Error())
+		}
+
+		for _, ev := range events {
+			w.apply(ev)
+			handle(ev)
+		}
+		w.revision = revision
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// read returns the events for the bucket recorded after the revision of the
+// watch and the revision to continue from. The bucket is relisted if events
+// have been trimmed from the log since.
+func (w *boltWatch) read(tx *bolt.Tx) ([]*boltEvent, uint64, error) {
+	events := make([]*boltEvent, 0)
+	revision := w.revision
+
+	c := tx.Bucket(boltEventsBucket).Cursor()
+	k, v := c.Seek(itob(w.revision + 1))
+	if k != nil && btoi(k) > w.revision+1 {
+		log.Printf("State: watcher missed %d events - relisting %s", btoi(k)-w.revision-1, w.bucket)
+		return w.relist(tx), currentRevision(tx), nil
+	}
+	for ; k != nil; k, v = c.Next() {
+		ev := &boltEvent{}
+		if err := json.Unmarshal(v, ev); err != nil {
+			return nil, w.revision, err
+		}
+		revision = ev.Revision
+		if ev.Bucket == string(w.bucket) {
+			events = append(events, ev)
+		}
+	}
+	return events, revision, nil
+}
+
+// relist returns the differences between the known and the current state
+// of the bucket as events
+func (w *boltWatch) relist(tx *bolt.Tx) []*boltEvent {
+	events := make([]*boltEvent, 0)
+	revision := currentRevision(tx)
+	current := listBucket(tx, w.bucket)
+
+	for key, entry := range current {
+		ev := &boltEvent{
+			Revision: entry.revision,
+			Bucket:   string(w.bucket),
+			Type:     boltEventPut,
+			Key:      key,
+			Value:    entry.value,
+		}
+		if ev.Revision == 0 {
+			ev.Revision = revision
+		}
+		prev, known := w.known[key]
+		if known && bytes.Equal(prev.value, entry.value) {
+			continue
+		}
+		if known {
+			ev.PrevValue = prev.value
+			ev.PrevRevision = prev.revision
+		}
+		events = append(events, ev)
+	}
+	for key, prev := range w.known {
+		if _, ok := current[key]; !ok {
+			events = append(events, &boltEvent{
+				Revision:     revision,
+				Bucket:       string(w.bucket),
+				Type:         boltEventDelete,
+				Key:          key,
+				PrevValue:    prev.value,
+				PrevRevision: prev.revision,
+			})
+		}
+	}
+	return events
+}
+
+// apply updates the known state with ev
+func (w *boltWatch) apply(ev *boltEvent) {
+	if ev.Type == boltEventDelete {
+		delete(w.known, ev.Key)
+		return
+	}
+	w.known[ev.Key] = boltEntry{value: ev.Value, revision: ev.Revision}
+}
+
+// Put persists an allocation and updates the IP lookup table
+func (s *boltStateManager) Put(allocation *Allocation) error {
+	return s.put(allocation, false, 0)
+}
+
+// Update persists an allocation if the stored allocation is still at
+// expectedRevision
+func (s *boltStateManager) Update(allocation *Allocation, expectedRevision int64) error {
+	return s.put(allocation, true, expectedRevision)
+}
+
+func (s *boltStateManager) put(allocation *Allocation, checkRevision bool, expectedRevision int64) error {
+
+	b, err := encode(allocation)
+	if err != nil {
+		log.Printf("State: error econding lease [%s]", err.Error())
+		return err
+	}
+
+	var revision uint64
+	err = s.update(func(tx *bolt.Tx) error {
+		allocations := tx.Bucket(boltAllocationsBucket)
+		lookup := tx.Bucket(boltLookupBucket)
+		key := []byte(allocation.ID.String())
+
+		if checkRevision && int64(allocationRevision(tx, key)) != expectedRevision {
+			return ErrConflict
+		}
+
+		prev := copyBytes(allocations.Get(key))
+		if checkRevision && prev != nil {
+			stored, err := decode(prev)
+			if err != nil {
+				return err
+			}
+			if err := checkUpdate(stored, allocation); err != nil {
+				return err
+			}
+		}
+		if prev != nil {
+			if old, err := decode(prev); err == nil {
+				if err := removeLookup(tx, old); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := allocations.Put(key, b); err != nil {
+			return err
+		}
+		for _, ip := range allocation.IPs() {
+			if err := lookup.Put([]byte(ip.String()), key); err != nil {
+				return err
+			}
+		}
+
+		ev := &boltEvent{
+			Bucket:    string(boltAllocationsBucket),
+			Type:      boltEventPut,
+			Key:       string(key),
+			Value:     b,
+			PrevValue: prev,
+		}
+		if err := appendEvent(tx, ev); err != nil {
+			return err
+		}
+		revision = ev.Revision
+		return tx.Bucket(boltRevisionsBucket).Put(key, itob(revision))
+	})
+	if err != nil {
+		return err
+	}
+
+	allocation.Revision = int64(revision)
+	return nil
+}
+
+// Remove deletes an allocation
+func (s *boltStateManager) Remove(allocation *Allocation) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return removeAllocation(tx, allocation.ID)
+	})
+}
+
+// removeAllocation deletes the allocation with id and its lookup entry
+func removeAllocation(tx *bolt.Tx, id uuid.UUID) error {
+	allocations := tx.Bucket(boltAllocationsBucket)
+	key := []byte(id.String())
+
+	prev := copyBytes(allocations.Get(key))
+	if prev == nil {
+		return nil
+	}
+	if old, err := decode(prev); err == nil {
+		if err := removeLookup(tx, old); err != nil {
+			return err
+		}
+	}
+	prevRevision := allocationRevision(tx, key)
+	if err := allocations.Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltRevisionsBucket).Delete(key); err != nil {
+		return err
+	}
+
+	return appendEvent(tx, &boltEvent{
+		Bucket:       string(boltAllocationsBucket),
+		Type:         boltEventDelete,
+		Key:          string(key),
+		PrevValue:    prev,
+		PrevRevision: prevRevision,
+	})
+}
+
+// removeLookup deletes the lookup entries of the IPs of allocation. Entries
+// of IPs another allocation obtained in the meantime are kept.
+func removeLookup(tx *bolt.Tx, allocation *Allocation) error {
+	lookup := tx.Bucket(boltLookupBucket)
+	key := []byte(allocation.ID.String())
+	for _, ip := range allocation.IPs() {
+		if !bytes.Equal(lookup.Get([]byte(ip.String())), key) {
+			continue
+		}
+		if err := lookup.Delete([]byte(ip.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocationRevision returns the revision of the stored allocation with key
+// or 0 if it does not exist
+func allocationRevision(tx *bolt.Tx, key []byte) uint64 {
+	if v := tx.Bucket(boltRevisionsBucket).Get(key); v != nil {
+		return btoi(v)
+	}
+	return 0
+}
+
+// Allocations returns a list of all allocations
+func (s *boltStateManager) Allocations() ([]*Allocation, error) {
+	allocations := make([]*Allocation, 0)
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAllocationsBucket).ForEach(func(k, v []byte) error {
+			allocation, err := decode(v)
+			if err != nil {
+				return err
+			}
+			allocation.Revision = int64(allocationRevision(tx, k))
+			allocations = append(allocations, allocation)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+// Get returns the allocation with ID
+func (s *boltStateManager) Get(id uuid.UUID) (*Allocation, error) {
+	var allocation *Allocation
+	err := s.view(func(tx *bolt.Tx) error {
+		key := []byte(id.String())
+		v := tx.Bucket(boltAllocationsBucket).Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		var err error
+		if allocation, err = decode(v); err != nil {
+			return err
+		}
+		allocation.Revision = int64(allocationRevision(tx, key))
+		return nil
+	})
+	return allocation, err
+}
+
+// GetByIP returns the allocation assigned to ip
+func (s *boltStateManager) GetByIP(ip *net.IP) (*Allocation, error) {
+
+	if ip == nil {
+		return nil, errors.New("invalid argument. ip must not be nil")
+	}
+
+	var id uuid.UUID
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltLookupBucket).Get([]byte(ip.String()))
+		if v == nil {
+			return fmt.Errorf("No allocation for IP %s in index", ip.String())
+		}
+		var err error
+		id, err = uuid.ParseBytes(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(id)
+}
+
+// MACPool returns a list of available MAC addresses
+func (s *boltStateManager) MACPool() ([]string, error) {
+	macs := make([]string, 0)
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMACsBucket).ForEach(func(k, v []byte) error {
+			macs = append(macs, string(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return macs, nil
+}
+
+// Claims returns the claimed MACs and the IDs of the claiming allocations
+func (s *boltStateManager) Claims() (map[string]uuid.UUID, error) {
+	claims := make(map[string]uuid.UUID)
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltClaimsBucket).ForEach(func(k, v []byte) error {
+			id, err := uuid.Parse(string(v))
+			if err != nil {
+				log.Printf("Error deserialising claim of MAC [%s]", string(k))
+				return nil
+			}
+			claims[string(k)] = id
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// PutMAC puts a MAC into the pool of available MAC addresses
+func (s *boltStateManager) PutMAC(mac net.HardwareAddr) error {
+
+	if len(mac) == 0 {
+		return fmt.Errorf("Empty MAC")
+	}
+	amac := strings.ToLower(mac.String())
+
+	return s.update(func(tx *bolt.Tx) error {
+
+		// Check if MAC is already in use
+		err := tx.Bucket(boltAllocationsBucket).ForEach(func(k, v []byte) error {
+			al, err := decode(v)
+			if err != nil {
+				return err
+			}
+			if strings.ToLower(al.Interface.HardwareAddr.String()) == amac {
+				return fmt.Errorf("MAC address already in use by allocation [%s]", al.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltClaimsBucket).Delete([]byte(amac)); err != nil {
+			return err
+		}
+
+		macs := tx.Bucket(boltMACsBucket)
+		prev := copyBytes(macs.Get([]byte(amac)))
+		if err := macs.Put([]byte(amac), []byte(amac)); err != nil {
+			return err
+		}
+		return appendEvent(tx, &boltEvent{
+			Bucket:    string(boltMACsBucket),
+			Type:      boltEventPut,
+			Key:       amac,
+			Value:     []byte(amac),
+			PrevValue: prev,
+		})
+	})
+}
+
+// SeedMAC puts a MAC into the pool of available MAC addresses if it is
+// neither pooled, claimed nor used by an allocation
+func (s *boltStateManager) SeedMAC(mac net.HardwareAddr) (bool, error) {
+
+	if len(mac) == 0 {
+		return false, fmt.Errorf("Empty MAC")
+	}
+	amac := strings.ToLower(mac.String())
+
+	seeded := false
+	err := s.update(func(tx *bolt.Tx) error {
+		macs := tx.Bucket(boltMACsBucket)
+		if macs.Get([]byte(amac)) != nil || tx.Bucket(boltClaimsBucket).Get([]byte(amac)) != nil {
+			return nil
+		}
+		allocations := make([]*Allocation, 0)
+		err := tx.Bucket(boltAllocationsBucket).ForEach(func(k, v []byte) error {
+			al, err := decode(v)
+			if err != nil {
+				return err
+			}
+			allocations = append(allocations, al)
+			return nil
+		})
+		if err != nil || allocationWithMAC(allocations, amac) != nil {
+			return err
+		}
+
+		if err := macs.Put([]byte(amac), []byte(amac)); err != nil {
+			return err
+		}
+		seeded = true
+		return appendEvent(tx, &boltEvent{
+			Bucket: string(boltMACsBucket),
+			Type:   boltEventPut,
+			Key:    amac,
+			Value:  []byte(amac),
+		})
+	})
+	return seeded, err
+}
+
+// RemoveMAC removes a MAC and its claim from the pool
+func (s *boltStateManager) RemoveMAC(mac net.HardwareAddr) error {
+	amac := strings.ToLower(mac.String())
+
+	return s.update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltClaimsBucket).Delete([]byte(amac)); err != nil {
+			return err
+		}
+		macs := tx.Bucket(boltMACsBucket)
+		prev := copyBytes(macs.Get([]byte(amac)))
+		if prev == nil {
+			return nil
+		}
+		if err := macs.Delete([]byte(amac)); err != nil {
+			return err
+		}
+		return appendEvent(tx, &boltEvent{
+			Bucket:    string(boltMACsBucket),
+			Type:      boltEventDelete,
+			Key:       amac,
+			PrevValue: prev,
+		})
+	})
+}
+
+// PopMAC retrieves a MAC from the pool of available MAC addresses and records
+// the claim by the allocation with ID claimant
+func (s *boltStateManager) PopMAC(claimant uuid.UUID, accept func(net.HardwareAddr) bool) (net.HardwareAddr, error) {
+	var amac string
+	err := s.update(func(tx *bolt.Tx) error {
+		macs := tx.Bucket(boltMACsBucket)
+		c := macs.Cursor()
+		k, v := c.First()
+		for k != nil && !acceptMAC(accept, string(v)) {
+			k, v = c.Next()
+		}
+		if k == nil {
+			return errors.New("No available MAC")
+		}
+		amac = string(v)
+		key := copyBytes(k)
+		prev := copyBytes(v)
+
+		if err := macs.Delete(key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltClaimsBucket).Put(key, []byte(claimant.String())); err != nil {
+			return err
+		}
+		return appendEvent(tx, &boltEvent{
+			Bucket:    string(boltMACsBucket),
+			Type:      boltEventDelete,
+			Key:       string(key),
+			PrevValue: prev,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseMAC(amac)
+}
+
+// appendEvent records ev in the event log under the next revision and
+// trims the log to boltEventHistory entries
+func appendEvent(tx *bolt.Tx, ev *boltEvent) error {
+	revision := currentRevision(tx) + 1
+	ev.Revision = revision
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	events := tx.Bucket(boltEventsBucket)
+	if err := events.Put(itob(revision), b); err != nil {
+		return err
+	}
+	if revision > boltEventHistory {
+		if err := events.Delete(itob(revision - boltEventHistory)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltMetaBucket).Put(boltRevisionKey, itob(revision))
+}
+
+func currentRevision(tx *bolt.Tx) uint64 {
+	if v := tx.Bucket(boltMetaBucket).Get(boltRevisionKey); v != nil {
+		return btoi(v)
+	}
+	return 0
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+// copyBytes copies values obtained from bolt, which are only valid for
+// the duration of a transaction
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
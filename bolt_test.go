@@ -0,0 +1,295 @@
+package dhcpmanager
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltStateManager(t *testing.T, path string) *boltStateManager {
+	t.Helper()
+	sm, err := NewBoltStateManager(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sm.(*boltStateManager)
+	s.electionTTL = 300 * time.Millisecond
+	return s
+}
+
+func TestBoltPutGet(t *testing.T) {
+
+	sm := newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db"))
+	defer sm.Stop()
+
+	alloc := NewAllocation("test")
+	alloc.Lease = &dhclient.Lease{
+		FixedAddress: net.ParseIP("192.168.1.100"),
+		Expire:       time.Now().Add(time.Hour),
+	}
+	if err := sm.Put(alloc); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := sm.Get(alloc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(alloc, stored, t)
+
+	ip := net.ParseIP("192.168.1.100")
+	byIP, err := sm.GetByIP(&ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(alloc, byIP, t)
+
+	if err := sm.Remove(alloc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.GetByIP(&ip); err == nil {
+		t.Error("Lookup entry not removed with allocation")
+	}
+}
+
+func TestBoltWatch(t *testing.T) {
+
+	sm := newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db"))
+	defer sm.Stop()
+
+	created := make(chan *Allocation, 1)
+	modified := make(chan *Allocation, 1)
+	deleted := make(chan *Allocation, 1)
+	stop := sm.Watch(&AllocationWatcher{
+		OnCreate: func(a *Allocation) { created <- a },
+		OnModify: func(a *Allocation) { modified <- a },
+		OnDelete: func(a *Allocation) { deleted <- a },
+	})
+	defer stop()
+
+	alloc := NewAllocation("test")
+	sm.Put(alloc)
+	assertEvent(t, created, alloc)
+
+	alloc.State = Bound
+	sm.Put(alloc)
+	if a := assertEvent(t, modified, alloc); a.State != Bound {
+		t.Errorf("Expected state %d got %d", Bound, a.State)
+	}
+
+	sm.Remove(alloc)
+	assertEvent(t, deleted, alloc)
+}
+
+func TestBoltLookupOfReassignedIP(t *testing.T) {
+
+	sm := newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db"))
+	defer sm.Stop()
+
+	// The IP of a lost lease has been handed out to another allocation
+	ip := net.ParseIP("192.168.1.100")
+	lost := NewAllocation("lost")
+	lost.Lease = &dhclient.Lease{FixedAddress: ip, Expire: time.Now().Add(time.Hour)}
+	sm.Put(lost)
+	current := NewAllocation("current")
+	current.Lease = &dhclient.Lease{FixedAddress: ip, Expire: time.Now().Add(time.Hour)}
+	sm.Put(current)
+
+	if err := sm.Remove(lost); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := sm.GetByIP(&ip); err != nil || stored.ID != current.ID {
+		t.Errorf("Expected lookup of IP %s to be kept for the current allocation - %v", ip, err)
+	}
+}
+
+func TestBoltReopen(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	sm := newTestBoltStateManager(t, path)
+
+	// The database is locked while it is open
+	if _, err := NewBoltStateManager(path, 50*time.Millisecond); err == nil {
+		t.Error("Expected error opening a database in use")
+	}
+
+	alloc := NewAllocation("test")
+	if err := sm.Put(alloc); err != nil {
+		t.Fatal(err)
+	}
+	sm.Stop()
+
+	reopened := newTestBoltStateManager(t, path)
+	defer reopened.Stop()
+	stored, err := reopened.Get(alloc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(alloc, stored, t)
+}
+
+func TestBoltWatchRelist(t *testing.T) {
+
+	sm := newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db"))
+	defer sm.Stop()
+
+	kept := NewAllocation("kept")
+	removed := NewAllocation("removed")
+	sm.Put(kept)
+	sm.Put(removed)
+	w := sm.newBoltWatch(boltAllocationsBucket)
+
+	kept.Hostname = "modified"
+	sm.Put(kept)
+	sm.Remove(removed)
+	created := NewAllocation("created")
+	sm.Put(created)
+
+	// Trim the events the watch has not seen yet from the log
+	err := sm.update(func(tx *bolt.Tx) error {
+		for i := 0; i < boltEventHistory; i++ {
+			if err := appendEvent(tx, &boltEvent{Bucket: string(boltMetaBucket), Type: boltEventPut}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(map[uuid.UUID]AllocationEvent)
+	err = sm.view(func(tx *bolt.Tx) error {
+		evs, _, err := w.read(tx)
+		for _, ev := range evs {
+			event, err := ev.allocationEvent()
+			if err != nil {
+				return err
+			}
+			id, _ := uuid.Parse(ev.Key)
+			events[id] = event
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[uuid.UUID]EventType{
+		kept.ID:    EventModified,
+		removed.ID: EventDeleted,
+		created.ID: EventCreated,
+	}
+	if len(events) != len(expected) {
+		t.Errorf("Expected %d synthetic events got %d", len(expected), len(events))
+	}
+	for id, typ := range expected {
+		if event, ok := events[id]; !ok || event.Type != typ {
+			t.Errorf("Expected event %v for allocation %s got %v", typ, id, event.Type)
+		}
+	}
+	if events[kept.ID].New == nil || events[kept.ID].New.Hostname != "modified" {
+		t.Error("Synthetic event does not carry the modified allocation")
+	}
+}
+
+func TestBoltMACPool(t *testing.T) {
+
+	sm := newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db"))
+	defer sm.Stop()
+
+	popped := make(chan net.HardwareAddr, 1)
+	stop := sm.WatchMACPool(&MACPoolWatcher{
+		OnPop: func(mac net.HardwareAddr) { popped <- mac },
+	})
+	defer stop()
+
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	if err := sm.PutMAC(mac); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := sm.PopMAC(NewAllocation("test").ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.String() != mac.String() {
+		t.Errorf("Expected [%s] got [%s]", mac, claimed)
+	}
+	if _, err := sm.PopMAC(NewAllocation("test").ID, nil); err == nil {
+		t.Error("Expected empty MAC pool")
+	}
+
+	select {
+	case m := <-popped:
+		if m.String() != mac.String() {
+			t.Errorf("Expected [%s] got [%s]", mac, m)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout waiting for MAC pool event")
+	}
+}
+
+func TestBoltLeaseExpiry(t *testing.T) {
+
+	sm := newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db"))
+	defer sm.Stop()
+
+	alloc := NewAllocation("test")
+	alloc.Lease = &dhclient.Lease{
+		FixedAddress: net.ParseIP("192.168.1.100"),
+		Expire:       time.Now().Add(-time.Second),
+	}
+	sm.Put(alloc)
+
+	// Records are kept for a while after the lease expired
+	if err := sm.removeExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Get(alloc.ID); err != nil {
+		t.Errorf("Expected allocation to be kept - %v", err)
+	}
+
+	// Expired allocations are removed without maintaining indices
+	alloc.Lease.Expire = time.Now().Add(-expiredRecordGrace - time.Second)
+	sm.Put(alloc)
+	deadline := time.Now().Add(3 * boltExpiryInterval)
+	for {
+		if _, err := sm.Get(alloc.ID); err == ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expired allocation still present")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBoltUpdateConflict(t *testing.T) {
+	testUpdateConflict(newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db")), t)
+}
+
+func TestBoltWatchEvents(t *testing.T) {
+	testWatchEvents(newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db")), t)
+}
+
+func TestBoltClaims(t *testing.T) {
+	testClaims(newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db")), t)
+}
+
+func TestBoltSeedMAC(t *testing.T) {
+	testSeedMAC(newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db")), t)
+}
+
+func TestBoltCampaign(t *testing.T) {
+	testCampaign(newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db")), t)
+}
+
+func TestBoltNodes(t *testing.T) {
+	testNodes(newTestBoltStateManager(t, filepath.Join(t.TempDir(), "state.db")), t)
+}
@@ -0,0 +1,226 @@
+package dhcpmanager
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/uuid"
+)
+
+// LeaseState is the state of a lease kept alive by a DHCP client
+type LeaseState string
+
+const (
+	// LeaseBound = the lease is valid and not due for renewal
+	LeaseBound LeaseState = "bound"
+
+	// LeaseRenewing = the renewal time has passed and the client is extending
+	// the lease with the server that issued it
+	LeaseRenewing LeaseState = "renewing"
+
+	// LeaseRebinding = the rebinding time has passed and the client is
+	// extending the lease with any server
+	LeaseRebinding LeaseState = "rebinding"
+
+	// LeaseExpired = the lease has expired without being extended
+	LeaseExpired LeaseState = "expired"
+)
+
+// ClientInfo describes a running DHCP client and its lease
+type ClientInfo struct {
+	Allocation uuid.UUID
+	Interface  string
+	Hostname   string
+	IP         net.IP
+	State      LeaseState
+	Renew      time.Time
+	Rebind     time.Time
+	Expire     time.Time
+}
+
+// leaseState returns the state at now of a lease with the given times
+func leaseState(now, renew, rebind, expire time.Time) LeaseState {
+	switch {
+	case !now.Before(expire):
+		return LeaseExpired
+	case !now.Before(rebind):
+		return LeaseRebinding
+	case !now.Before(renew):
+		return LeaseRenewing
+	}
+	return LeaseBound
+}
+
+// managedClient is a running DHCPv4 or DHCPv6 client keeping ip alive for
+// an allocation
+type managedClient struct {
+	allocation uuid.UUID
+	iface      *net.Interface
+	hostname   string
+	ip         net.IP
+
+	// clientID is the client identifier (option 61) sent by the DHCPv4
+	// client or nil if the server identifies the client by its MAC
+	clientID []byte
+
+	// client is the DHCPv4 client and client6 the DHCPv6 client
+	client  DHCPClient
+	client6 DHCPv6Client
+
+	// lease is the current DHCPv4 lease. It is protected by the registry.
+	lease *dhclient.Lease
+
+	// renewed is signalled for renewed leases and done is closed when the
+	// client is stopped
+	renewed chan struct{}
+	done    chan struct{}
+}
+
+func newManagedClient(allocation *Allocation, iface *net.Interface) *managedClient {
+	return &managedClient{
+		allocation: allocation.ID,
+		iface:      iface,
+		hostname:   allocation.Hostname,
+		renewed:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// clientRegistry is the synchronized index of the running DHCP clients
+type clientRegistry struct {
+	mu      sync.RWMutex
+	clients map[string]*managedClient
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[string]*managedClient)}
+}
+
+// add registers client for ip with its first DHCPv4 lease, which is nil for
+// DHCPv6 clients. It returns false if ip is already managed by another
+// client.
+func (r *clientRegistry) add(client *managedClient, ip net.IP, lease *dhclient.Lease) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[ip.String()]; ok {
+		return false
+	}
+	client.ip, client.lease = ip, lease
+	r.clients[ip.String()] = client
+	return true
+}
+
+// remove unregisters and returns the client of ip or nil
+func (r *clientRegistry) remove(ip net.IP) *managedClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, ok := r.clients[ip.String()]
+	if !ok {
+		return nil
+	}
+	delete(r.clients, ip.String())
+	return client
+}
+
+// renew records a renewed DHCPv4 lease of client and returns the IP client
+// is registered for. Leases of clients that are not registered, because
+// binding failed or they have been stopped, are ignored. A client that
+// obtained a lease of another IP is unregistered, because it no longer keeps
+// the IP alive.
+func (r *clientRegistry) renew(client *managedClient, lease *dhclient.Lease) (net.IP, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if client.ip == nil || r.clients[client.ip.String()] != client {
+		return nil, false
+	}
+	if !lease.FixedAddress.Equal(client.ip) {
+		delete(r.clients, client.ip.String())
+		return client.ip, true
+	}
+	client.lease = lease
+	if client.renewed != nil {
+		select {
+		case client.renewed <- struct{}{}:
+		default:
+		}
+	}
+	return client.ip, true
+}
+
+// lease returns the current DHCPv4 lease of client
+func (r *clientRegistry) lease(client *managedClient) *dhclient.Lease {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return client.lease
+}
+
+// ip returns the IP client is registered for or nil if it is not registered
+func (r *clientRegistry) ip(client *managedClient) net.IP {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if client.ip == nil || r.clients[client.ip.String()] != client {
+		return nil
+	}
+	return client.ip
+}
+
+// describe describes client at now
+func (r *clientRegistry) describe(client *managedClient, now time.Time) ClientInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return client.info(now)
+}
+
+// get describes the client of ip
+func (r *clientRegistry) get(ip net.IP) (ClientInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, ok := r.clients[ip.String()]
+	if !ok {
+		return ClientInfo{}, false
+	}
+	return client.info(time.Now()), true
+}
+
+// ips returns the IPs of all clients
+func (r *clientRegistry) ips() []net.IP {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ips := make([]net.IP, 0, len(r.clients))
+	for _, client := range r.clients {
+		ips = append(ips, client.ip)
+	}
+	return ips
+}
+
+// info describes the client at now. The registry must be locked.
+func (c *managedClient) info(now time.Time) ClientInfo {
+	info := ClientInfo{
+		Allocation: c.allocation,
+		Interface:  c.iface.Name,
+		Hostname:   c.hostname,
+		IP:         c.ip,
+	}
+	if c.client6 != nil {
+		if lease := c.client6.Lease(); lease != nil {
+			info.Renew, info.Rebind, info.Expire = lease.Renew, lease.Rebind, lease.Expire
+		}
+	} else if c.lease != nil {
+		info.Renew, info.Rebind, info.Expire = c.lease.Renew, c.lease.Rebind, c.lease.Expire
+	}
+	info.State = leaseState(now, info.Renew, info.Rebind, info.Expire)
+	return info
+}
+
+// Client returns the DHCP client keeping ip alive
+func (c *DHCPController) Client(ip net.IP) (ClientInfo, bool) {
+	return c.clients.get(ip)
+}
@@ -0,0 +1,93 @@
+package dhcpmanager
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/uuid"
+)
+
+func TestClientRegistry(t *testing.T) {
+	c := NewDHCPController(nil, time.Second, true, false, false, false)
+	eth0 := &net.Interface{Name: "vf-eth0"}
+	eth1 := &net.Interface{Name: "vf-eth1"}
+	id := uuid.New()
+	now := time.Now()
+
+	// Register clients concurrently to be checked by the race detector
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			managed := &managedClient{allocation: uuid.New(), iface: eth1}
+			ip := net.ParseIP(fmt.Sprintf("10.0.1.%d", i))
+			if !c.clients.add(managed, ip, nil) {
+				t.Errorf("Could not register client for %s", ip)
+			}
+			c.clients.renew(managed, &dhclient.Lease{FixedAddress: ip, Renew: now.Add(time.Hour), Rebind: now.Add(2 * time.Hour), Expire: now.Add(3 * time.Hour)})
+			c.ManagedIPs()
+		}(i)
+	}
+	wg.Wait()
+
+	managed := &managedClient{allocation: id, iface: eth0, hostname: "web"}
+	lease := &dhclient.Lease{FixedAddress: net.ParseIP("10.0.0.1"), Renew: now.Add(-time.Minute), Rebind: now.Add(time.Hour), Expire: now.Add(2 * time.Hour)}
+	if !c.clients.add(managed, net.ParseIP("10.0.0.1"), lease) {
+		t.Fatal("Could not register client")
+	}
+	conflicting := &managedClient{allocation: uuid.New(), iface: eth0}
+	if c.clients.add(conflicting, net.ParseIP("10.0.0.1"), nil) {
+		t.Error("Expected conflict for managed IP")
+	}
+	if _, ok := c.clients.renew(conflicting, lease); ok || c.clients.ip(conflicting) != nil {
+		t.Error("Expected lease of unregistered client to be ignored")
+	}
+
+	if ips := c.ManagedIPs(); len(ips) != 11 {
+		t.Errorf("Expected 11 clients got %d", len(ips))
+	}
+	info, ok := c.Client(net.ParseIP("10.0.0.1"))
+	if !ok || info.Allocation != id || info.Hostname != "web" || info.Interface != "vf-eth0" {
+		t.Errorf("Unexpected client %+v", info)
+	}
+	if info.State != LeaseRenewing {
+		t.Errorf("Expected lease state %s got %s", LeaseRenewing, info.State)
+	}
+	if info, ok := c.Client(net.ParseIP("10.0.1.0")); !ok || info.Interface != "vf-eth1" || info.State != LeaseBound {
+		t.Errorf("Unexpected client %+v", info)
+	}
+
+	if c.clients.remove(net.ParseIP("10.0.0.1")) != managed {
+		t.Error("Expected removed client")
+	}
+	if _, ok := c.clients.renew(managed, lease); ok {
+		t.Error("Expected lease of removed client to be ignored")
+	}
+	if _, ok := c.Client(net.ParseIP("10.0.0.1")); ok {
+		t.Error("Expected no client for removed IP")
+	}
+	if len(c.ManagedIPs()) != 10 {
+		t.Errorf("Expected 10 managed IPs got %d", len(c.ManagedIPs()))
+	}
+}
+
+func TestLeaseState(t *testing.T) {
+	now := time.Now()
+	renew, rebind, expire := now.Add(time.Minute), now.Add(2*time.Minute), now.Add(3*time.Minute)
+	states := map[time.Time]LeaseState{
+		now:                     LeaseBound,
+		renew:                   LeaseRenewing,
+		rebind.Add(time.Second): LeaseRebinding,
+		expire:                  LeaseExpired,
+	}
+	for at, expected := range states {
+		if state := leaseState(at, renew, rebind, expire); state != expected {
+			t.Errorf("Expected %s at %s got %s", expected, at.Sub(now), state)
+		}
+	}
+}
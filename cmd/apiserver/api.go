@@ -7,6 +7,19 @@ import (
 // newIPRequest is send to Endpoint to request minting of a new IP
 type newIPRequest struct {
 	Service string `json:"service"` // Name of the service the IP is intended for
+	Node    string `json:"node"`    // Node to bind the IP on (optional)
+	Family  string `json:"family"`  // Address family ipv4, ipv6 or dual (optional)
+	Pool    string `json:"pool"`    // Pool to obtain the IP from (optional)
+	Device  string `json:"device"`  // Device mode overriding the controller configuration (optional)
+	VLAN    int    `json:"vlan"`    // VLAN ID of the device (optional)
+
+	Options dhcpOptions `json:"options"` // DHCP options sent to the DHCP server (optional)
+}
+
+type dhcpOptions struct {
+	ClientID    string `json:"clientId"`    // Client identifier (option 61)
+	VendorClass string `json:"vendorClass"` // Vendor class identifier (option 60)
+	FQDN        string `json:"fqdn"`        // Client FQDN for DNS updates (option 81)
 }
 
 // invalidateIPRequest is send to Endpoint to inform the service that
@@ -24,8 +37,22 @@ type validateIPRequest struct {
 // newIPRequestResponse is send as response to newIPRequest requests
 type newIPRequestResponse struct {
 	IP     string `json:"ip"`
+	IPv6   string `json:"ipv6,omitempty"`
 	ID     string `json:"id"`
+	Node   string `json:"node,omitempty"`
+	Pool   string `json:"pool,omitempty"`
 	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Network configuration received from the DHCP server
+	Config *networkConfig `json:"config,omitempty"`
+}
+
+type networkConfig struct {
+	DNS     []string `json:"dns,omitempty"`
+	Domain  string   `json:"domain,omitempty"`
+	Routers []string `json:"routers,omitempty"`
+	NTP     []string `json:"ntp,omitempty"`
 }
 
 // newIPRequestResponse is send as response to newIPRequest requests
@@ -62,6 +89,7 @@ type removeMACRequestResponse struct {
 type statusRequestResponse struct {
 	Allocations   []*dhcpmanager.Allocation
 	AvailableMACs []string
+	Pools         map[string]int // Number of allocations per pool
 }
 
 type apiEndpoint struct {
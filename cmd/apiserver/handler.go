@@ -1,13 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/kramergroup/dhcpmanager"
 )
@@ -21,42 +21,136 @@ func obtainIP(w http.ResponseWriter, r *http.Request) {
 	hostname := hostnameForService(ipRequest.Service)
 
 	allocation := dhcpmanager.NewAllocation(hostname)
+	family, err := dhcpmanager.ParseAddressFamily(ipRequest.Family)
+	if err != nil {
+		log.Printf("API: invalid request for %s - %s", allocation.Hostname, err.Error())
+		writeError(w, allocation.ID.String(), responseStatusError, err.Error())
+		return
+	}
+	allocation.Family = family
+	allocation.Pool = ipRequest.Pool
+
+	if ipRequest.Device != "" {
+		mode, err := dhcpmanager.ParseDeviceMode(ipRequest.Device)
+		if err == nil {
+			allocation.Device = &dhcpmanager.DeviceConfig{Mode: mode, VLAN: ipRequest.VLAN}
+			err = allocation.Device.Validate()
+		}
+		if err != nil {
+			log.Printf("API: invalid device for %s - %s", allocation.Hostname, err.Error())
+			writeError(w, allocation.ID.String(), responseStatusError, err.Error())
+			return
+		}
+	}
+
+	if o := ipRequest.Options; o.ClientID != "" || o.VendorClass != "" || o.FQDN != "" {
+		allocation.Options = &dhcpmanager.DHCPOptions{
+			ClientID:    o.ClientID,
+			VendorClass: o.VendorClass,
+			FQDN:        o.FQDN,
+		}
+		if err := allocation.Options.Validate(); err != nil {
+			log.Printf("API: invalid DHCP options for %s - %s", allocation.Hostname, err.Error())
+			writeError(w, allocation.ID.String(), responseStatusError, err.Error())
+			return
+		}
+	}
+
+	node, err := selectNode(ipRequest.Node)
+	if err != nil {
+		log.Printf("API: no node for %s - %s", allocation.Hostname, err.Error())
+		writeError(w, allocation.ID.String(), responseStatusError, err.Error())
+		return
+	}
+	allocation.Node = node
 
-	allocCh := make(chan net.IP)
-	watcher := dhcpmanager.AllocationWatcher{
-		OnModify: func(alloc *dhcpmanager.Allocation) {
-			if alloc.Lease != nil {
-				// We have obtained a lease. Report back IP
-				allocCh <- alloc.Lease.FixedAddress
+	ctx, cancel := context.WithTimeout(r.Context(), configuration.RequestTimeout)
+	defer cancel()
+	events := sm.WatchEvents(ctx, dhcpmanager.AllocationFilter{ID: allocation.ID})
+
+	// Only put allocation after watch is set to avoid race condition
+	if err := sm.Update(allocation, 0); err != nil {
+		log.Printf("API: error storing allocation for %s - %s", allocation.Hostname, err.Error())
+		writeError(w, allocation.ID.String(), responseStatusError, err.Error())
+		return
+	}
+
+	// Wait for the controller to obtain the leases. The channel is closed on timeout
+	var ip, ip6 net.IP
+	var config *dhcpmanager.NetworkConfig
+	failed := false
+	for ev := range events {
+		if ev.Type != dhcpmanager.EventModified {
+			continue
+		}
+		if ev.New.State == dhcpmanager.Failed {
+			failed = true
+			break
+		}
+		if ev.New.State == dhcpmanager.Bound && ev.New.Bound() {
+			if ev.New.Lease != nil {
+				ip = ev.New.Lease.FixedAddress
 			}
-		},
+			if ev.New.Lease6 != nil {
+				ip6 = ev.New.Lease6.Address
+			}
+			node = ev.New.Node
+			config = ev.New.Config
+			break
+		}
 	}
-	stopWatch := sm.WatchAllocation(allocation.ID, &watcher)
-	sm.Put(allocation) // Only put allocation after watch is set to avoid race condition
 
-	select {
-	case ip := <-allocCh:
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(newIPRequestResponse{
-			IP:     ip.String(),
+	if failed {
+		// The controller gave up binding the allocation
+		releaseAllocation(allocation, "binding failed")
+		writeError(w, allocation.ID.String(), responseStatusError, "binding failed")
+		log.Printf("API: ip request for %s failed", allocation.Hostname)
+	} else if ip != nil || ip6 != nil {
+		response := newIPRequestResponse{
 			ID:     allocation.ID.String(),
+			Node:   node,
+			Pool:   dhcpmanager.PoolName(allocation.Pool),
 			Status: newIPRequestResponseStatusOK,
-		})
-		log.Printf("API: ip %s assigned to %s ", ip, allocation.Hostname)
-	case <-time.After(configuration.RequestTimeout):
-		// No response from controller in time - Remove allocation and report back
-		sm.Remove(allocation)
-
+		}
+		if config != nil {
+			response.Config = &networkConfig{
+				DNS:     ipStrings(config.DNS),
+				Domain:  config.Domain,
+				Routers: ipStrings(config.Routers),
+				NTP:     ipStrings(config.NTP),
+			}
+		}
+		switch {
+		case ip == nil:
+			// IPv6 only allocations report the IPv6 address as ip
+			response.IP = ip6.String()
+		case ip6 == nil:
+			response.IP = ip.String()
+		default:
+			response.IP = ip.String()
+			response.IPv6 = ip6.String()
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(newIPRequestResponse{
-			IP:     "",
-			ID:     allocation.ID.String(),
-			Status: "timeout",
-		})
+		json.NewEncoder(w).Encode(response)
+		log.Printf("API: ip %s assigned to %s ", response.IP, allocation.Hostname)
+	} else {
+		// No response from controller in time - Release allocation and report back
+		releaseAllocation(allocation, "request timed out")
+		writeError(w, allocation.ID.String(), responseStatusTimeout, "request timed out")
 		log.Printf("API: ip request for %s timeout", allocation.Hostname)
 	}
+}
 
-	stopWatch()
+// writeError responds to the IP request of the allocation with id with status
+// and the error message msg
+func writeError(w http.ResponseWriter, id, status, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newIPRequestResponse{
+		IP:     "",
+		ID:     id,
+		Status: status,
+		Error:  msg,
+	})
 }
 
 func returnIP(w http.ResponseWriter, r *http.Request) {
@@ -81,7 +175,7 @@ func returnIP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("API: error obtaining allocation for IP %s - %s", ip.String(), err.Error())
 	} else {
-		err = sm.Remove(allocation)
+		err = releaseAllocation(allocation, "returned via API")
 	}
 
 	if err != nil {
@@ -100,6 +194,25 @@ func returnIP(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// releaseAllocation marks allocation as releasing for reason. The controller
+// releases its resources and removes it afterwards.
+func releaseAllocation(allocation *dhcpmanager.Allocation, reason string) error {
+	for {
+		if err := allocation.Transition(dhcpmanager.Releasing, reason); err != nil {
+			log.Printf("API: cannot return allocation %s - %s", allocation.ID, err.Error())
+			return err
+		}
+		err := sm.Update(allocation, allocation.Revision)
+		if err != dhcpmanager.ErrConflict {
+			return err
+		}
+		// Modified concurrently - retry with the current state
+		if allocation, err = sm.Get(allocation.ID); err != nil {
+			return err
+		}
+	}
+}
+
 func registerMACs(w http.ResponseWriter, r *http.Request) {
 	request := new(registerMACRequest)
 	json.NewDecoder(r.Body).Decode(request)
@@ -160,12 +273,54 @@ func returnStatus(w http.ResponseWriter, r *http.Request) {
 	status := statusRequestResponse{
 		Allocations:   allocations,
 		AvailableMACs: macs,
+		Pools:         make(map[string]int),
+	}
+	for _, allocation := range allocations {
+		status.Pools[dhcpmanager.PoolName(allocation.Pool)]++
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
 }
 
+// selectNode returns the requested node if it is live. Without a requested
+// node, the least loaded live node is selected. No node is selected if no
+// controller runs with sharding, in which case any controller binds the
+// allocation.
+func selectNode(requested string) (string, error) {
+	nodes, err := sm.Nodes()
+	if err != nil {
+		return "", err
+	}
+
+	if requested != "" {
+		for _, node := range nodes {
+			if node == requested {
+				return node, nil
+			}
+		}
+		return "", fmt.Errorf("Node %s is not live", requested)
+	}
+
+	if len(nodes) == 0 {
+		return "", nil
+	}
+	allocations, err := sm.Allocations()
+	if err != nil {
+		return "", err
+	}
+	return dhcpmanager.LeastLoadedNode(nodes, allocations), nil
+}
+
+// ipStrings converts ips into their string representation
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
 // hostnameForService converts "namespace/service" service identifiers into
 // proper hostnames of the form "service.namespace"
 func hostnameForService(svc string) string {
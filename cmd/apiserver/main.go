@@ -14,8 +14,15 @@ import (
 
 // Configuration holds the global apiserver configuration
 type Configuration struct {
-	Port           int
-	Cidrs          []string
+	Port  int
+	Cidrs []string
+
+	// Store is the state store URL: etcd://<endpoints>,
+	// bolt:///<path to database file>, kubernetes://<namespace> or
+	// memory://. The bolt database is locked by the apiserver and the memory
+	// store is not shared with the controller. The etcd endpoints are used
+	// if empty
+	Store          string
 	Etcd           []string
 	RequestTimeout time.Duration `mapstructure:"request-timeout"`
 	DialTimeout    time.Duration `mapstructure:"dial-timeout"`
@@ -30,7 +37,7 @@ func main() {
 	processConfiguration()
 
 	var err error
-	sm, err = dhcpmanager.NewStateManager(configuration.Etcd, configuration.DialTimeout, configuration.RequestTimeout)
+	sm, err = dhcpmanager.OpenStateManager(configuration.Store, configuration.Etcd, configuration.DialTimeout, configuration.RequestTimeout)
 	if err == nil {
 		ListenAndServe()
 	} else {
@@ -72,6 +79,7 @@ func processConfiguration() {
 	viper.SetEnvPrefix("DHCP")
 	viper.AutomaticEnv()
 
+	viper.SetDefault("store", "")
 	viper.SetDefault("etcd", []string{"etcd:2379"})
 	viper.SetDefault("port", 8000)
 	viper.SetDefault("dial-timeout", "5s")
@@ -90,6 +98,7 @@ func processConfiguration() {
 	log.Printf("[config]            port: %d", configuration.Port)
 	log.Printf("[config] request-timeout: %s", configuration.RequestTimeout)
 	log.Printf("[config]    dial-timeout: %s", configuration.DialTimeout)
+	log.Printf("[config]           store: %s", configuration.Store)
 	log.Printf("[config]            etcd: %s", configuration.Etcd)
 	log.Printf("[config]           cidrs: %s", configuration.Cidrs)
 }
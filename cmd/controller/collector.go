@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/google/uuid"
+	dhcpmanager "github.com/kramergroup/dhcpmanager"
+)
+
+// CollectReport lists the devices found on the parent interfaces when the
+// controller takes over the allocations
+type CollectReport struct {
+	AdoptedDevices []string
+	RemovedDevices []string
+}
+
+// collectDevices matches the devices on the parent interfaces against the
+// bound and stopped allocations processed by this controller. A device with
+// the name and MAC of such an allocation is adopted and used to bind the
+// allocation again. All other devices have been left behind by a controller
+// that terminated without stopping its allocations and are removed.
+func (c *Controller) collectDevices(allocations []*dhcpmanager.Allocation) (*CollectReport, error) {
+
+	ifaces, err := c.dhcp.PoolDevices()
+	if err != nil {
+		return nil, fmt.Errorf("could not list devices - %s", err.Error())
+	}
+
+	owners := make(map[string]*dhcpmanager.Allocation)
+	for _, allocation := range allocations {
+		if !allocation.State.Active() && allocation.State != dhcpmanager.Stopped {
+			continue
+		}
+		if c.node != "" && allocation.Node != c.node {
+			continue
+		}
+		if allocation.Interface.Name != "" {
+			owners[allocation.Interface.Name] = allocation
+		}
+	}
+
+	report := &CollectReport{}
+	adopted := make(map[uuid.UUID]net.Interface)
+	for _, iface := range ifaces {
+		allocation, ok := owners[iface.Name]
+		if ok && strings.EqualFold(iface.HardwareAddr.String(), allocation.Interface.HardwareAddr.String()) {
+			log.Printf("Controller: adopted device %s of allocation %s", iface.Name, allocation.ID)
+			adopted[allocation.ID] = iface
+			report.AdoptedDevices = append(report.AdoptedDevices, iface.Name)
+			continue
+		}
+
+		if err := c.dhcp.RemoveDevice(&iface); err != nil {
+			log.Printf("Warning: Could not remove orphaned device [%s] - %s", iface.Name, err.Error())
+			continue
+		}
+		log.Printf("Controller: removed orphaned device %s", iface.Name)
+		report.RemovedDevices = append(report.RemovedDevices, iface.Name)
+	}
+
+	c.mu.Lock()
+	c.adopted = adopted
+	c.mu.Unlock()
+	return report, nil
+}
+
+// adoptDevice returns the adopted device of allocation. Devices are adopted
+// only once.
+func (c *Controller) adoptDevice(allocation *dhcpmanager.Allocation) (*net.Interface, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	iface, ok := c.adopted[allocation.ID]
+	delete(c.adopted, allocation.ID)
+	if !ok || iface.Name != allocation.Interface.Name {
+		return nil, false
+	}
+	return &iface, true
+}
+
+func (r *CollectReport) String() string {
+	return fmt.Sprintf("adopted %d devices %v, removed %d devices %v",
+		len(r.AdoptedDevices), r.AdoptedDevices, len(r.RemovedDevices), r.RemovedDevices)
+}
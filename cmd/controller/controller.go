@@ -1,271 +1,964 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/uuid"
 	dhcpmanager "github.com/kramergroup/dhcpmanager"
+	"k8s.io/client-go/util/workqueue"
 )
 
-// Controller handles state changes to DHCP leases
+const (
+	// retryBaseDelay and retryMaxDelay bound the exponential backoff of
+	// failed reconciliations
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 5 * time.Minute
+)
+
+// maxDeviceNameAttempts is the number of alternative device names tried if
+// the name derived from an allocation ID is taken
+const maxDeviceNameAttempts = 9
+
+// electionRetryDelay is the time to wait before campaigning again after a
+// failed leader election
+const electionRetryDelay = 5 * time.Second
+
+// Controller handles state changes to DHCP leases. Changes are processed
+// level-triggered: watch events and periodic resyncs only enqueue allocation
+// IDs, and each reconciliation drives the allocation towards its desired
+// state based on the current stored state.
+//
+// With leader election enabled, several controllers can run for high
+// availability. Only the elected leader processes allocations. With sharding
+// enabled, every controller processes the allocations assigned to its node
+// and claims unassigned allocations and those of failed nodes.
 type Controller struct {
 	sm                dhcpmanager.StateManager
 	dhcp              *dhcpmanager.DHCPController
-	watchStopFunc     func()
 	createInterfaces  bool
 	dynamicInterfaces bool
+	resyncInterval    time.Duration
+	maxRetries        int
+	identity          string
+	leaderElection    bool
+	node              string
+	reacquireTimeout  time.Duration
+	reapInterval      time.Duration
+
+	queue  workqueue.RateLimitingInterface
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// mu protects bound, deleted, adopted, nodes and reacquiring
+	mu sync.Mutex
+
+	// bound are the allocations bound by this controller
+	bound map[uuid.UUID]*dhcpmanager.Allocation
+
+	// deleted are the last known states of deleted allocations that have not
+	// been reconciled yet
+	deleted map[uuid.UUID]*dhcpmanager.Allocation
+
+	// nodes are the live nodes as of the last resync. It is nil until the
+	// nodes have been read successfully.
+	nodes map[string]bool
+
+	// adopted are the devices left behind by a previous controller that are
+	// used to bind their stopped allocations again
+	adopted map[uuid.UUID]net.Interface
+
+	// reacquiring are the timeouts of lost allocations whose IPs are being
+	// reacquired
+	reacquiring map[uuid.UUID]*time.Timer
 }
 
 // NewController creates a new controller
-func NewController(StateManager dhcpmanager.StateManager, client *dhcpmanager.DHCPController, manageInterfaces, dynamicInterfaces bool) *Controller {
+func NewController(StateManager dhcpmanager.StateManager, client *dhcpmanager.DHCPController, manageInterfaces, dynamicInterfaces bool,
+	resyncInterval time.Duration, maxRetries int) *Controller {
 	c := Controller{
 		sm:                StateManager,
 		dhcp:              client,
 		createInterfaces:  manageInterfaces,
 		dynamicInterfaces: dynamicInterfaces,
+		resyncInterval:    resyncInterval,
+		maxRetries:        maxRetries,
+		bound:             make(map[uuid.UUID]*dhcpmanager.Allocation),
+		deleted:           make(map[uuid.UUID]*dhcpmanager.Allocation),
+		adopted:           make(map[uuid.UUID]net.Interface),
+		reacquiring:       make(map[uuid.UUID]*time.Timer),
 	}
+	client.OnLeaseEvent(c.handleLeaseEvent)
 	return &c
 }
 
+// EnableLeaderElection lets the controller only process allocations while it
+// is the leader among all controllers campaigning with the state manager
+func (c *Controller) EnableLeaderElection(identity string) {
+	c.identity = identity
+	c.leaderElection = true
+}
+
+// EnableSharding lets the controller only process allocations assigned to
+// node. Unassigned allocations and allocations of nodes that are no longer
+// live are claimed by assigning them to node.
+func (c *Controller) EnableSharding(node string) {
+	c.node = node
+}
+
+// EnableReacquire lets the controller keep the allocations of lost leases
+// for timeout while their DHCP clients try to obtain the same IPs again.
+// Allocations of lost leases are removed immediately otherwise.
+func (c *Controller) EnableReacquire(timeout time.Duration) {
+	c.reacquireTimeout = timeout
+}
+
+// EnableReaper lets the controller run a Reaper every interval while it
+// processes allocations
+func (c *Controller) EnableReaper(interval time.Duration) {
+	c.reapInterval = interval
+}
+
 // Start the controller main loop
 func (c *Controller) Start() {
-	if c.watchStopFunc == nil {
-		c.converge()
-		go c.watch()
+	if c.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+		if c.node != "" && !c.registerNode(ctx) {
+			return
+		}
+		if !c.leaderElection {
+			c.takeover()
+			c.lead(ctx)
+			c.stopAllocations()
+			return
+		}
+		c.campaign(ctx)
+	}()
+}
+
+// registerNode registers the node of the controller for sharding. The store
+// may be unavailable for a while - keep trying until it answers or ctx is
+// cancelled. It reports whether the node has been registered.
+func (c *Controller) registerNode(ctx context.Context) bool {
+	for delay := retryBaseDelay; ; delay *= 2 {
+		err := c.sm.RegisterNode(ctx, c.node)
+		if err == nil {
+			log.Printf("Controller: registered node %s", c.node)
+			return true
+		}
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		log.Printf("Warning: Could not register node %s - %s (retrying in %s)", c.node, err.Error(), delay)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
 	}
 }
 
-// Stop stops the controller operation
+// Stop stops the controller operation. Allocations bound by the controller are
+// marked as stopped before the leadership is resigned, so that they are bound
+// again by the next leader.
 func (c *Controller) Stop() {
-	if c.watchStopFunc != nil {
-		c.watchStopFunc()
-	}
-	if allocations, err := c.sm.Allocations(); err == nil {
-		for _, allocation := range allocations {
-			if allocation.State == dhcpmanager.Bound {
-				if allocation.Lease != nil {
-					c.dhcp.Stop(&allocation.Lease.FixedAddress)
-				}
-				if c.createInterfaces {
-					dhcpmanager.RemoveDevice(&allocation.Interface)
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+	c.cancel = nil
+}
+
+// campaign runs for leadership until ctx is cancelled and processes
+// allocations while elected
+func (c *Controller) campaign(ctx context.Context) {
+	for ctx.Err() == nil {
+		log.Printf("Controller: %s campaigning for leadership", c.identity)
+		leaderCtx, resign, err := c.sm.Campaign(ctx, c.identity)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Warning: Leader election failed - %s", err.Error())
+				select {
+				case <-ctx.Done():
+				case <-time.After(electionRetryDelay):
 				}
-				allocation.State = dhcpmanager.Stopped
-				c.sm.Put(allocation)
 			}
+			continue
+		}
+
+		log.Printf("Controller: %s elected leader", c.identity)
+		c.takeover()
+		c.lead(leaderCtx)
+
+		if ctx.Err() != nil {
+			c.stopAllocations()
+		} else {
+			// Another controller takes over - free the devices and MACs
+			log.Printf("Controller: %s lost leadership", c.identity)
+			c.release()
 		}
+		resign()
 	}
-	c.watchStopFunc = nil
 }
 
-func (c *Controller) converge() {
+// lead processes allocations until ctx is cancelled
+func (c *Controller) lead(ctx context.Context) {
 
-	// Enque all leases for renewal
+	c.queue = workqueue.NewRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(retryBaseDelay, retryMaxDelay))
+
+	// Establish the watch before the initial resync to not miss any changes.
+	// The store may be unavailable for a while - keep trying until it answers
+	// or the leadership ends.
+	events := c.sm.WatchEvents(ctx, dhcpmanager.AllocationFilter{})
+	for delay := retryBaseDelay; ; delay *= 2 {
+		err := c.resync()
+		if err == nil {
+			break
+		}
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		log.Printf("Warning: Could not read allocations - %s (retrying in %s)", err.Error(), delay)
+		select {
+		case <-ctx.Done():
+			c.queue.ShutDown()
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.watch(events)
+	}()
+	go func() {
+		defer wg.Done()
+		c.resyncLoop(ctx)
+	}()
+	if c.reapInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			NewReaper(c.sm, c.dhcp, c.createInterfaces, c.node).Run(ctx, c.reapInterval)
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+
+	c.worker(ctx)
+	wg.Wait()
+}
+
+// takeover marks allocations that are bound, but not by this controller, as
+// stopped. These have been bound by a previous leader that terminated without
+// stopping them and are bound again by the reconciliation. Devices left
+// behind on this host are adopted or removed first.
+func (c *Controller) takeover() {
 	allocations, err := c.sm.Allocations()
 	if err != nil {
-		log.Fatalf("Could not read leases from kv store. [%s]", err.Error())
+		log.Printf("Warning: Could not take over allocations - %s", err.Error())
+		return
+	}
+
+	if c.createInterfaces {
+		report, err := c.collectDevices(allocations)
+		if err != nil {
+			log.Printf("Warning: Could not collect devices - %s", err.Error())
+		} else {
+			log.Printf("Controller: %s", report)
+		}
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, allocation := range allocations {
-		switch allocation.State {
-		// This is a gracefully stopped allocation - try to resurrect
-		case dhcpmanager.Stopped:
-			c.processStoppedAllocation(allocation)
-		// This is a new allocation that has never been assigned
-		case dhcpmanager.Unbound:
-			c.processUnboundAllocation(allocation)
-		// This is a stale allocation
-		case dhcpmanager.Stale:
-			log.Printf("Stale allocation [%s] removed", allocation.ID)
-			c.deleteAllocation(allocation)
-		// This is an already bound allocation
-		case dhcpmanager.Bound:
+		if _, ok := c.bound[allocation.ID]; ok || !allocation.State.Active() {
+			continue
+		}
+		if c.node != "" && allocation.Node != c.node {
+			continue
+		}
+		if err := allocation.Transition(dhcpmanager.Stopped, "taken over from terminated controller"); err != nil {
+			log.Printf("Warning: Could not take over allocation %s - %s", allocation.ID, err.Error())
+			continue
+		}
+		if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+			log.Printf("Warning: Could not take over allocation %s - %s", allocation.ID, err.Error())
+			continue
+		}
+		log.Printf("Controller: took over allocation %s", allocation.ID)
+	}
+}
 
+// stopAllocations stops the DHCP clients and devices of all allocations bound
+// by this controller and marks the allocations as stopped
+func (c *Controller) stopAllocations() {
+	c.mu.Lock()
+	bound := c.bound
+	c.bound = make(map[uuid.UUID]*dhcpmanager.Allocation)
+	c.deleted = make(map[uuid.UUID]*dhcpmanager.Allocation)
+	c.mu.Unlock()
+
+	for id, local := range bound {
+		c.stopAllocation(local)
+
+		allocation, err := c.sm.Get(id)
+		if err != nil || !allocation.State.Active() {
+			continue
+		}
+		if err := allocation.Transition(dhcpmanager.Stopped, "controller stopped"); err != nil {
+			log.Printf("Warning: Could not mark allocation %s as stopped - %s", allocation.ID, err.Error())
+			continue
+		}
+		if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+			log.Printf("Warning: Could not mark allocation %s as stopped - %s", allocation.ID, err.Error())
 		}
 	}
 }
 
-func (c *Controller) processUnboundAllocation(allocation *dhcpmanager.Allocation) {
+// release stops the DHCP clients and devices of all allocations bound by this
+// controller without modifying the stored allocations
+func (c *Controller) release() {
+	c.mu.Lock()
+	bound := c.bound
+	c.bound = make(map[uuid.UUID]*dhcpmanager.Allocation)
+	c.deleted = make(map[uuid.UUID]*dhcpmanager.Allocation)
+	c.mu.Unlock()
+
+	for _, allocation := range bound {
+		c.stopAllocation(allocation)
+	}
+}
 
-	renewCallback := func(iface *net.Interface, lease *dhclient.Lease) {
-		allocation.Lease = lease
-		if err := c.sm.Put(allocation); err != nil {
-			log.Printf("Warning: Error persisting allocation for IP %s = %s", lease.FixedAddress.String(), err.Error())
+func (c *Controller) stopAllocation(allocation *dhcpmanager.Allocation) {
+	for _, ip := range allocation.IPs() {
+		c.dhcp.Stop(&ip)
+	}
+	if c.createInterfaces {
+		c.dhcp.RemoveDevice(&allocation.Interface)
+	}
+}
+
+// resync enqueues all stored and locally bound allocations and refreshes
+// the live nodes
+func (c *Controller) resync() error {
+	allocations, err := c.sm.Allocations()
+	if err != nil {
+		return err
+	}
+	if c.node != "" {
+		c.refreshNodes()
+	}
+	for _, allocation := range allocations {
+		c.queue.Add(allocation.ID)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.bound {
+		c.queue.Add(id)
+	}
+	return nil
+}
+
+// refreshNodes reads the live nodes. The previous nodes are kept if the
+// nodes cannot be read.
+func (c *Controller) refreshNodes() {
+	nodes, err := c.sm.Nodes()
+	if err != nil {
+		log.Printf("Warning: Could not read nodes - %s", err.Error())
+		return
+	}
+
+	live := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		live[node] = true
+	}
+	c.mu.Lock()
+	c.nodes = live
+	c.mu.Unlock()
+}
+
+func (c *Controller) resyncLoop(ctx context.Context) {
+	if c.resyncInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.resync(); err != nil {
+				log.Printf("Warning: Could not resync allocations - %s", err.Error())
+			}
+		}
+	}
+}
+
+// worker processes the queue until it is shut down. Queued allocations are
+// discarded once ctx is cancelled.
+func (c *Controller) worker(ctx context.Context) {
+	for {
+		item, shutdown := c.queue.Get()
+		if shutdown {
+			return
+		}
+		id := item.(uuid.UUID)
+		if ctx.Err() != nil {
+			c.queue.Done(id)
+			continue
+		}
+
+		err := c.reconcile(id)
+		switch {
+		case err == nil:
+			c.queue.Forget(id)
+		case c.queue.NumRequeues(id) < c.maxRetries:
+			log.Printf("Warning: Could not reconcile allocation %s - %s (retrying)", id, err.Error())
+			c.queue.AddRateLimited(id)
+		default:
+			log.Printf("Warning: Could not reconcile allocation %s - %s (giving up)", id, err.Error())
+			c.queue.Forget(id)
+			c.markFailed(id, err.Error())
+		}
+		c.queue.Done(id)
+	}
+}
+
+// reconcile drives the allocation with id towards its desired state
+func (c *Controller) reconcile(id uuid.UUID) error {
+
+	allocation, err := c.sm.Get(id)
+	if err == dhcpmanager.ErrNotFound {
+		// Release everything bound to a removed allocation
+		c.mu.Lock()
+		removed, ok := c.bound[id]
+		if !ok {
+			removed, ok = c.deleted[id]
+		}
+		delete(c.bound, id)
+		delete(c.deleted, id)
+		delete(c.adopted, id)
+		c.mu.Unlock()
+		if ok {
+			c.deleteAllocation(removed)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	owned, err := c.claim(allocation)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		// The allocation is processed on another node - release it locally
+		c.mu.Lock()
+		local, ok := c.bound[id]
+		delete(c.bound, id)
+		c.mu.Unlock()
+		if ok {
+			log.Printf("Controller: allocation %s moved to node %s", id, allocation.Node)
+			c.stopAllocation(local)
+		}
+		return nil
+	}
+
+	switch allocation.State {
+	// This is a gracefully stopped allocation - try to resurrect
+	case dhcpmanager.Stopped:
+		return c.processStoppedAllocation(allocation)
+	// This is a new allocation that has never been assigned or whose binding
+	// was interrupted
+	case dhcpmanager.Unbound, dhcpmanager.Binding:
+		return c.processUnboundAllocation(allocation)
+	// This is a stale allocation
+	case dhcpmanager.Stale:
+		log.Printf("Stale allocation [%s] removed", allocation.ID)
+		return c.startReleasing(allocation, "stale")
+	// This allocation has been returned
+	case dhcpmanager.Releasing:
+		return c.processReleasingAllocation(allocation)
+	// This allocation has been released, but not removed
+	case dhcpmanager.Released:
+		if err := c.sm.Remove(allocation); err != nil {
+			return err
+		}
+		c.returnMAC(allocation)
+	// This is an already bound allocation
+	case dhcpmanager.Bound, dhcpmanager.Renewing, dhcpmanager.Rebinding, dhcpmanager.Lost:
+	// This allocation has been given up
+	case dhcpmanager.Failed:
+	}
+	return nil
+}
+
+// claim reports whether the allocation is processed by this controller. With
+// sharding, unassigned allocations and allocations of nodes that are no longer
+// live are assigned to this controller's node. Bound allocations of failed
+// nodes are marked as stopped to bind them again on this node.
+func (c *Controller) claim(allocation *dhcpmanager.Allocation) (bool, error) {
+	if c.node == "" || allocation.Node == c.node {
+		return true, nil
+	}
+
+	c.mu.Lock()
+	live := c.nodes == nil || c.nodes[allocation.Node]
+	c.mu.Unlock()
+	if allocation.Node != "" && live {
+		return false, nil
+	}
+	if allocation.State == dhcpmanager.Failed {
+		return false, nil
+	}
+
+	previous := allocation.Node
+	allocation.Node = c.node
+	if allocation.State.Active() {
+		if err := allocation.Transition(dhcpmanager.Stopped, fmt.Sprintf("node %s failed", previous)); err != nil {
+			return false, err
 		}
 	}
+	if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+		if err == dhcpmanager.ErrConflict {
+			// Claimed or modified concurrently - the change is reconciled again
+			return false, nil
+		}
+		return false, err
+	}
+
+	if previous == "" {
+		log.Printf("Controller: claimed allocation %s", allocation.ID)
+	} else {
+		log.Printf("Controller: took over allocation %s from node %s", allocation.ID, previous)
+	}
+	return true, nil
+}
+
+// markFailed marks an allocation that could not be reconciled as failed
+func (c *Controller) markFailed(id uuid.UUID, reason string) {
+	allocation, err := c.sm.Get(id)
+	if err != nil {
+		return
+	}
+	if allocation.State != dhcpmanager.Unbound && allocation.State != dhcpmanager.Binding && allocation.State != dhcpmanager.Stopped {
+		return
+	}
+	if err := allocation.Transition(dhcpmanager.Failed, reason); err != nil {
+		log.Printf("Warning: Could not mark allocation %s as failed - %s", id, err.Error())
+		return
+	}
+	if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+		log.Printf("Warning: Could not mark allocation %s as failed - %s", id, err.Error())
+	}
+}
+
+func (c *Controller) processUnboundAllocation(allocation *dhcpmanager.Allocation) error {
+
+	if _, err := c.dhcp.Pool(allocation.Pool); err != nil {
+		// Retrying does not help if the pool is not configured
+		log.Printf("Warning: Allocation %s cannot be bound - %s", allocation.ID, err.Error())
+		c.markFailed(allocation.ID, err.Error())
+		return nil
+	}
 
+	if allocation.State == dhcpmanager.Unbound {
+		if err := allocation.Transition(dhcpmanager.Binding, "binding started"); err != nil {
+			return err
+		}
+		if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+			if err == dhcpmanager.ErrConflict {
+				// The change has been enqueued by the watch
+				return nil
+			}
+			return err
+		}
+	}
+
+	// popped is the MAC taken from the pool for this attempt. It is returned
+	// if the allocation cannot be bound.
 	var iface *net.Interface
+	var popped net.HardwareAddr
 	if c.createInterfaces {
-		var err error
-		ifName := fmt.Sprintf("vf-%s", randomString(6))
-		mac, err := c.sm.PopMAC()
+		device, err := c.dhcp.Device(allocation.Pool, allocation.Device)
 		if err != nil {
-			if !c.dynamicInterfaces {
-				log.Print("Warning: No valid MAC address")
-				return
+			return err
+		}
+		allocation.Device = &device
+
+		var mac net.HardwareAddr
+		if device.UsesMAC() {
+			mac, err = c.sm.PopMAC(allocation.ID, c.dhcp.AcceptsMAC(allocation.Pool))
+			if err != nil {
+				if !c.dynamicInterfaces {
+					return errors.New("No valid MAC address")
+				}
+				mac = nil // causes randomn MAC generation in dhclient
+			}
+			popped = mac
+		}
+		var ifName string
+		for attempt := 0; ; attempt++ {
+			ifName = dhcpmanager.DeviceName(allocation.ID, attempt)
+			iface, err = c.dhcp.CreateDevice(ifName, dhcpmanager.DeviceAlias(allocation), &mac, allocation.Pool, allocation.Device)
+			if !errors.Is(err, os.ErrExist) || attempt == maxDeviceNameAttempts {
+				break
 			}
-			mac = nil // causes randomn MAC generation in dhclient
+			log.Printf("Warning: Device name %s of allocation %s is taken", ifName, allocation.ID)
 		}
-		iface, err = c.dhcp.CreateDevice(ifName, &mac)
 		if err != nil {
-			log.Printf("Warning: Could not create device [%s] - %s", ifName, err.Error())
-
-			// Not sure if the allocation should be deleted at this point. Probably not
-			// to give others the option to process it
-			// c.deleteAllocation(allocation)
-
-			// make sure the mac is returned
-			// At this point it is probably not be bound to the allocation and is, therefore,
-			// not released when the allocation is deleted
-			if allocation.Interface.HardwareAddr.String() != mac.String() {
-				c.sm.PutMAC(mac)
+			// The MAC is not bound to the allocation yet and would not be
+			// returned when the allocation is deleted
+			if popped != nil {
+				c.sm.PutMAC(popped)
 			}
-			return
+			return fmt.Errorf("Could not create device [%s] - %s", ifName, err.Error())
 		}
 	} else {
 		var err error
-		iface, err = c.dhcp.Interface()
+		iface, err = c.dhcp.Interface(allocation.Pool)
 		if err != nil {
-			log.Printf("Warning: Could not access device")
-			// Not sure if the allocation should be deleted at this point. Probably not
-			// to give others the option to process it. It's the job of the creator to
-			// remove stale allocations
-			// c.deleteAllocation(allocation)
-			return
+			return fmt.Errorf("Could not access device - %s", err.Error())
 		}
 	}
 
-	lease, err := c.dhcp.BindAllocationToInterface(allocation, iface, renewCallback)
-	if err != nil {
-		log.Printf("Warning: Could not bind allocation [%s] to device [%s]", allocation.ID, allocation.Interface.Name)
-		c.sm.Remove(allocation)
-		return
+	if err := c.bindLeases(allocation, iface); err != nil {
+		if c.createInterfaces {
+			// Release the device and MAC to retry with fresh ones
+			c.dhcp.RemoveDevice(iface)
+			if popped != nil {
+				c.sm.PutMAC(popped)
+			}
+		}
+		return fmt.Errorf("Could not bind allocation [%s] to device [%s] - %s", allocation.ID, iface.Name, err.Error())
 	}
-	allocation.Lease = lease
 	allocation.Interface = *iface
-	allocation.State = dhcpmanager.Bound
+	if err := allocation.Transition(dhcpmanager.Bound, "leases obtained"); err != nil {
+		c.deleteAllocation(allocation)
+		return err
+	}
 
-	if err := c.sm.Put(allocation); err != nil {
-		log.Printf("Warning: Error persisting allocation for IP %s = %s", lease.FixedAddress.String(), err.Error())
+	if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+		log.Printf("Warning: Error persisting allocation for IP %s = %s", allocation.IPs(), err.Error())
+		// The allocation has been modified or removed while binding (e.g. the
+		// request timed out) or could not be stored - release everything bound to it
+		c.deleteAllocation(allocation)
+		if err == dhcpmanager.ErrConflict {
+			// The change has been enqueued by the watch
+			return nil
+		}
+		return err
 	}
+	c.setBound(allocation)
 
 	log.Printf("Allocation %s bound to interface %s with IP %s (%s)",
-		allocation.ID, allocation.Interface.Name, allocation.Lease.FixedAddress, allocation.Hostname)
+		allocation.ID, allocation.Interface.Name, allocation.IPs(), allocation.Hostname)
+	return nil
 }
 
-func (c *Controller) processStoppedAllocation(allocation *dhcpmanager.Allocation) {
+// startReleasing persists the allocation as releasing for reason before its
+// resources are released
+func (c *Controller) startReleasing(allocation *dhcpmanager.Allocation, reason string) error {
+	if err := allocation.Transition(dhcpmanager.Releasing, reason); err != nil {
+		return err
+	}
+	if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+		if err == dhcpmanager.ErrConflict {
+			// The change has been enqueued by the watch
+			return nil
+		}
+		return err
+	}
+	return c.processReleasingAllocation(allocation)
+}
 
-	if allocation == nil {
-		return
+// processReleasingAllocation releases the leases, device and MAC of a
+// returned allocation and removes it after marking it as released. The MAC
+// is returned to the pool once no stored allocation uses it.
+func (c *Controller) processReleasingAllocation(allocation *dhcpmanager.Allocation) error {
+
+	c.mu.Lock()
+	local, ok := c.bound[allocation.ID]
+	delete(c.bound, allocation.ID)
+	delete(c.adopted, allocation.ID)
+	c.mu.Unlock()
+	c.stopReacquire(allocation.ID)
+	if !ok {
+		local = allocation
 	}
+	c.releaseResources(local)
 
-	renewCallback := func(iface *net.Interface, lease *dhclient.Lease) {
-		allocation.Lease = lease
-		if err := c.sm.Put(allocation); err != nil {
-			log.Printf("Warning: Error persisting allocation for IP %s = %s", lease.FixedAddress.String(), err.Error())
+	if err := allocation.Transition(dhcpmanager.Released, "leases released"); err != nil {
+		return err
+	}
+	if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+		if err == dhcpmanager.ErrConflict {
+			// The change has been enqueued by the watch
+			return nil
 		}
+		return err
 	}
+	log.Printf("Allocation %s released", allocation.ID)
+	if err := c.sm.Remove(allocation); err != nil {
+		return err
+	}
+	c.returnMAC(local)
+	return nil
+}
 
-	if allocation.Lease != nil && allocation.Lease.Expire.Before(time.Now()) {
-		log.Printf("Warning: lease for IP %s already expired.", allocation.Lease.FixedAddress)
-		c.deleteAllocation(allocation)
-		return
+func (c *Controller) processStoppedAllocation(allocation *dhcpmanager.Allocation) error {
+
+	if expire, ok := allocation.Expiry(); ok && expire.Before(time.Now()) {
+		log.Printf("Warning: lease for IP %s already expired.", allocation.IPs())
+		return c.startReleasing(allocation, "lease expired while stopped")
 	}
 
 	var iface *net.Interface
 	if c.createInterfaces {
-		var err error
-		iface, err = c.dhcp.CreateDevice(allocation.Interface.Name, &allocation.Interface.HardwareAddr)
-		if err != nil {
-			log.Printf("Warning: Could not create device [%s] - %s", allocation.Interface.Name, err.Error())
-			// Not sure if the allocation should be deleted at this point. Probably not
-			// to give others the option to process it. It's the job of the creator to
-			// remove stale allocations
-			// c.deleteAllocation(allocation)
-			return
+		if adopted, ok := c.adoptDevice(allocation); ok {
+			iface = adopted
+		} else {
+			var err error
+			iface, err = c.dhcp.CreateDevice(allocation.Interface.Name, dhcpmanager.DeviceAlias(allocation), &allocation.Interface.HardwareAddr, allocation.Pool, allocation.Device)
+			if err != nil {
+				return fmt.Errorf("Could not create device [%s] - %s", allocation.Interface.Name, err.Error())
+			}
 		}
 		allocation.Interface = *iface
 	} else {
 		var err error
-		iface, err = c.dhcp.Interface()
+		iface, err = c.dhcp.Interface(allocation.Pool)
 		if err != nil {
-			log.Printf("Warning: Could not access device")
-			// Not sure if the allocation should be deleted at this point. Probably not
-			// to give others the option to process it. It's the job of the creator to
-			// remove stale allocations
-			// c.deleteAllocation(allocation)
-			return
+			return fmt.Errorf("Could not access device - %s", err.Error())
 		}
 	}
 
-	lease, err := c.dhcp.BindAllocationToInterface(allocation, iface, renewCallback)
-	if err != nil {
-		log.Printf("Warning: Could not bind stopped allocation [%s] to device [%s]", allocation.ID, allocation.Interface.Name)
-		// Not sure if the allocation should be deleted at this point. Probably not
-		// to give others the option to process it. It's the job of the creator to
-		// remove stale allocations
-		// c.deleteAllocation(allocation)
-		return
+	if err := c.bindLeases(allocation, iface); err != nil {
+		if c.createInterfaces {
+			c.dhcp.RemoveDevice(iface)
+		}
+		return fmt.Errorf("Could not bind stopped allocation [%s] to device [%s] - %s", allocation.ID, allocation.Interface.Name, err.Error())
+	}
+	if err := allocation.Transition(dhcpmanager.Bound, "leases obtained again"); err != nil {
+		c.deleteAllocation(allocation)
+		return err
 	}
-	allocation.Lease = lease
-	allocation.State = dhcpmanager.Bound
-
-	// Make sure the MAC is not left in the pool
-	c.sm.RemoveMAC(allocation.Interface.HardwareAddr)
 
-	if err := c.sm.Put(allocation); err != nil {
-		log.Printf("Warning: Error persisting allocation for IP %s = %s", lease.FixedAddress.String(), err.Error())
+	// Make sure the MAC is not left in the pool. Taking it from the pool
+	// claims it for the allocation again.
+	if allocation.Device.UsesMAC() && len(allocation.Interface.HardwareAddr) > 0 {
+		mac := allocation.Interface.HardwareAddr
+		c.sm.PopMAC(allocation.ID, func(candidate net.HardwareAddr) bool {
+			return bytes.Equal(candidate, mac)
+		})
 	}
 
+	if err := c.sm.Update(allocation, allocation.Revision); err != nil {
+		log.Printf("Warning: Error persisting allocation for IP %s = %s", allocation.IPs(), err.Error())
+		c.deleteAllocation(allocation)
+		if err == dhcpmanager.ErrConflict {
+			return nil
+		}
+		return err
+	}
+	c.setBound(allocation)
+	return nil
 }
 
-func (c *Controller) deleteAllocation(allocation *dhcpmanager.Allocation) {
+// bindLeases obtains the leases of all address families of the allocation
+// on iface. The IPv4 lease is given up again if no IPv6 lease is obtained.
+func (c *Controller) bindLeases(allocation *dhcpmanager.Allocation, iface *net.Interface) error {
 
-	if allocation.Lease != nil {
-		log.Printf("Controller: Stopping DHCP client for IP %s", allocation.Lease.FixedAddress.String())
-		c.dhcp.Stop(&allocation.Lease.FixedAddress)
+	id := allocation.ID
+	if allocation.Family.IPv4() {
+		lease, err := c.dhcp.BindAllocationToInterface(allocation, iface, func(iface *net.Interface, lease *dhclient.Lease) {
+			c.renewLease(id, lease)
+		})
+		if err != nil {
+			return err
+		}
+		allocation.Lease = lease
+		allocation.Config = dhcpmanager.NewNetworkConfig(lease)
 	}
 
-	// Recover the MAC if we are managing interfaces
-	if c.createInterfaces && len(allocation.Interface.HardwareAddr) > 0 {
-		c.sm.PutMAC(allocation.Interface.HardwareAddr)
-		dhcpmanager.RemoveDevice(&allocation.Interface)
+	if allocation.Family.IPv6() {
+		lease6, err := c.dhcp.BindAllocationToInterface6(allocation, iface, func(iface *net.Interface, lease *dhcpmanager.Lease6) {
+			c.renewLease6(id, lease)
+		})
+		if err != nil {
+			if allocation.Family.IPv4() {
+				c.dhcp.Stop(&allocation.Lease.FixedAddress)
+			}
+			return err
+		}
+		allocation.Lease6 = lease6
 	}
-	allocation.State = dhcpmanager.Stale
+	return nil
 }
 
-// watch for changes in the allocation store
-func (c *Controller) watch() {
-	watcher := dhcpmanager.AllocationWatcher{
+// renewLease persists a renewed lease with the current revision of the
+// allocation. Allocations that are renewing, rebinding or lost are bound
+// again. Renewals never resurrect allocations removed or deactivated in the
+// meantime. Instead, the IP of such an allocation is released.
+func (c *Controller) renewLease(id uuid.UUID, lease *dhclient.Lease) {
+	c.persistRenewal(id, lease.FixedAddress, func(allocation *dhcpmanager.Allocation) {
+		allocation.Lease = lease
+		allocation.Config = dhcpmanager.NewNetworkConfig(lease)
+	})
+}
 
-		// Remove DHCP client if allocation is removed
-		OnDelete: func(alloc *dhcpmanager.Allocation) {
-			c.deleteAllocation(alloc)
-		},
+// renewLease6 persists a renewed DHCPv6 lease like renewLease
+func (c *Controller) renewLease6(id uuid.UUID, lease *dhcpmanager.Lease6) {
+	c.persistRenewal(id, lease.Address, func(allocation *dhcpmanager.Allocation) {
+		allocation.Lease6 = lease
+	})
+}
 
-		// Create DHCP client if allocation is created
-		OnCreate: func(alloc *dhcpmanager.Allocation) {
+func (c *Controller) persistRenewal(id uuid.UUID, ip net.IP, renew func(*dhcpmanager.Allocation)) {
+	for {
+		allocation, err := c.sm.Get(id)
+		if err == dhcpmanager.ErrNotFound {
+			log.Printf("Allocation %s removed - releasing IP %s", id, ip.String())
+			c.dhcp.Release(&ip)
+			return
+		}
+		if err != nil {
+			log.Printf("Warning: Error reading allocation for IP %s = %s", ip.String(), err.Error())
+			return
+		}
+		if c.node != "" && allocation.Node != c.node {
+			// Taken over by another node, which is renewing its own lease
+			return
+		}
+
+		if allocation.State == dhcpmanager.Binding {
+			// The lease is persisted once binding completes
+			return
+		}
+		if !allocation.State.Active() {
+			// The allocation is releasing, stopped or failed and must not be
+			// bound again by a late renewal
+			log.Printf("Allocation %s is %s - releasing IP %s", id, allocation.State, ip.String())
+			c.dhcp.Release(&ip)
+			return
+		}
 
-			if alloc.State != dhcpmanager.Unbound {
-				log.Printf("Created allocation %s not unbound. Ignore.", alloc.ID)
+		if allocation.State != dhcpmanager.Bound {
+			log.Printf("Controller: lease for IP %s of allocation %s renewed", ip.String(), id)
+			if err := allocation.Transition(dhcpmanager.Bound, "lease renewed"); err != nil {
+				log.Printf("Warning: Could not persist renewal of IP %s - %s", ip.String(), err.Error())
 				return
 			}
-			c.processUnboundAllocation(alloc)
+		}
+		renew(allocation)
+		err = c.sm.Update(allocation, allocation.Revision)
+		if err == dhcpmanager.ErrConflict {
+			// Modified concurrently - retry with the current state
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: Error persisting allocation for IP %s = %s", ip.String(), err.Error())
+			return
+		}
+		if allocation.State == dhcpmanager.Bound {
+			c.stopReacquire(id)
+		}
+		return
+	}
+}
+
+func (c *Controller) setBound(allocation *dhcpmanager.Allocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bound[allocation.ID] = allocation
+}
+
+// deleteAllocation releases the leases, device and MAC of an allocation
+func (c *Controller) deleteAllocation(allocation *dhcpmanager.Allocation) {
+	c.releaseResources(allocation)
+	c.returnMAC(allocation)
+}
 
-		},
+// releaseResources releases the leases and removes the device of an
+// allocation
+func (c *Controller) releaseResources(allocation *dhcpmanager.Allocation) {
+
+	// Release the leases before the device is removed
+	for _, ip := range allocation.IPs() {
+		log.Printf("Controller: Releasing IP %s", ip.String())
+		c.dhcp.Release(&ip)
+	}
+
+	if c.createInterfaces && len(allocation.Interface.HardwareAddr) > 0 {
+		c.dhcp.RemoveDevice(&allocation.Interface)
 	}
-	c.watchStopFunc = c.sm.Watch(&watcher)
 }
 
-func randomString(n int) string {
-	var letter = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+// returnMAC puts the MAC of allocation back into the pool if it has been
+// taken from the pool for the allocation. Random MACs of dynamic interfaces
+// are not claimed and never enter the pool.
+func (c *Controller) returnMAC(allocation *dhcpmanager.Allocation) {
+	mac := allocation.Interface.HardwareAddr
+	if !c.createInterfaces || len(mac) == 0 || !allocation.Device.UsesMAC() {
+		return
+	}
+	claims, err := c.sm.Claims()
+	if err != nil {
+		log.Printf("Warning: Could not read MAC claims - %s", err.Error())
+		return
+	}
+	if claims[strings.ToLower(mac.String())] != allocation.ID {
+		return
+	}
+	if err := c.sm.PutMAC(mac); err != nil {
+		log.Printf("Warning: Could not return MAC [%s] of allocation %s - %s", mac, allocation.ID, err.Error())
+	}
+}
 
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letter[rand.Intn(len(letter))]
+// watch enqueues all changed allocations
+func (c *Controller) watch(events <-chan dhcpmanager.AllocationEvent) {
+	for ev := range events {
+		switch ev.Type {
+		case dhcpmanager.EventDeleted:
+			if ev.Old.State == dhcpmanager.Released {
+				// Removed after releasing its resources
+				continue
+			}
+			// Remember the last state to release its resources
+			c.mu.Lock()
+			c.deleted[ev.Old.ID] = ev.Old
+			c.mu.Unlock()
+			c.queue.Add(ev.Old.ID)
+		default:
+			c.queue.Add(ev.New.ID)
+		}
 	}
-	return string(b)
 }
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/uuid"
+	dhcpmanager "github.com/kramergroup/dhcpmanager"
+	"github.com/kramergroup/dhcpmanager/internal/dhcptest"
+)
+
+// fakeFactory creates the clients of a fake DHCP server
+type fakeFactory struct {
+	server *dhcptest.Server
+}
+
+func (f fakeFactory) NewClient(iface *net.Interface, hostname string, onBound func(*dhclient.Lease)) dhcpmanager.DHCPClient {
+	return f.server.NewClient(iface, hostname, onBound)
+}
+
+// newTestController creates a controller binding the allocations of an
+// in-memory store on in-memory devices with leases of a fake DHCP server.
+// The MACs are put into the MAC pool.
+func newTestController(t *testing.T, leaseTime time.Duration, macs ...string) (*Controller, dhcpmanager.StateManager, *dhcptest.Server) {
+	t.Helper()
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	server := dhcptest.NewServer(*network, leaseTime)
+	dhcp := dhcpmanager.NewDHCPController([]dhcpmanager.Pool{{Name: dhcpmanager.DefaultPool, Interface: "eth0"}},
+		time.Second, true, false, false, false)
+	dhcp.UseLinkManager(dhcpmanager.NewInMemoryLinkManager("eth0"))
+	dhcp.UseClientFactory(fakeFactory{server})
+
+	sm := dhcpmanager.NewInMemoryStateManager()
+	for _, s := range macs {
+		mac, _ := net.ParseMAC(s)
+		if err := sm.PutMAC(mac); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewController(sm, dhcp, true, false, 0, 3), sm, server
+}
+
+// waitFor polls cond until it holds and fails the test if it does not hold
+// within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForState waits until the stored allocation with id is in state and
+// returns it
+func waitForState(t *testing.T, sm dhcpmanager.StateManager, id uuid.UUID, state dhcpmanager.AllocationState) *dhcpmanager.Allocation {
+	t.Helper()
+	var allocation *dhcpmanager.Allocation
+	waitFor(t, "allocation "+state.String(), func() bool {
+		var err error
+		allocation, err = sm.Get(id)
+		return err == nil && allocation.State == state
+	})
+	return allocation
+}
+
+// waitForRemoval waits until the allocation with id has been removed
+func waitForRemoval(t *testing.T, sm dhcpmanager.StateManager, id uuid.UUID) {
+	t.Helper()
+	waitFor(t, "removal of the allocation", func() bool {
+		_, err := sm.Get(id)
+		return err == dhcpmanager.ErrNotFound
+	})
+}
+
+// bindAllocation stores a new allocation and binds it with c
+func bindAllocation(t *testing.T, c *Controller, sm dhcpmanager.StateManager, hostname string) *dhcpmanager.Allocation {
+	t.Helper()
+	allocation := dhcpmanager.NewAllocation(hostname)
+	if err := sm.Put(allocation); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processUnboundAllocation(allocation); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := sm.Get(allocation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// poolSize returns the number of MACs in the MAC pool
+func poolSize(t *testing.T, sm dhcpmanager.StateManager) int {
+	t.Helper()
+	pool, err := sm.MACPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(pool)
+}
+
+func TestProcessUnboundAllocation(t *testing.T) {
+	c, sm, server := newTestController(t, time.Hour, "56:6a:e2:0b:01:8d", "30:ba:33:c2:e3:c2")
+	defer c.release()
+
+	allocation := bindAllocation(t, c, sm, "web")
+	if allocation.State != dhcpmanager.Bound || allocation.Lease == nil || allocation.Interface.Name == "" {
+		t.Fatalf("Expected bound allocation got %s on [%s]", allocation.State, allocation.Interface.Name)
+	}
+	claims, _ := sm.Claims()
+	if claims[strings.ToLower(allocation.Interface.HardwareAddr.String())] != allocation.ID || poolSize(t, sm) != 1 {
+		t.Errorf("Expected MAC %s to be claimed by the allocation", allocation.Interface.HardwareAddr)
+	}
+	if info, ok := c.dhcp.Client(allocation.Lease.FixedAddress); !ok || info.Interface != allocation.Interface.Name {
+		t.Errorf("Expected client on %s got %+v", allocation.Interface.Name, info)
+	}
+
+	// The server hands out the IP of the first allocation again. The device
+	// and MAC of the failed binding are released to retry with fresh ones.
+	server.Script(dhcptest.Response{IP: allocation.Lease.FixedAddress})
+	other := dhcpmanager.NewAllocation("db")
+	if err := sm.Put(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processUnboundAllocation(other); err == nil {
+		t.Fatal("Expected binding to fail")
+	}
+	if stored, _ := sm.Get(other.ID); stored.State != dhcpmanager.Binding {
+		t.Errorf("Expected allocation to stay binding got %s", stored.State)
+	}
+	if devices, _ := c.dhcp.Devices(); len(devices) != 1 || poolSize(t, sm) != 1 {
+		t.Errorf("Expected device and MAC to be released, %d devices and %d MACs left", len(devices), poolSize(t, sm))
+	}
+
+	// Allocations of unknown pools fail without retrying
+	unknown := dhcpmanager.NewAllocation("unknown")
+	unknown.Pool = "unknown"
+	if err := sm.Put(unknown); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processUnboundAllocation(unknown); err != nil {
+		t.Error(err)
+	}
+	if stored, _ := sm.Get(unknown.ID); stored.State != dhcpmanager.Failed {
+		t.Errorf("Expected failed allocation got %s", stored.State)
+	}
+}
+
+func TestProcessAllocationsOnVLAN(t *testing.T) {
+	c, sm, _ := newTestController(t, time.Hour, "56:6a:e2:0b:01:8d", "30:ba:33:c2:e3:c2")
+	defer c.release()
+
+	// Both devices are stacked on the shared VLAN sub-interface
+	ips := make(map[string]bool)
+	for _, hostname := range []string{"web", "db"} {
+		allocation := dhcpmanager.NewAllocation(hostname)
+		allocation.Device = &dhcpmanager.DeviceConfig{Mode: dhcpmanager.VLAN, VLAN: 100}
+		if err := sm.Put(allocation); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.processUnboundAllocation(allocation); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := sm.Get(allocation.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.State != dhcpmanager.Bound || stored.Lease == nil {
+			t.Fatalf("Expected bound allocation %s got %s", hostname, stored.State)
+		}
+		ips[stored.Lease.FixedAddress.String()] = true
+	}
+	if devices, _ := c.dhcp.Devices(); len(devices) != 2 || len(ips) != 2 || poolSize(t, sm) != 0 {
+		t.Errorf("Expected 2 devices with distinct IPs got %v and %v", devices, ips)
+	}
+}
+
+func TestProcessReleasingAllocation(t *testing.T) {
+	c, sm, server := newTestController(t, time.Hour, "56:6a:e2:0b:01:8d")
+	allocation := bindAllocation(t, c, sm, "web")
+
+	if err := allocation.Transition(dhcpmanager.Releasing, "returned via API"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Update(allocation, allocation.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processReleasingAllocation(allocation); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sm.Get(allocation.ID); err != dhcpmanager.ErrNotFound {
+		t.Errorf("Expected allocation to be removed got %v", err)
+	}
+	if devices, _ := c.dhcp.Devices(); len(devices) != 0 || server.Running() != 0 {
+		t.Errorf("Expected device and client to be released, %d devices and %d clients left", len(devices), server.Running())
+	}
+	if claims, _ := sm.Claims(); len(claims) != 0 || poolSize(t, sm) != 1 {
+		t.Errorf("Expected MAC to be returned, claims %v", claims)
+	}
+}
+
+func TestDeleteAllocation(t *testing.T) {
+	c, sm, server := newTestController(t, time.Hour, "56:6a:e2:0b:01:8d")
+	allocation := bindAllocation(t, c, sm, "web")
+
+	// The allocation has been removed from the store by someone else
+	if err := sm.Remove(allocation); err != nil {
+		t.Fatal(err)
+	}
+	c.deleteAllocation(allocation)
+	if devices, _ := c.dhcp.Devices(); len(devices) != 0 || server.Running() != 0 {
+		t.Errorf("Expected device and client to be released, %d devices and %d clients left", len(devices), server.Running())
+	}
+	if poolSize(t, sm) != 1 {
+		t.Errorf("Expected MAC to be returned, %d MACs in pool", poolSize(t, sm))
+	}
+
+	// MACs that are not claimed by the allocation are not returned
+	mac, err := sm.PopMAC(uuid.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.deleteAllocation(allocation)
+	if claims, _ := sm.Claims(); len(claims) != 1 || poolSize(t, sm) != 0 {
+		t.Errorf("Expected MAC %s claimed by another allocation to stay claimed", mac)
+	}
+}
+
+func TestTakeoverStoppedAllocation(t *testing.T) {
+	previous, sm, server := newTestController(t, time.Hour, "56:6a:e2:0b:01:8d")
+	allocation := bindAllocation(t, previous, sm, "web")
+
+	// The previous controller terminated without stopping the allocation and
+	// left its device behind
+	previous.dhcp.Stop(&allocation.Lease.FixedAddress)
+
+	c := NewController(sm, previous.dhcp, true, false, 0, 3)
+	c.Start()
+	waitFor(t, "rebound allocation", func() bool {
+		stored, err := sm.Get(allocation.ID)
+		return err == nil && stored.State == dhcpmanager.Bound && stored.Revision > allocation.Revision+1
+	})
+	stored, _ := sm.Get(allocation.ID)
+	if !stored.Lease.FixedAddress.Equal(allocation.Lease.FixedAddress) || stored.Interface.Name != allocation.Interface.Name {
+		t.Errorf("Expected IP %s on %s got %s on %s", allocation.Lease.FixedAddress, allocation.Interface.Name,
+			stored.Lease.FixedAddress, stored.Interface.Name)
+	}
+	last := stored.History[len(stored.History)-2]
+	if last.To != dhcpmanager.Stopped || last.Reason != "taken over from terminated controller" {
+		t.Errorf("Expected allocation to be taken over got %+v", last)
+	}
+	if devices, _ := c.dhcp.Devices(); len(devices) != 1 || server.Running() != 1 || poolSize(t, sm) != 0 {
+		t.Errorf("Expected adopted device, %d devices, %d clients and %d MACs in pool", len(devices), server.Running(), poolSize(t, sm))
+	}
+
+	// Stopping the controller stops the allocation for the next controller
+	c.Stop()
+	if stored, _ := sm.Get(allocation.ID); stored.State != dhcpmanager.Stopped || server.Running() != 0 {
+		t.Errorf("Expected stopped allocation got %s with %d clients", stored.State, server.Running())
+	}
+}
+
+func TestProcessExpiredStoppedAllocation(t *testing.T) {
+	c, sm, server := newTestController(t, time.Hour, "56:6a:e2:0b:01:8d")
+	allocation := bindAllocation(t, c, sm, "web")
+	c.release()
+
+	// Stopped allocations whose leases expired in the meantime are released
+	allocation.Lease.Expire = time.Now().Add(-time.Second)
+	if err := allocation.Transition(dhcpmanager.Stopped, "controller stopped"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Update(allocation, allocation.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processStoppedAllocation(allocation); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Get(allocation.ID); err != dhcpmanager.ErrNotFound {
+		t.Errorf("Expected allocation to be removed got %v", err)
+	}
+	if server.Running() != 0 || poolSize(t, sm) != 1 {
+		t.Errorf("Expected client to be stopped and MAC returned, %d clients and %d MACs", server.Running(), poolSize(t, sm))
+	}
+}
+
+// unavailableRegistry fails to register nodes a number of times
+type unavailableRegistry struct {
+	dhcpmanager.StateManager
+	failures int32
+}
+
+func (r *unavailableRegistry) RegisterNode(ctx context.Context, node string) error {
+	if atomic.AddInt32(&r.failures, -1) >= 0 {
+		return errors.New("store unavailable")
+	}
+	return r.StateManager.RegisterNode(ctx, node)
+}
+
+func TestRegisterNodeRetried(t *testing.T) {
+	previous, sm, _ := newTestController(t, time.Hour)
+	registry := &unavailableRegistry{StateManager: sm, failures: 1}
+
+	c := NewController(registry, previous.dhcp, true, false, 0, 3)
+	c.EnableSharding("node-1")
+	c.Start()
+	defer c.Stop()
+
+	waitFor(t, "registered node", func() bool {
+		nodes, err := sm.Nodes()
+		return err == nil && len(nodes) == 1 && nodes[0] == "node-1"
+	})
+}
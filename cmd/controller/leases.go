@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	dhcpmanager "github.com/kramergroup/dhcpmanager"
+)
+
+// handleLeaseEvent moves the allocation of a lease that is not renewed in
+// time through the Renewing and Rebinding states. Allocations of rejected,
+// expired or changed leases are marked as stale and removed. If reacquiring
+// is enabled, allocations of rejected and expired leases are marked as lost
+// instead while the DHCP client tries to obtain the same IP again.
+func (c *Controller) handleLeaseEvent(ev dhcpmanager.LeaseEvent) {
+	switch {
+	case ev.Type == dhcpmanager.LeaseIPChanged:
+		if c.setState(ev.Allocation, ev.IP, dhcpmanager.Stale, "IP changed") {
+			log.Printf("Warning: IP of allocation %s changed from %s to %s - removing allocation", ev.Allocation, ev.IP, ev.Lease.FixedAddress)
+		}
+	case ev.Type == dhcpmanager.LeaseRejected || ev.State == dhcpmanager.LeaseExpired:
+		if c.reacquireTimeout == 0 {
+			if c.setState(ev.Allocation, ev.IP, dhcpmanager.Stale, "lease lost") {
+				log.Printf("Warning: Lease for IP %s of allocation %s lost - removing allocation", ev.IP, ev.Allocation)
+			}
+			return
+		}
+		if c.setState(ev.Allocation, ev.IP, dhcpmanager.Lost, "lease lost") {
+			log.Printf("Warning: Lease for IP %s of allocation %s lost - reacquiring for %s", ev.IP, ev.Allocation, c.reacquireTimeout)
+			c.startReacquire(ev.Allocation, ev.IP)
+		}
+	case ev.State == dhcpmanager.LeaseRebinding:
+		if c.setState(ev.Allocation, ev.IP, dhcpmanager.Rebinding, "renewal failed") {
+			log.Printf("Warning: Lease for IP %s of allocation %s not renewed - rebinding", ev.IP, ev.Allocation)
+		}
+	case ev.State == dhcpmanager.LeaseRenewing:
+		if c.setState(ev.Allocation, ev.IP, dhcpmanager.Renewing, "renewal overdue") {
+			log.Printf("Controller: lease for IP %s of allocation %s overdue for renewal", ev.IP, ev.Allocation)
+		}
+	}
+}
+
+// setState moves the active allocation with id that holds ip to state for
+// reason and reports whether the state changed. Lost allocations only
+// recover through a renewal.
+func (c *Controller) setState(id uuid.UUID, ip net.IP, state dhcpmanager.AllocationState, reason string) bool {
+	for {
+		allocation, err := c.sm.Get(id)
+		if err != nil {
+			if err != dhcpmanager.ErrNotFound {
+				log.Printf("Warning: Error reading allocation for IP %s = %s", ip.String(), err.Error())
+			}
+			return false
+		}
+		if !allocation.State.Active() || allocation.State == state || !holds(allocation, ip) {
+			return false
+		}
+		if allocation.State == dhcpmanager.Lost && state != dhcpmanager.Stale {
+			return false
+		}
+		if c.node != "" && allocation.Node != c.node {
+			return false
+		}
+
+		if err := allocation.Transition(state, reason); err != nil {
+			log.Printf("Warning: %s", err.Error())
+			return false
+		}
+		err = c.sm.Update(allocation, allocation.Revision)
+		if err == dhcpmanager.ErrConflict {
+			// Modified concurrently - retry with the current state
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: Error persisting allocation for IP %s = %s", ip.String(), err.Error())
+			return false
+		}
+		return true
+	}
+}
+
+// startReacquire marks the lost allocation with id as stale if its lease is
+// not renewed within the reacquire timeout
+func (c *Controller) startReacquire(id uuid.UUID, ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.reacquiring[id]; ok {
+		return
+	}
+	c.reacquiring[id] = time.AfterFunc(c.reacquireTimeout, func() {
+		c.mu.Lock()
+		delete(c.reacquiring, id)
+		c.mu.Unlock()
+		if c.setState(id, ip, dhcpmanager.Stale, "IP not reacquired") {
+			log.Printf("Warning: Could not reacquire IP %s of allocation %s - removing allocation", ip, id)
+		}
+	})
+}
+
+// stopReacquire stops the reacquire timeout of the allocation with id
+func (c *Controller) stopReacquire(id uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if timer, ok := c.reacquiring[id]; ok {
+		timer.Stop()
+		delete(c.reacquiring, id)
+	}
+}
+
+// holds reports whether ip is one of the IPs of allocation
+func holds(allocation *dhcpmanager.Allocation, ip net.IP) bool {
+	for _, held := range allocation.IPs() {
+		if held.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	dhcpmanager "github.com/kramergroup/dhcpmanager"
+	"github.com/kramergroup/dhcpmanager/internal/dhcptest"
+)
+
+func TestRenewalPersisted(t *testing.T) {
+	c, sm, _ := newTestController(t, 300*time.Millisecond, "56:6a:e2:0b:01:8d")
+	c.Start()
+	defer c.Stop()
+
+	allocation := dhcpmanager.NewAllocation("web")
+	if err := sm.Put(allocation); err != nil {
+		t.Fatal(err)
+	}
+	bound := waitForState(t, sm, allocation.ID, dhcpmanager.Bound)
+
+	waitFor(t, "renewed lease", func() bool {
+		renewed, err := sm.Get(allocation.ID)
+		return err == nil && renewed.Lease.Expire.After(bound.Lease.Expire)
+	})
+	renewed, _ := sm.Get(allocation.ID)
+	if !renewed.Lease.FixedAddress.Equal(bound.Lease.FixedAddress) || renewed.State != dhcpmanager.Bound {
+		t.Errorf("Expected IP %s to stay bound got %s (%s)", bound.Lease.FixedAddress, renewed.Lease.FixedAddress, renewed.State)
+	}
+}
+
+func TestLateRenewalOfReleasingAllocation(t *testing.T) {
+	c, sm, server := newTestController(t, time.Hour, "56:6a:e2:0b:01:8d")
+	defer c.release()
+	allocation := bindAllocation(t, c, sm, "web")
+
+	if err := allocation.Transition(dhcpmanager.Releasing, "returned via API"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Update(allocation, allocation.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	// A renewal arriving after the allocation has been returned releases the
+	// IP instead of storing the lease
+	renewed := *allocation.Lease
+	renewed.Expire = allocation.Lease.Expire.Add(time.Hour)
+	c.renewLease(allocation.ID, &renewed)
+
+	stored, err := sm.Get(allocation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != dhcpmanager.Releasing || !stored.Lease.Expire.Equal(allocation.Lease.Expire) {
+		t.Errorf("Expected releasing allocation to keep its lease got %s until %s", stored.State, stored.Lease.Expire)
+	}
+	if server.Running() != 0 {
+		t.Errorf("Expected client to be stopped, %d running", server.Running())
+	}
+}
+
+func TestRejectedRenewal(t *testing.T) {
+	c, sm, server := newTestController(t, 300*time.Millisecond, "56:6a:e2:0b:01:8d")
+	c.Start()
+	defer c.Stop()
+
+	allocation := dhcpmanager.NewAllocation("web")
+	if err := sm.Put(allocation); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, sm, allocation.ID, dhcpmanager.Bound)
+
+	// The allocation of a rejected lease is released together with the
+	// client of the other IP obtained afterwards
+	server.Script(dhcptest.Response{NAK: true})
+	waitForRemoval(t, sm, allocation.ID)
+	waitFor(t, "stopped clients", func() bool { return server.Running() == 0 })
+	waitFor(t, "returned MAC", func() bool {
+		pool, _ := sm.MACPool()
+		return len(pool) == 1
+	})
+}
+
+func TestExpiredLease(t *testing.T) {
+	c, sm, server := newTestController(t, 300*time.Millisecond, "56:6a:e2:0b:01:8d")
+	c.Start()
+	defer c.Stop()
+
+	allocation := dhcpmanager.NewAllocation("web")
+	if err := sm.Put(allocation); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, sm, allocation.ID, dhcpmanager.Bound)
+
+	// Unanswered renewals let the lease expire and the allocation is released
+	server.Script(dhcptest.Response{Ignore: true, Delay: 5 * time.Second})
+	waitForRemoval(t, sm, allocation.ID)
+	if server.Running() != 0 {
+		t.Errorf("Expected client to be stopped, %d running", server.Running())
+	}
+}
+
+func TestExpiredLeaseReacquired(t *testing.T) {
+	c, sm, server := newTestController(t, 300*time.Millisecond, "56:6a:e2:0b:01:8d")
+	c.EnableReacquire(5 * time.Second)
+	c.Start()
+	defer c.Stop()
+
+	allocation := dhcpmanager.NewAllocation("web")
+	if err := sm.Put(allocation); err != nil {
+		t.Fatal(err)
+	}
+	bound := waitForState(t, sm, allocation.ID, dhcpmanager.Bound)
+
+	// The allocation moves through the renewing and rebinding states and is
+	// lost when the lease expires until the same IP is obtained again
+	server.Script(dhcptest.Response{Ignore: true, Delay: 3 * time.Second})
+	waitForState(t, sm, allocation.ID, dhcpmanager.Lost)
+	reacquired := waitForState(t, sm, allocation.ID, dhcpmanager.Bound)
+	if !reacquired.Lease.FixedAddress.Equal(bound.Lease.FixedAddress) {
+		t.Errorf("Expected IP %s got %s", bound.Lease.FixedAddress, reacquired.Lease.FixedAddress)
+	}
+
+	var states []dhcpmanager.AllocationState
+	for _, transition := range reacquired.History {
+		states = append(states, transition.To)
+	}
+	expected := []dhcpmanager.AllocationState{dhcpmanager.Binding, dhcpmanager.Bound, dhcpmanager.Renewing,
+		dhcpmanager.Rebinding, dhcpmanager.Lost, dhcpmanager.Bound}
+	if len(states) != len(expected) {
+		t.Fatalf("Expected states %v got %v", expected, states)
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Errorf("Expected states %v got %v", expected, states)
+			break
+		}
+	}
+}
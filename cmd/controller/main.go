@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -18,6 +19,15 @@ var controller *Controller
 // Configuration structure for the application
 type Configuration struct {
 
+	// The state store. Supported stores are etcd://<endpoints>,
+	// bolt:///<path to database file>, kubernetes://<namespace> and
+	// memory://. The bolt database is locked by the controller and the memory
+	// store is not shared with the apiserver. The etcd endpoints are used if
+	// empty
+	//
+	// Default: ""
+	Store string
+
 	// Array of etcd endpoints
 	//
 	// Default: etcd:2379
@@ -63,6 +73,19 @@ type Configuration struct {
 	// Default: false
 	AssignInterfaces bool `mapstructure:"assign-interfaces"`
 
+	// If true, the lease of a removed allocation is returned to the DHCP
+	// server with a DHCPRELEASE. Otherwise, the IP stays reserved on the DHCP
+	// server until the lease expires.
+	//
+	// Default: true
+	ReleaseLeases bool `mapstructure:"release-leases"`
+
+	// If true, a lease for an IP that is already managed by another DHCP
+	// client is rejected with a DHCPDECLINE
+	//
+	// Default: false
+	DeclineConflicts bool `mapstructure:"decline-conflicts"`
+
 	// The MAC addresses that will be used to obtain unique IPs from the DHCP
 	// server if ManageInterfaces = true
 	// If manage-interfaces is set to true, the list of MACs defines the total
@@ -76,6 +99,109 @@ type Configuration struct {
 	//
 	// Default: false
 	DynamicInterfaces bool `mapstructure:"dynamic-interfaces"`
+
+	// Interval in which all allocations are reconciled in addition to
+	// reconciling changed allocations immediately
+	//
+	// Default: 30 sec
+	ResyncInterval time.Duration `mapstructure:"resync-interval"`
+
+	// Number of retries with exponential backoff before an allocation that
+	// cannot be bound is marked as failed
+	//
+	// Default: 5
+	MaxRetries int `mapstructure:"max-retries"`
+
+	// Time the DHCP client of an allocation whose lease expired or was
+	// rejected tries to obtain the same IP again before the allocation is
+	// removed. Allocations of lost leases are removed immediately if set to 0.
+	//
+	// Default: 0
+	ReacquireTimeout time.Duration `mapstructure:"reacquire-timeout"`
+
+	// Interval in which the reaper reconciles the MAC pool, virtual interfaces,
+	// DHCP clients and stored allocations. Leaked MACs are returned to the pool,
+	// orphaned interfaces are removed and allocations with expired leases are
+	// released. The reaper only runs while the controller is the leader or
+	// processes its shard. Resources are only reclaimed if they
+	// are found orphaned in two consecutive runs, so the interval should be well
+	// above client-timeout. The reaper is disabled if set to 0.
+	//
+	// Default: 60 sec
+	ReapInterval time.Duration `mapstructure:"reap-interval"`
+
+	// If true, several controllers can be run for high availability. The
+	// controllers elect a leader through the state store and only the leader
+	// processes allocations. Allocations of a leader that terminates are
+	// bound again by the next leader.
+	//
+	// Default: true
+	LeaderElection bool `mapstructure:"leader-election"`
+
+	// If true, every controller processes the allocations assigned to its
+	// node. Unassigned allocations and allocations of failed nodes are claimed
+	// by the first controller processing them. Leader election is disabled
+	// with sharding.
+	//
+	// Default: false
+	Sharding bool
+
+	// Type of the virtual interfaces created with manage-interfaces:
+	// macvlan-bridge, macvlan-private, macvlan-vepa, macvlan-passthru, ipvlan
+	// (L2 mode) or vlan (macvlan-bridge on the VLAN sub-interface of the
+	// parent interface tagged with vlan). ipvlan interfaces share the MAC of the parent
+	// interface and identify their leases with a client identifier, so no MAC
+	// pool is required.
+	//
+	// Default: macvlan-bridge
+	DeviceMode string `mapstructure:"device-mode"`
+
+	// The VLAN ID of vlan interfaces. Interfaces of other modes are stacked on
+	// the VLAN sub-interface of the parent too if it is set.
+	//
+	// Default: 0
+	VLAN int
+
+	// Name of a network namespace in which the virtual interfaces are created
+	// and their DHCP clients run if manage-interfaces is true. The namespace
+	// is created if it does not exist. Network managers of the host do not
+	// see interfaces in the namespace. Interfaces are created in the
+	// namespace of the controller if empty.
+	//
+	// Default: ""
+	Netns string
+
+	// Additional named pools, each with its own parent interface, MAC
+	// addresses and device mode. Interface, Macs, DeviceMode and VLAN above
+	// configure the default pool.
+	Pools []PoolConfiguration
+
+	// Identity of the controller in the leader election and its node name with
+	// sharding. Must be unique among all controllers sharing a state store.
+	//
+	// Default: hostname
+	Identity string
+}
+
+// PoolConfiguration configures a named pool
+type PoolConfiguration struct {
+
+	// Name of the pool requested with POST /v1/ip
+	Name string
+
+	// The name of the parent interface of the pool
+	Interface string
+
+	// The MAC addresses of the pool's virtual interfaces
+	Macs []string
+
+	// Type of the pool's virtual interfaces
+	//
+	// Default: macvlan-bridge
+	DeviceMode string `mapstructure:"device-mode"`
+
+	// The VLAN ID of the pool's interfaces
+	VLAN int
 }
 
 func main() {
@@ -84,29 +210,57 @@ func main() {
 	config := processConfiguration()
 
 	// Start Controller and Manager
-	dhcp := dhcpmanager.NewDHCPController(config.Interface,
-		config.ClientTimeout, config.ManageInterfaces, config.AssignInterfaces)
-	sm, err := dhcpmanager.NewStateManager(config.Etcd, config.DialTimeout, config.RequestTimeout)
+	pools, err := configurePools(config)
+	if err != nil {
+		log.Fatalf("Configuration error: %s", err.Error())
+	}
+	dhcp := dhcpmanager.NewDHCPController(pools, config.ClientTimeout, config.ManageInterfaces,
+		config.AssignInterfaces, config.ReleaseLeases, config.DeclineConflicts)
+	if config.ManageInterfaces && config.Netns != "" {
+		ns, err := dhcpmanager.OpenNamespace(config.Netns)
+		if err != nil {
+			log.Fatalf("Could not open network namespace %s - %s", config.Netns, err.Error())
+		}
+		defer ns.Close()
+		dhcp.UseNamespace(ns)
+		log.Printf("Creating interfaces in network namespace %s", ns.Name)
+	}
+	if dhcp.Namespace() == nil {
+		// Only the DHCP clients of devices in a namespace report DHCPNAKs
+		log.Printf("Warning: Leases rejected by the DHCP server are only detected when they expire - use netns to detect rejections")
+	}
+	sm, err := dhcpmanager.OpenStateManager(config.Store, config.Etcd, config.DialTimeout, config.RequestTimeout)
 	if err == nil {
 
-		// Register the MAC addresses
-		for _, mac := range config.Macs {
-			mmac, errB := net.ParseMAC(mac)
-			if errB != nil {
-				log.Printf("Invalid MAC address [%s]", mac)
-				continue
-			}
-
-			switch sm.PutMAC(mmac) {
-			case nil:
-				log.Printf("Registered MAC [%s] with pool", mac)
-			default:
-				log.Printf("Error registering MAC [%s] with pool", mac)
+		// Register the MAC addresses. MACs claimed by allocations stay with
+		// them until they are released.
+		for _, pool := range pools {
+			for _, mac := range pool.MACs {
+				seeded, err := sm.SeedMAC(mac)
+				switch {
+				case err != nil:
+					log.Printf("Error registering MAC [%s] with pool %s", mac, pool.Name)
+				case seeded:
+					log.Printf("Registered MAC [%s] with pool %s", mac, pool.Name)
+				}
 			}
 		}
 
 		// Start the main controller syncing state with DHCP clients
-		controller = NewController(sm, dhcp, config.ManageInterfaces, config.DynamicInterfaces)
+		controller = NewController(sm, dhcp, config.ManageInterfaces, config.DynamicInterfaces,
+			config.ResyncInterval, config.MaxRetries)
+		if config.ReacquireTimeout > 0 {
+			controller.EnableReacquire(config.ReacquireTimeout)
+		}
+		if config.Sharding {
+			controller.EnableSharding(config.Identity)
+		} else if config.LeaderElection {
+			controller.EnableLeaderElection(config.Identity)
+		}
+		if config.ReapInterval > 0 {
+			// Reclaim leaked resources while processing allocations
+			controller.EnableReaper(config.ReapInterval)
+		}
 		log.Print("Controller: starting")
 		controller.Start()
 
@@ -125,6 +279,50 @@ func main() {
 	}
 }
 
+// configurePools returns the default pool and the named pools of config
+func configurePools(config *Configuration) ([]dhcpmanager.Pool, error) {
+
+	configs := append([]PoolConfiguration{{
+		Name:       dhcpmanager.DefaultPool,
+		Interface:  config.Interface,
+		Macs:       config.Macs,
+		DeviceMode: config.DeviceMode,
+		VLAN:       config.VLAN,
+	}}, config.Pools...)
+
+	pools := make([]dhcpmanager.Pool, 0, len(configs))
+	names := make(map[string]bool)
+	for _, pc := range configs {
+		if pc.Name == "" || names[pc.Name] {
+			return nil, fmt.Errorf("Missing or duplicate pool name [%s]", pc.Name)
+		}
+		names[pc.Name] = true
+
+		mode, err := dhcpmanager.ParseDeviceMode(pc.DeviceMode)
+		if err != nil {
+			return nil, err
+		}
+		pool := dhcpmanager.Pool{
+			Name:      pc.Name,
+			Interface: pc.Interface,
+			Device:    dhcpmanager.DeviceConfig{Mode: mode, VLAN: pc.VLAN},
+		}
+		if err := pool.Device.Validate(); err != nil {
+			return nil, fmt.Errorf("Pool %s - %s", pc.Name, err.Error())
+		}
+		for _, mac := range pc.Macs {
+			mmac, err := net.ParseMAC(mac)
+			if err != nil {
+				log.Printf("Invalid MAC address [%s]", mac)
+				continue
+			}
+			pool.MACs = append(pool.MACs, mmac)
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
 func processConfiguration() *Configuration {
 
 	viper.SetConfigName("dhcpmanager")
@@ -132,6 +330,7 @@ func processConfiguration() *Configuration {
 	viper.SetEnvPrefix("DHCP")
 	viper.AutomaticEnv()
 
+	viper.SetDefault("store", "")
 	viper.SetDefault("etcd", []string{"etcd:2379"})
 	viper.SetDefault("interface", "eth0")
 	viper.SetDefault("dial-timeout", "5s")
@@ -139,7 +338,21 @@ func processConfiguration() *Configuration {
 	viper.SetDefault("client-timeout", "5s")
 	viper.SetDefault("manage-interfaces", true)
 	viper.SetDefault("assign-interfaces", false)
+	viper.SetDefault("release-leases", true)
+	viper.SetDefault("decline-conflicts", false)
 	viper.SetDefault("dynamic-interfaces", false)
+	viper.SetDefault("resync-interval", "30s")
+	viper.SetDefault("max-retries", 5)
+	viper.SetDefault("reacquire-timeout", "0s")
+	viper.SetDefault("reap-interval", "60s")
+	viper.SetDefault("leader-election", true)
+	viper.SetDefault("sharding", false)
+	viper.SetDefault("device-mode", "macvlan-bridge")
+	viper.SetDefault("vlan", 0)
+	viper.SetDefault("netns", "")
+	if hostname, err := os.Hostname(); err == nil {
+		viper.SetDefault("identity", hostname)
+	}
 
 	// Find and read the config file
 	if err := viper.ReadInConfig(); err != nil {
@@ -155,7 +368,23 @@ func processConfiguration() *Configuration {
 	log.Printf("[config]  manage-interfaces: %t", config.ManageInterfaces)
 	log.Printf("[config]  assign-interfaces: %t", config.AssignInterfaces)
 	log.Printf("[config] dynamic-interfaces: %t", config.DynamicInterfaces)
+	log.Printf("[config]     release-leases: %t", config.ReleaseLeases)
+	log.Printf("[config]  decline-conflicts: %t", config.DeclineConflicts)
+	log.Printf("[config]        device-mode: %s", config.DeviceMode)
+	log.Printf("[config]               vlan: %d", config.VLAN)
+	log.Printf("[config]              netns: %s", config.Netns)
 	log.Printf("[config]      MAC pool size: %d", len(config.Macs))
+	for _, pool := range config.Pools {
+		log.Printf("[config]               pool: %s (%s, %s, %d MACs)", pool.Name, pool.Interface, pool.DeviceMode, len(pool.Macs))
+	}
+	log.Printf("[config]    resync-interval: %s", config.ResyncInterval)
+	log.Printf("[config]        max-retries: %d", config.MaxRetries)
+	log.Printf("[config]  reacquire-timeout: %s", config.ReacquireTimeout)
+	log.Printf("[config]      reap-interval: %s", config.ReapInterval)
+	log.Printf("[config]    leader-election: %t", config.LeaderElection)
+	log.Printf("[config]           sharding: %t", config.Sharding)
+	log.Printf("[config]           identity: %s", config.Identity)
+	log.Printf("[config]              store: %s", config.Store)
 	log.Printf("[config]               etcd: %s", config.Etcd)
 	log.Printf("[config]     client-timeout: %s", config.ClientTimeout)
 	log.Printf("[config]    request-timeout: %s", config.RequestTimeout)
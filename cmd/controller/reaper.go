@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	dhcpmanager "github.com/kramergroup/dhcpmanager"
+)
+
+// Reaper reconciles the MAC pool, the virtual NICs on the host, the running
+// DHCP clients and the stored allocations. It returns leaked MACs to the pool,
+// removes orphaned devices and stops DHCP clients of removed allocations.
+//
+// Resources are only reclaimed if they are found orphaned in two consecutive
+// runs. This leaves allocations that are being bound (and are not persisted
+// yet) time to complete.
+//
+// The reaper is run by the controller while it processes allocations. With
+// sharding, it only releases the allocations assigned to node.
+type Reaper struct {
+	sm               dhcpmanager.StateManager
+	dhcp             *dhcpmanager.DHCPController
+	manageInterfaces bool
+	node             string
+
+	// suspects are the resources found orphaned in the last run
+	suspects map[string]bool
+}
+
+// ReapReport lists the inconsistencies fixed by a run of the Reaper
+type ReapReport struct {
+	ReturnedMACs        []string
+	RemovedDevices      []string
+	StoppedClients      []string
+	ReleasedAllocations []uuid.UUID
+}
+
+// NewReaper creates a new Reaper
+func NewReaper(sm dhcpmanager.StateManager, dhcp *dhcpmanager.DHCPController, manageInterfaces bool, node string) *Reaper {
+	return &Reaper{
+		sm:               sm,
+		dhcp:             dhcp,
+		manageInterfaces: manageInterfaces,
+		node:             node,
+		suspects:         make(map[string]bool),
+	}
+}
+
+// Run runs the reaper every interval until ctx is cancelled
+func (r *Reaper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := r.Reap()
+		if err != nil {
+			log.Printf("Reaper: %s", err.Error())
+			continue
+		}
+		if !report.Empty() {
+			log.Printf("Reaper: %s", report)
+		}
+	}
+}
+
+// Reap runs a single reconciliation and reports the fixed inconsistencies
+func (r *Reaper) Reap() (*ReapReport, error) {
+
+	report := &ReapReport{}
+	suspects := make(map[string]bool)
+
+	// suspect records an orphaned resource and returns true if it has already
+	// been orphaned in the last run
+	suspect := func(key string) bool {
+		suspects[key] = true
+		return r.suspects[key]
+	}
+	defer func() { r.suspects = suspects }()
+
+	allocations, err := r.sm.Allocations()
+	if err != nil {
+		return nil, fmt.Errorf("could not read allocations - %s", err.Error())
+	}
+
+	// Collect the resources in use by stored allocations
+	now := time.Now()
+	ids := make(map[uuid.UUID]bool)
+	macs := make(map[string]bool)
+	devices := make(map[string]bool)
+	ips := make(map[string]bool)
+	for _, allocation := range allocations {
+		if expire, ok := allocation.RecordExpiry(); ok && expire.Before(now) && r.release(allocation) {
+			// The store should have removed this allocation already. Its
+			// resources stay in use until the controller has released them.
+			report.ReleasedAllocations = append(report.ReleasedAllocations, allocation.ID)
+		}
+		ids[allocation.ID] = true
+		if len(allocation.Interface.HardwareAddr) > 0 {
+			macs[strings.ToLower(allocation.Interface.HardwareAddr.String())] = true
+		}
+		if allocation.Interface.Name != "" {
+			devices[allocation.Interface.Name] = true
+		}
+		if allocation.State.Active() {
+			for _, ip := range allocation.IPs() {
+				ips[ip.String()] = true
+			}
+		}
+	}
+
+	// Stop DHCP clients of removed allocations
+	for _, ip := range r.dhcp.ManagedIPs() {
+		if !ips[ip.String()] && suspect("client:"+ip.String()) {
+			r.dhcp.Stop(&ip)
+			report.StoppedClients = append(report.StoppedClients, ip.String())
+		}
+	}
+
+	if !r.manageInterfaces {
+		return report, nil
+	}
+
+	// Remove devices that do not belong to an allocation
+	ifaces, err := r.dhcp.Devices()
+	if err != nil {
+		return report, fmt.Errorf("could not list devices - %s", err.Error())
+	}
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if devices[iface.Name] {
+			continue
+		}
+		if !suspect("device:" + iface.Name) {
+			// Keep the MAC of a device that may still be bound
+			macs[strings.ToLower(iface.HardwareAddr.String())] = true
+			continue
+		}
+		if err := r.dhcp.RemoveDevice(iface); err != nil {
+			log.Printf("Warning: Could not remove orphaned device [%s] - %s", iface.Name, err.Error())
+			continue
+		}
+		report.RemovedDevices = append(report.RemovedDevices, iface.Name)
+	}
+
+	// Return claimed MACs that are neither used nor claimed by an existing
+	// allocation
+	claims, err := r.sm.Claims()
+	if err != nil {
+		return report, fmt.Errorf("could not read MAC claims - %s", err.Error())
+	}
+	for mac, claimant := range claims {
+		if macs[mac] || ids[claimant] || !suspect("mac:"+mac) {
+			continue
+		}
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			continue
+		}
+		if err := r.sm.PutMAC(hw); err != nil {
+			log.Printf("Warning: Could not return leaked MAC [%s] - %s", mac, err.Error())
+			continue
+		}
+		report.ReturnedMACs = append(report.ReturnedMACs, mac)
+	}
+
+	return report, nil
+}
+
+// release marks an allocation with an expired lease as releasing, so that the
+// controller releases its resources and removes it. Released allocations
+// whose removal failed are removed. It reports whether the allocation has
+// been modified.
+func (r *Reaper) release(allocation *dhcpmanager.Allocation) bool {
+	if r.node != "" && allocation.Node != r.node {
+		return false
+	}
+
+	var err error
+	switch allocation.State {
+	case dhcpmanager.Releasing:
+		return false
+	case dhcpmanager.Released:
+		err = r.sm.Remove(allocation)
+	default:
+		if err = allocation.Transition(dhcpmanager.Releasing, "lease expired"); err == nil {
+			err = r.sm.Update(allocation, allocation.Revision)
+		}
+	}
+	if err != nil {
+		if err != dhcpmanager.ErrConflict {
+			log.Printf("Warning: Could not release expired allocation %s - %s", allocation.ID, err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+// Empty returns true if the report lists no fixed inconsistencies
+func (r *ReapReport) Empty() bool {
+	return len(r.ReturnedMACs) == 0 && len(r.RemovedDevices) == 0 &&
+		len(r.StoppedClients) == 0 && len(r.ReleasedAllocations) == 0
+}
+
+func (r *ReapReport) String() string {
+	return fmt.Sprintf("returned MACs %v, removed devices %v, stopped clients %v, released allocations %v",
+		r.ReturnedMACs, r.RemovedDevices, r.StoppedClients, r.ReleasedAllocations)
+}
@@ -31,6 +31,12 @@ import (
 */
 
 type Configuration struct {
+	// Store is the state store URL: etcd://<endpoints>,
+	// bolt:///<path to database file>, kubernetes://<namespace> or
+	// memory://. The bolt database is locked by the backend and the memory
+	// store is not shared with the controller. The etcd endpoints are used
+	// if empty
+	Store          string        `mapstructure:"store"`
 	EtcdEndpoints  []string      `mapstructure:"etcd"`
 	Port           int           `mapstructure:"ui-port"`
 	RequestTimeout time.Duration `mapstructure:"request-timeout"`
@@ -77,11 +83,11 @@ func main() {
 
 	// Backing infrastructure
 	var err error
-	sm, err = dhcpmanager.NewStateManager(config.EtcdEndpoints, config.DialTimeout, config.RequestTimeout)
+	sm, err = dhcpmanager.OpenStateManager(config.Store, config.EtcdEndpoints, config.DialTimeout, config.RequestTimeout)
 	if err != nil {
-		log.Fatalf("Could not access etcd at %s", config.EtcdEndpoints)
+		log.Fatalf("Could not access state store - %s", err.Error())
 	}
-	//sm = NewInMemoryStateManager()
+	//sm = dhcpmanager.NewInMemoryStateManager()
 
 	// Routing
 	router := mux.NewRouter()
@@ -221,7 +227,7 @@ func pushMACPoolChange(w http.ResponseWriter, r *http.Request) {
 		}
 
 		for _, al := range allocs {
-			if al.State == dhcpmanager.Bound {
+			if al.State.Active() {
 				response.NumBound = response.NumBound + 1
 			}
 		}
@@ -275,7 +281,11 @@ func addAllocation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	alloc := dhcpmanager.NewAllocation(data.Hostname)
-	sm.Put(alloc)
+	if err := sm.Update(alloc, 0); err != nil {
+		res := Response{Status: "error", Info: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
 	json.NewEncoder(w).Encode(alloc)
 }
 
@@ -318,6 +328,7 @@ func processConfiguration() {
 	viper.SetEnvPrefix("DHCP")
 	viper.AutomaticEnv()
 
+	viper.SetDefault("store", "")
 	viper.SetDefault("etcd", []string{"etcd:2379"})
 	viper.SetDefault("ui-port", 8080)
 	viper.SetDefault("request-timeout", "10s")
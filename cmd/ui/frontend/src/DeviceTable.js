@@ -74,6 +74,7 @@ class DeviceTable extends Component {
                 <TableCell className={classes.tablehead}>IP</TableCell>
                 <TableCell className={classes.tablehead}>MAC</TableCell>
                 <TableCell className={classes.tablehead}>Expires</TableCell>
+                <TableCell className={classes.tablehead}>Node</TableCell>
               </TableRow>
             </TableHead>
             <TableBody>
@@ -82,9 +83,10 @@ class DeviceTable extends Component {
                   <TableRow key={n.id}>
                     <StatusTableCell size='16' status={n.State} className={classes.statuscol}></StatusTableCell>
                     <TableCell scope="row" className={classes.namecol}>{n.Hostname}</TableCell> 
-                    <TableCell>{n.Lease !== null ? n.Lease.FixedAddress : "n/a"}</TableCell>
+                    <TableCell>{[n.Lease, n.Lease6].filter(l => l).map(l => l.FixedAddress || l.Address).join(", ") || "n/a"}</TableCell>
                     <TableCell>{n.Interface.HardwareAddr}</TableCell>
                     <TableCell>{n.Lease !== null ? this.formateTime(n.Lease.Expire) : "n/a"}</TableCell>
+                    <TableCell>{n.Node ? n.Node : "n/a"}</TableCell>
                   </TableRow>
                 );
               })}
@@ -2,8 +2,19 @@ import React from 'react';
 import TableCell from '@material-ui/core/TableCell';
 import {withStyles} from '@material-ui/core/styles';
 
-// Status: 0-Unbound, 1-Bound, 2-Stale, 3-Stopped
-const colors = ['#ffdb4d','#009900','#990000','#e6e6e6'];
+const colors = {
+  unbound: '#ffdb4d',
+  binding: '#ffdb4d',
+  bound: '#009900',
+  renewing: '#009900',
+  rebinding: '#ffdb4d',
+  lost: '#ff6600',
+  stale: '#990000',
+  stopped: '#e6e6e6',
+  failed: '#ff6600',
+  releasing: '#e6e6e6',
+  released: '#e6e6e6',
+};
 const stroke = 3;
 
 const styles = {
@@ -0,0 +1,158 @@
+package dhcpmanager
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vishvananda/netlink"
+)
+
+// maxDeviceNameLength is the maximum length of interface names (IFNAMSIZ
+// without the terminating null byte)
+const maxDeviceNameLength = 15
+
+// DeviceMode selects the type of virtual devices created by the
+// DHCPController
+type DeviceMode string
+
+const (
+	// MacvlanBridge = macvlan device in bridge mode (default)
+	MacvlanBridge DeviceMode = "macvlan-bridge"
+
+	// MacvlanPrivate = macvlan device in private mode
+	MacvlanPrivate DeviceMode = "macvlan-private"
+
+	// MacvlanVEPA = macvlan device in VEPA mode
+	MacvlanVEPA DeviceMode = "macvlan-vepa"
+
+	// MacvlanPassthru = macvlan device in passthru mode
+	MacvlanPassthru DeviceMode = "macvlan-passthru"
+
+	// IPvlan = ipvlan device in L2 mode sharing the MAC of the parent
+	// interface. Leases are identified by a client identifier instead.
+	IPvlan DeviceMode = "ipvlan"
+
+	// VLAN = macvlan device in bridge mode on the 802.1Q VLAN sub-interface
+	// of the parent interface
+	VLAN DeviceMode = "vlan"
+)
+
+var macvlanModes = map[DeviceMode]netlink.MacvlanMode{
+	MacvlanBridge:   netlink.MACVLAN_MODE_BRIDGE,
+	MacvlanPrivate:  netlink.MACVLAN_MODE_PRIVATE,
+	MacvlanVEPA:     netlink.MACVLAN_MODE_VEPA,
+	MacvlanPassthru: netlink.MACVLAN_MODE_PASSTHRU,
+}
+
+// ParseDeviceMode parses a device mode. An empty string and macvlan select
+// macvlan in bridge mode.
+func ParseDeviceMode(s string) (DeviceMode, error) {
+	switch m := DeviceMode(strings.ToLower(s)); m {
+	case "", "macvlan":
+		return MacvlanBridge, nil
+	case IPvlan, VLAN:
+		return m, nil
+	default:
+		if _, ok := macvlanModes[m]; ok {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid device mode [%s]", s)
+}
+
+// DeviceConfig selects the virtual device created for an allocation
+type DeviceConfig struct {
+	Mode DeviceMode
+
+	// VLAN is the 802.1Q VLAN ID of VLAN devices. Devices of other modes are
+	// created on the VLAN sub-interface of the parent too if it is set.
+	VLAN int `json:",omitempty"`
+}
+
+// Validate checks that devices can be created with the configuration
+func (d *DeviceConfig) Validate() error {
+	if _, err := ParseDeviceMode(string(d.Mode)); err != nil {
+		return err
+	}
+	if (d.Mode == VLAN || d.VLAN != 0) && (d.VLAN < 1 || d.VLAN > 4094) {
+		return errors.New("VLAN ID must be between 1 and 4094")
+	}
+	return nil
+}
+
+// UsesMAC reports whether devices have their own MAC address taken from the
+// MAC pool. Devices of allocations without configuration are macvlan devices.
+func (d *DeviceConfig) UsesMAC() bool {
+	return d == nil || d.Mode != IPvlan
+}
+
+// newLink returns the link for a device with attributes la. The parent of
+// devices with a VLAN ID is the VLAN sub-interface returned by newVlan.
+func (d *DeviceConfig) newLink(la netlink.LinkAttrs) netlink.Link {
+	if d.Mode == IPvlan {
+		// ipvlan devices always use the MAC of the parent
+		la.HardwareAddr = nil
+		return &netlink.IPVlan{LinkAttrs: la, Mode: netlink.IPVLAN_MODE_L2}
+	}
+	mode, ok := macvlanModes[d.Mode]
+	if !ok {
+		mode = netlink.MACVLAN_MODE_BRIDGE
+	}
+	return &netlink.Macvlan{LinkAttrs: la, Mode: mode}
+}
+
+// newVlan returns the VLAN sub-interface of the interface with index parent.
+// The kernel allows a single VLAN device per parent and VLAN ID, so all
+// devices on the VLAN share it.
+func (d *DeviceConfig) newVlan(parent string, index int) *netlink.Vlan {
+	la := netlink.NewLinkAttrs()
+	la.Name = vlanName(parent, d.VLAN)
+	la.ParentIndex = index
+	return &netlink.Vlan{LinkAttrs: la, VlanId: d.VLAN}
+}
+
+// vlanName returns the name of the VLAN sub-interface of parent tagged with
+// vlan. The name of the parent is shortened if needed.
+func vlanName(parent string, vlan int) string {
+	suffix := "." + strconv.Itoa(vlan)
+	if len(parent)+len(suffix) > maxDeviceNameLength {
+		parent = parent[:maxDeviceNameLength-len(suffix)]
+	}
+	return parent + suffix
+}
+
+// DeviceName returns the name of the device of the allocation with id. The
+// name starts with the first digits of the ID, so that devices can be
+// correlated to allocations. Further attempts replace the last digits with
+// the attempt number to resolve collisions.
+func DeviceName(id uuid.UUID, attempt int) string {
+	digits := hex.EncodeToString(id[:])[:maxDeviceNameLength-len(DevicePrefix)]
+	if attempt > 0 {
+		suffix := "-" + strconv.Itoa(attempt)
+		digits = digits[:len(digits)-len(suffix)] + suffix
+	}
+	return DevicePrefix + digits
+}
+
+// DeviceAlias returns the alias of the device of allocation shown by
+// ip link
+func DeviceAlias(allocation *Allocation) string {
+	if allocation.Hostname == "" {
+		return "dhcpmanager " + allocation.ID.String()
+	}
+	return fmt.Sprintf("dhcpmanager %s %s", allocation.Hostname, allocation.ID)
+}
+
+// isDevice reports whether link has the type of a device created by the
+// DHCPController
+func isDevice(link netlink.Link) bool {
+	switch link.(type) {
+	case *netlink.Macvlan, *netlink.IPVlan, *netlink.Vlan:
+		return strings.HasPrefix(link.Attrs().Name, DevicePrefix)
+	}
+	return false
+}
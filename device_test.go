@@ -0,0 +1,93 @@
+package dhcpmanager
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseDeviceMode(t *testing.T) {
+	valid := map[string]DeviceMode{
+		"":                MacvlanBridge,
+		"macvlan":         MacvlanBridge,
+		"macvlan-vepa":    MacvlanVEPA,
+		"MACVLAN-PRIVATE": MacvlanPrivate,
+		"ipvlan":          IPvlan,
+		"vlan":            VLAN,
+	}
+	for s, expected := range valid {
+		if mode, err := ParseDeviceMode(s); err != nil || mode != expected {
+			t.Errorf("Expected %s for [%s] got %s (%v)", expected, s, mode, err)
+		}
+	}
+	if _, err := ParseDeviceMode("bridge"); err == nil {
+		t.Error("Expected error for invalid device mode")
+	}
+
+	if err := (&DeviceConfig{Mode: VLAN}).Validate(); err == nil {
+		t.Error("Expected error for VLAN device without VLAN ID")
+	}
+	if err := (&DeviceConfig{Mode: VLAN, VLAN: 100}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&DeviceConfig{Mode: IPvlan, VLAN: 4095}).Validate(); err == nil {
+		t.Error("Expected error for invalid VLAN ID")
+	}
+}
+
+func TestDeviceConfigLink(t *testing.T) {
+	mac, _ := net.ParseMAC("56:6a:e2:0b:01:8d")
+	la := netlink.LinkAttrs{Name: DevicePrefix + "test", ParentIndex: 2, HardwareAddr: mac}
+
+	if link, ok := (&DeviceConfig{Mode: MacvlanPassthru}).newLink(la).(*netlink.Macvlan); !ok || link.Mode != netlink.MACVLAN_MODE_PASSTHRU {
+		t.Errorf("Expected macvlan device in passthru mode got %+v", link)
+	}
+	vlan := &DeviceConfig{Mode: VLAN, VLAN: 100}
+	if link, ok := vlan.newLink(la).(*netlink.Macvlan); !ok || link.Mode != netlink.MACVLAN_MODE_BRIDGE || link.HardwareAddr.String() != mac.String() {
+		t.Errorf("Expected macvlan device in bridge mode on the VLAN got %+v", link)
+	}
+	if link := vlan.newVlan("eth0", 2); link.VlanId != 100 || link.ParentIndex != 2 || link.Name != "eth0.100" {
+		t.Errorf("Expected VLAN sub-interface eth0.100 got %+v", link)
+	}
+	if name := vlanName("enp0s31f6-long", 4094); name != "enp0s31f6-.4094" {
+		t.Errorf("Expected shortened name enp0s31f6-.4094 got %s", name)
+	}
+	link, ok := (&DeviceConfig{Mode: IPvlan}).newLink(la).(*netlink.IPVlan)
+	if !ok || link.Mode != netlink.IPVLAN_MODE_L2 || link.HardwareAddr != nil {
+		t.Errorf("Expected ipvlan device in L2 mode without MAC got %+v", link)
+	}
+	if !isDevice(link) || isDevice(&netlink.Device{LinkAttrs: la}) {
+		t.Error("Expected only virtual devices to be managed")
+	}
+
+	var legacy *DeviceConfig
+	if !legacy.UsesMAC() || (&DeviceConfig{Mode: IPvlan}).UsesMAC() {
+		t.Error("Expected only ipvlan devices to share the MAC of the parent")
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	id := uuid.MustParse("0123abcd-4567-89ef-0123-456789abcdef")
+	if name := DeviceName(id, 0); name != "vf-0123abcd4567" {
+		t.Errorf("Expected vf-0123abcd4567 got %s", name)
+	}
+	names := make(map[string]bool)
+	for attempt := 0; attempt <= 10; attempt++ {
+		name := DeviceName(id, attempt)
+		if len(name) > maxDeviceNameLength || !strings.HasPrefix(name, DevicePrefix+"0123abcd") {
+			t.Errorf("Invalid device name %s", name)
+		}
+		if names[name] {
+			t.Errorf("Duplicate device name %s for attempt %d", name, attempt)
+		}
+		names[name] = true
+	}
+
+	allocation := &Allocation{ID: id, Hostname: "web"}
+	if alias := DeviceAlias(allocation); alias != "dhcpmanager web "+id.String() {
+		t.Errorf("Unexpected alias %s", alias)
+	}
+}
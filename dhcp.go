@@ -1,67 +1,166 @@
 package dhcpmanager
 
 import (
+	"encoding/binary"
 	"errors"
 	"log"
 	"net"
 	"time"
 
 	dhclient "github.com/digineo/go-dhclient"
-	"github.com/vishvananda/netlink"
+	"github.com/google/gopacket/layers"
 )
 
+// DevicePrefix is the name prefix of virtual NICs managed by the DHCPController
+const DevicePrefix = "vf-"
+
 // DHCPController manages the DHCP clients
 type DHCPController struct {
-	iface            string
+	pools            map[string]*Pool
 	timeout          time.Duration
-	clients          map[string]*dhclient.Client
+	clients          *clientRegistry
 	manageInterfaces bool
 	assignInterfaces bool
+	releaseLeases    bool
+	declineConflicts bool
+	namespace        *Namespace
+	links            LinkManager
+	clientFactory    DHCPClientFactory
+	clientFactory6   DHCPv6ClientFactory
+	onLeaseEvent     func(LeaseEvent)
+	reportDelay      time.Duration
 }
 
-// NewDHCPController creates a new DHCPController for an interface
-func NewDHCPController(iface string, timeout time.Duration, manageInterfaces, assignInterfaces bool) *DHCPController {
+// NewDHCPController creates a new DHCPController for the parent interfaces
+// of pools. Pool names must be unique and one pool should be the
+// DefaultPool. If releaseLeases is true, leases of released IPs are returned
+// to the DHCP server with a DHCPRELEASE. If declineConflicts is true, leases
+// of IPs that are already managed by another client are rejected with a
+// DHCPDECLINE.
+func NewDHCPController(pools []Pool, timeout time.Duration, manageInterfaces, assignInterfaces, releaseLeases, declineConflicts bool) *DHCPController {
 	c := DHCPController{
+		pools:            make(map[string]*Pool, len(pools)),
 		timeout:          timeout,
-		clients:          make(map[string]*dhclient.Client),
+		clients:          newClientRegistry(),
 		manageInterfaces: manageInterfaces,
-		iface:            iface,
 		assignInterfaces: assignInterfaces,
+		releaseLeases:    releaseLeases,
+		declineConflicts: declineConflicts,
+		links:            NewNetlinkLinkManager(nil),
+		clientFactory:    NewDHCPClientFactory(nil),
+		clientFactory6:   NewDHCPv6ClientFactory(nil),
+		reportDelay:      defaultLeaseReportDelay,
+	}
+	for i := range pools {
+		pool := pools[i]
+		c.pools[PoolName(pool.Name)] = &pool
 	}
 	return &c
 }
 
+// UseNamespace creates devices and runs their DHCP clients in network
+// namespace ns. It must be called before devices are created.
+func (c *DHCPController) UseNamespace(ns *Namespace) {
+	c.namespace = ns
+	c.links = NewNetlinkLinkManager(ns)
+	c.clientFactory = NewDHCPClientFactory(ns)
+	c.clientFactory6 = NewDHCPv6ClientFactory(ns)
+}
+
+// UseLinkManager manages devices with links instead of netlink. It must be
+// called before devices are created.
+func (c *DHCPController) UseLinkManager(links LinkManager) {
+	c.links = links
+}
+
+// UseClientFactory obtains DHCPv4 leases with clients created by factory. It
+// must be called before allocations are bound.
+func (c *DHCPController) UseClientFactory(factory DHCPClientFactory) {
+	c.clientFactory = factory
+}
+
+// UseClientFactory6 obtains DHCPv6 leases with clients created by factory.
+// It must be called before allocations are bound.
+func (c *DHCPController) UseClientFactory6(factory DHCPv6ClientFactory) {
+	c.clientFactory6 = factory
+}
+
+// Namespace returns the network namespace of the devices or nil if devices
+// are created in the namespace of the controller
+func (c *DHCPController) Namespace() *Namespace {
+	return c.namespace
+}
+
 // BindAllocationToInterface create a new DHCP client with the interface and bind to allocation
 func (c *DHCPController) BindAllocationToInterface(allocation *Allocation, iface *net.Interface, onRenew func(*net.Interface, *dhclient.Lease)) (*dhclient.Lease, error) {
 
 	boundCh := make(chan *dhclient.Lease)
-	client := dhclient.Client{
-		Iface:    iface,
-		Hostname: allocation.Hostname,
-
-		OnBound: func(lease *dhclient.Lease) {
-			// Non-blocking send  because we only have a receiver for the first call
-			// But the OnBound callback is also executed for renewals, which we use
-			// to update state
-			select {
-			case boundCh <- lease:
-			default:
-				onRenew(iface, lease)
+	managed := newManagedClient(allocation, iface)
+	onBound := func(lease *dhclient.Lease) {
+		// Non-blocking send  because we only have a receiver for the first call
+		// But the OnBound callback is also executed for renewals, which we use
+		// to update state
+		select {
+		case boundCh <- lease:
+		default:
+			ip, ok := c.clients.renew(managed, lease)
+			if !ok {
+				// Leases received after binding failed or the client has been
+				// stopped are ignored
+				return
 			}
-		},
+			if !lease.FixedAddress.Equal(ip) {
+				// The lease has been lost and the server handed out another IP,
+				// which is returned because the allocation holds ip. Clients
+				// cannot be stopped from their own callbacks.
+				go c.drop(managed, lease)
+				c.emit(LeaseEvent{Type: LeaseIPChanged, Allocation: managed.allocation, Interface: iface.Name,
+					IP: ip, State: LeaseExpired, Lease: lease})
+				return
+			}
+			onRenew(iface, lease)
+		}
+	}
+
+	client := c.clientFactory.NewClient(iface, allocation.Hostname, onBound)
+	if reporter, ok := client.(NAKReporter); ok {
+		reporter.OnNAK(func() {
+			// Rejections of the first request are retried by the client
+			if c.clients.ip(managed) == nil {
+				return
+			}
+			info := c.clients.describe(managed, time.Now())
+			c.emit(LeaseEvent{Type: LeaseRejected, Allocation: info.Allocation, Interface: info.Interface,
+				IP: info.IP, State: info.State})
+		})
+	}
+	allocation.Options.apply(client)
+	if allocation.Options != nil && allocation.Options.ClientID != "" {
+		managed.clientID = encodeClientID(allocation.Options.ClientID)
+	} else if !allocation.Device.UsesMAC() {
+		// All ipvlan devices share the MAC of the parent interface
+		managed.clientID = encodeClientID(allocation.ID.String())
+		client.AddOption(layers.DHCPOptClientID, managed.clientID)
 	}
+	managed.client = client
 	client.Start()
 	select {
 	case lease := <-boundCh:
 		// First check if a client is already handling this IP and stop
-		if _, ok := c.clients[lease.FixedAddress.String()]; ok {
+		if !c.clients.add(managed, lease.FixedAddress, lease) {
 			client.Stop()
+			if c.declineConflicts {
+				// The server handed out an address that is already in use
+				c.sendMessage(dhcpDecline, lease, managed)
+			}
 			return nil, errors.New("IP address already managed")
 		}
+		go c.monitorLease(managed)
 		if c.assignInterfaces {
-			c.associateLeasewithDevice(lease, iface)
+			if err := c.associateLeasewithDevice(lease, iface); err != nil {
+				log.Printf("Warning: Could not add %s to link %s - %s", lease.FixedAddress.String(), iface.Name, err.Error())
+			}
 		}
-		c.clients[lease.FixedAddress.String()] = &client
 		return lease, nil
 	case <-time.After(c.timeout):
 		log.Printf("Timeout binding to interface [%s] for %s", iface.Name, allocation.Hostname)
@@ -71,81 +170,242 @@ func (c *DHCPController) BindAllocationToInterface(allocation *Allocation, iface
 
 }
 
-// Interface returns the parent interface for the DHCP clients
-func (c *DHCPController) Interface() (*net.Interface, error) {
-	return net.InterfaceByName(c.iface)
+// BindAllocationToInterface6 creates a new DHCPv6 client obtaining an IA_NA
+// address for allocation on iface. The IAID is derived from the allocation
+// ID, so that several allocations can share an interface.
+func (c *DHCPController) BindAllocationToInterface6(allocation *Allocation, iface *net.Interface, onRenew func(*net.Interface, *Lease6)) (*Lease6, error) {
+
+	boundCh := make(chan *Lease6)
+	managed := newManagedClient(allocation, iface)
+	onBound := func(lease *Lease6) {
+		// Renewals are reported through onRenew unless binding failed or the
+		// client has been stopped
+		select {
+		case boundCh <- lease:
+		default:
+			if c.clients.ip(managed) != nil {
+				onRenew(iface, lease)
+			}
+		}
+	}
+
+	var fqdn string
+	if allocation.Options != nil {
+		fqdn = allocation.Options.FQDN
+	}
+	client := c.clientFactory6.NewClient6(iface, binary.BigEndian.Uint32(allocation.ID[0:4]), allocation.Hostname, fqdn, onBound)
+	if err := client.Start(); err != nil {
+		return nil, err
+	}
+	select {
+	case lease := <-boundCh:
+		managed.client6 = client
+		if !c.clients.add(managed, lease.Address, nil) {
+			client.Stop()
+			if c.declineConflicts {
+				c.sendMessage6(client.Decline, lease)
+			}
+			return nil, errors.New("IP address already managed")
+		}
+		go c.monitorLease(managed)
+		return lease, nil
+	case <-time.After(c.timeout):
+		log.Printf("Timeout binding to interface [%s] for %s with DHCPv6", iface.Name, allocation.Hostname)
+		client.Stop()
+		return nil, errors.New("Timeout binding to interface")
+	}
+
+}
+
+// Interface returns the parent interface of pool for the DHCP clients
+func (c *DHCPController) Interface(pool string) (*net.Interface, error) {
+	p, err := c.Pool(pool)
+	if err != nil {
+		return nil, err
+	}
+	return net.InterfaceByName(p.Interface)
 }
 
-// Stop stops the DHCP client keeping ip alive
+// Stop stops the DHCP client keeping ip alive. The lease stays reserved on
+// the DHCP server until it expires.
 func (c *DHCPController) Stop(ip *net.IP) {
+	if ip.To4() == nil {
+		c.stop6(ip)
+		return
+	}
+	c.stop(ip)
+}
 
-	if client, ok := c.clients[ip.String()]; ok {
-		delete(c.clients, ip.String())
-		client.Stop()
-		log.Printf("Stopped managing IP %s for %s", ip.String(), client.Hostname)
-	} else {
+// Release stops the DHCP client keeping ip alive and returns the lease to the
+// DHCP server with a DHCPRELEASE, unless releasing leases is disabled
+func (c *DHCPController) Release(ip *net.IP) {
+
+	if ip.To4() == nil {
+		managed := c.stop6(ip)
+		if managed == nil || !c.releaseLeases {
+			return
+		}
+		if lease := managed.client6.Lease(); lease != nil && c.sendMessage6(managed.client6.Release, lease) {
+			log.Printf("Released IP %s for %s", ip.String(), managed.hostname)
+		}
+		return
+	}
+
+	managed := c.stop(ip)
+	if managed == nil || !c.releaseLeases {
+		return
+	}
+	lease := c.clients.lease(managed)
+	if c.sendMessage(dhcpRelease, lease, managed) {
+		log.Printf("Released IP %s for %s", ip.String(), managed.hostname)
+	}
+
+}
+
+func (c *DHCPController) stop(ip *net.IP) *managedClient {
+
+	managed := c.clients.remove(*ip)
+	if managed == nil || managed.client == nil {
 		log.Printf("Cannot stop DHCP client for IP %s - No known client", ip.String())
+		return nil
+	}
+	managed.client.Stop()
+	close(managed.done)
+	log.Printf("Stopped managing IP %s for %s", ip.String(), managed.hostname)
+	return managed
+
+}
+
+// drop stops the unregistered client managed that obtained lease of another
+// IP than its allocation holds and returns lease to the DHCP server, unless
+// releasing leases is disabled
+func (c *DHCPController) drop(managed *managedClient, lease *dhclient.Lease) {
+
+	managed.client.Stop()
+	close(managed.done)
+	log.Printf("Stopped DHCP client for %s that obtained other IP %s", managed.hostname, lease.FixedAddress.String())
+	if c.releaseLeases && c.sendMessage(dhcpRelease, lease, managed) {
+		log.Printf("Released IP %s for %s", lease.FixedAddress.String(), managed.hostname)
+	}
+
+}
+
+func (c *DHCPController) stop6(ip *net.IP) *managedClient {
+
+	managed := c.clients.remove(*ip)
+	if managed == nil || managed.client6 == nil {
+		log.Printf("Cannot stop DHCPv6 client for IP %s - No known client", ip.String())
+		return nil
+	}
+	managed.client6.Stop()
+	close(managed.done)
+	log.Printf("Stopped managing IP %s for %s", ip.String(), managed.hostname)
+	return managed
+
+}
+
+// sendMessage6 sends a DHCPv6 release or decline for lease with send and
+// reports whether the message was sent
+func (c *DHCPController) sendMessage6(send func(*Lease6) error, lease *Lease6) bool {
+	if err := send(lease); err != nil {
+		log.Printf("Warning: Could not send DHCPv6 message for IP %s - %s", lease.Address.String(), err.Error())
+		return false
 	}
+	return true
+}
 
+// sendMessage sends a DHCPRELEASE or DHCPDECLINE for lease of managed from
+// the namespace of the devices and reports whether the message was sent
+func (c *DHCPController) sendMessage(msgType byte, lease *dhclient.Lease, managed *managedClient) bool {
+	if err := sendDHCPMessage(msgType, lease, managed.iface.HardwareAddr, managed.clientID, c.namespace); err != nil {
+		log.Printf("Warning: Could not send DHCP message for IP %s - %s", lease.FixedAddress.String(), err.Error())
+		return false
+	}
+	return true
 }
 
-func (c *DHCPController) associateLeasewithDevice(lease *dhclient.Lease, iface *net.Interface) {
+// ManagedIPs returns the IPs kept alive by DHCP clients
+func (c *DHCPController) ManagedIPs() []net.IP {
+	return c.clients.ips()
+}
 
-	link, _ := netlink.LinkByName(iface.Name)
+func (c *DHCPController) associateLeasewithDevice(lease *dhclient.Lease, iface *net.Interface) error {
 
+	if lease.Netmask == nil {
+		return errors.New("Lease without netmask")
+	}
 	cidr := net.IPNet{
 		IP:   lease.FixedAddress,
 		Mask: lease.Netmask,
 	}
-	addr, _ := netlink.ParseAddr(cidr.String())
 	log.Printf("Adding %s to link %s", cidr.String(), iface.Name)
 
-	netlink.AddrAdd(link, addr)
+	return c.links.AddAddress(iface.Name, cidr)
 }
 
-// CreateDevice creates a new network interface and bridges it to iface
-func (c *DHCPController) CreateDevice(ifName string, mac *net.HardwareAddr) (*net.Interface, error) {
-
-	parent, err := netlink.LinkByName(c.iface)
-	if err != nil {
-		return nil, err
+// Device returns the device configuration used for an allocation in pool
+// with configuration device, which may be nil to select the pool's default
+func (c *DHCPController) Device(pool string, device *DeviceConfig) (DeviceConfig, error) {
+	if device != nil {
+		return *device, nil
 	}
-	la := netlink.LinkAttrs{
-		Name:        ifName,
-		ParentIndex: parent.Attrs().Index,
+	p, err := c.Pool(pool)
+	if err != nil {
+		return DeviceConfig{}, err
 	}
+	return p.Device, nil
+}
 
-	if mac != nil {
-		la.HardwareAddr = *mac
-	}
+// CreateDevice creates a new network interface with alias on the parent
+// interface of pool. The type of the interface is selected by device or the
+// default configuration of the pool if device is nil. Errors satisfy
+// errors.Is(err, os.ErrExist) if an interface named ifName exists.
+func (c *DHCPController) CreateDevice(ifName, alias string, mac *net.HardwareAddr, pool string, device *DeviceConfig) (*net.Interface, error) {
 
-	mybridge := &netlink.Macvlan{
-		LinkAttrs: la,
-		Mode:      netlink.MACVLAN_MODE_BRIDGE,
+	config, err := c.Device(pool, device)
+	if err != nil {
+		return nil, err
 	}
-	err = netlink.LinkAdd(mybridge)
+	p, err := c.Pool(pool)
 	if err != nil {
-		log.Printf("could not add interface %s: %v\n", la.Name, err)
 		return nil, err
 	}
 
-	ifn, err := net.InterfaceByName(la.Name)
-	if err == nil {
-		err = netlink.LinkSetUp(mybridge)
+	var hwaddr net.HardwareAddr
+	if mac != nil {
+		hwaddr = *mac
 	}
+	return c.links.CreateLink(p.Interface, ifName, alias, hwaddr, config)
+}
 
-	if err != nil {
-		// try to remove device if setup failed to avoid orphaned devices
-		netlink.LinkDel(mybridge)
+// Devices returns the virtual NICs on the host or in the namespace of the
+// controller that are named like devices created by CreateDevice
+func (c *DHCPController) Devices() ([]net.Interface, error) {
+	return c.links.Links("")
+}
+
+// PoolDevices returns the devices like Devices that have been created on the
+// parent interface of a pool
+func (c *DHCPController) PoolDevices() ([]net.Interface, error) {
+	devices := make([]net.Interface, 0)
+	parents := make(map[string]bool, len(c.pools))
+	for _, pool := range c.pools {
+		// Pools may share their parent interface
+		if parents[pool.Interface] {
+			continue
+		}
+		parents[pool.Interface] = true
+		ifaces, err := c.links.Links(pool.Interface)
+		if err != nil {
+			log.Printf("Warning: Could not list devices of pool %s - %s", pool.Name, err.Error())
+			continue
+		}
+		devices = append(devices, ifaces...)
 	}
-	return ifn, err
+	return devices, nil
 }
 
 // RemoveDevice removes virtual NICs
-func RemoveDevice(iface *net.Interface) error {
-	link, err := netlink.LinkByName(iface.Name)
-	if err != nil {
-		return err
-	}
-	return netlink.LinkDel(link)
+func (c *DHCPController) RemoveDevice(iface *net.Interface) error {
+	return c.links.DeleteLink(iface.Name)
 }
@@ -0,0 +1,250 @@
+package dhcpmanager
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/gopacket/layers"
+	"github.com/kramergroup/dhcpmanager/internal/dhcptest"
+)
+
+// fakeFactory creates the clients of a fake DHCP server
+type fakeFactory struct {
+	server *dhcptest.Server
+}
+
+func (f fakeFactory) NewClient(iface *net.Interface, hostname string, onBound func(*dhclient.Lease)) DHCPClient {
+	return f.server.NewClient(iface, hostname, onBound)
+}
+
+func newFakeController(leaseTime time.Duration) (*DHCPController, *dhcptest.Server) {
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	server := dhcptest.NewServer(*network, leaseTime)
+	c := NewDHCPController([]Pool{{Name: DefaultPool, Interface: "eth0"}}, 200*time.Millisecond, true, false, false, false)
+	c.UseClientFactory(fakeFactory{server})
+	return c, server
+}
+
+func newFakeInterface(name, mac string) *net.Interface {
+	hw, _ := net.ParseMAC(mac)
+	return &net.Interface{Name: name, HardwareAddr: hw}
+}
+
+func TestBindAllocationToInterface(t *testing.T) {
+	c, server := newFakeController(time.Hour)
+	iface := newFakeInterface("vf-a", "56:6a:e2:0b:01:8d")
+	allocation := NewAllocation("web")
+
+	lease, err := c.BindAllocationToInterface(allocation, iface, func(*net.Interface, *dhclient.Lease) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lease.FixedAddress.Equal(net.ParseIP("192.168.1.2")) {
+		t.Errorf("Expected IP 192.168.1.2 got %s", lease.FixedAddress)
+	}
+	info, ok := c.Client(lease.FixedAddress)
+	if !ok || info.Allocation != allocation.ID || info.State != LeaseBound {
+		t.Errorf("Unexpected client %+v", info)
+	}
+
+	// The server hands out an IP that is already managed
+	server.Script(dhcptest.Response{IP: lease.FixedAddress})
+	other := NewAllocation("other")
+	if _, err := c.BindAllocationToInterface(other, newFakeInterface("vf-b", "30:ba:33:c2:e3:c2"), nil); err == nil {
+		t.Error("Expected error for managed IP")
+	}
+	if len(c.ManagedIPs()) != 1 || server.Running() != 1 {
+		t.Errorf("Expected client of conflicting lease to be stopped, %d running", server.Running())
+	}
+
+	// A rejected request is repeated
+	server.Script(dhcptest.Response{NAK: true})
+	lease, err = c.BindAllocationToInterface(other, newFakeInterface("vf-b", "30:ba:33:c2:e3:c2"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Requests() != 4 {
+		t.Errorf("Expected 4 requests got %d", server.Requests())
+	}
+
+	c.Stop(&lease.FixedAddress)
+	if _, ok := c.Client(lease.FixedAddress); ok || server.Running() != 1 {
+		t.Errorf("Expected client to be stopped, %d running", server.Running())
+	}
+}
+
+func TestBindAllocationToInterfaceTimeout(t *testing.T) {
+	c, server := newFakeController(time.Hour)
+	server.Script(dhcptest.Response{Delay: time.Second})
+
+	if _, err := c.BindAllocationToInterface(NewAllocation("web"), newFakeInterface("vf-a", "56:6a:e2:0b:01:8d"), nil); err == nil {
+		t.Error("Expected timeout")
+	}
+	if server.Running() != 0 || len(c.ManagedIPs()) != 0 {
+		t.Errorf("Expected client to be stopped, %d running", server.Running())
+	}
+}
+
+// manualClient is a DHCPClient whose leases are delivered by the test
+type manualClient struct {
+	onBound func(*dhclient.Lease)
+}
+
+func (c *manualClient) NewClient(iface *net.Interface, hostname string, onBound func(*dhclient.Lease)) DHCPClient {
+	c.onBound = onBound
+	return c
+}
+
+func (c *manualClient) AddOption(layers.DHCPOpt, []byte) {}
+func (c *manualClient) AddParamRequest(layers.DHCPOpt)   {}
+func (c *manualClient) Start()                           {}
+func (c *manualClient) Stop()                            {}
+
+func TestBindAllocationToInterfaceLateLease(t *testing.T) {
+	c, _ := newFakeController(time.Hour)
+	client := &manualClient{}
+	c.UseClientFactory(client)
+
+	renew := func(*net.Interface, *dhclient.Lease) { t.Error("Expected late lease to be ignored") }
+	if _, err := c.BindAllocationToInterface(NewAllocation("web"), newFakeInterface("vf-a", "56:6a:e2:0b:01:8d"), renew); err == nil {
+		t.Fatal("Expected timeout")
+	}
+
+	// A lease delivered while the timed out client is stopped is not reported
+	now := time.Now()
+	client.onBound(&dhclient.Lease{FixedAddress: net.ParseIP("192.168.1.2"), Renew: now.Add(time.Hour), Expire: now.Add(2 * time.Hour)})
+	if len(c.ManagedIPs()) != 0 {
+		t.Errorf("Expected no client got %v", c.ManagedIPs())
+	}
+}
+
+// manualClient6 is a DHCPv6Client whose lease is delivered when it starts
+type manualClient6 struct {
+	lease    *Lease6
+	iaid     uint32
+	released []*Lease6
+	stopped  bool
+}
+
+func (c *manualClient6) NewClient6(iface *net.Interface, iaid uint32, hostname, fqdn string, onBound func(*Lease6)) DHCPv6Client {
+	c.iaid = iaid
+	c.lease.IAID = iaid
+	go onBound(c.lease)
+	return c
+}
+
+func (c *manualClient6) Start() error                { return nil }
+func (c *manualClient6) Stop()                       { c.stopped = true }
+func (c *manualClient6) Lease() *Lease6              { return c.lease }
+func (c *manualClient6) Decline(lease *Lease6) error { return nil }
+func (c *manualClient6) Release(lease *Lease6) error {
+	c.released = append(c.released, lease)
+	return nil
+}
+
+func TestBindAllocationToInterface6(t *testing.T) {
+	c := NewDHCPController([]Pool{{Name: DefaultPool, Interface: "eth0"}}, 200*time.Millisecond, true, false, true, false)
+	now := time.Now()
+	client := &manualClient6{lease: &Lease6{Address: net.ParseIP("2001:db8::2"), Renew: now.Add(time.Hour), Expire: now.Add(2 * time.Hour)}}
+	c.UseClientFactory6(client)
+	allocation := NewAllocation("web")
+
+	lease, err := c.BindAllocationToInterface6(allocation, newFakeInterface("vf-a", "56:6a:e2:0b:01:8d"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.iaid != binary.BigEndian.Uint32(allocation.ID[0:4]) {
+		t.Errorf("Expected IAID derived from allocation got %d", client.iaid)
+	}
+	info, ok := c.Client(lease.Address)
+	if !ok || info.Allocation != allocation.ID || !info.Expire.Equal(lease.Expire) {
+		t.Errorf("Unexpected client %+v", info)
+	}
+
+	c.Release(&lease.Address)
+	if !client.stopped || len(client.released) != 1 || len(c.ManagedIPs()) != 0 {
+		t.Errorf("Expected client to be stopped and lease released, released %d", len(client.released))
+	}
+}
+
+func TestBindAllocationToInterfaceIPvlan(t *testing.T) {
+	c, server := newFakeController(time.Hour)
+	parent := newFakeInterface("vf-a", "56:6a:e2:0b:01:8d")
+
+	// ipvlan devices share the MAC of the parent and are told apart by the
+	// client identifier
+	var ips []string
+	for _, hostname := range []string{"web", "db"} {
+		allocation := NewAllocation(hostname)
+		allocation.Device = &DeviceConfig{Mode: IPvlan}
+		lease, err := c.BindAllocationToInterface(allocation, parent, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientID := encodeClientID(allocation.ID.String())
+		if server.Binding(string(clientID)) == nil {
+			t.Errorf("Expected lease bound to client identifier of %s", hostname)
+		}
+		// The lease is released with the identifier it was obtained with
+		c.clients.mu.RLock()
+		managed := c.clients.clients[lease.FixedAddress.String()]
+		c.clients.mu.RUnlock()
+		if managed == nil || string(managed.clientID) != string(clientID) {
+			t.Errorf("Expected client identifier of %s to be kept for release", hostname)
+		}
+		ips = append(ips, lease.FixedAddress.String())
+	}
+	if ips[0] == ips[1] {
+		t.Errorf("Expected different IPs got %v", ips)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	c, server := newFakeController(100 * time.Millisecond)
+	renewed := make(chan *dhclient.Lease, 10)
+	iface := newFakeInterface("vf-a", "56:6a:e2:0b:01:8d")
+
+	lease, err := c.BindAllocationToInterface(NewAllocation("web"), iface, func(renewedIface *net.Interface, lease *dhclient.Lease) {
+		if renewedIface != iface {
+			t.Errorf("Expected renewal on %s got %s", iface.Name, renewedIface.Name)
+		}
+		renewed <- lease
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(&lease.FixedAddress)
+
+	select {
+	case renewal := <-renewed:
+		if !renewal.FixedAddress.Equal(lease.FixedAddress) || !renewal.Expire.After(lease.Expire) {
+			t.Errorf("Unexpected renewal %s until %s", renewal.FixedAddress, renewal.Expire)
+		}
+		info, _ := c.Client(lease.FixedAddress)
+		if !info.Expire.Equal(renewal.Expire) {
+			t.Errorf("Expected renewed lease in registry, expires %s", info.Expire)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Lease not renewed")
+	}
+
+	// The lease expires if renewals are not answered and a new lease is
+	// obtained afterwards
+	server.Script(dhcptest.Response{Ignore: true}, dhcptest.Response{Ignore: true}, dhcptest.Response{Ignore: true})
+	previous := lease
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case renewal := <-renewed:
+			if !renewal.Bound.Before(previous.Expire) {
+				return
+			}
+			previous = renewal
+		case <-deadline:
+			t.Fatalf("Lease not obtained again after %d requests", server.Requests())
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package dhcpmanager
+
+import (
+	"net"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/gopacket/layers"
+)
+
+// DHCPClient obtains and renews a DHCPv4 lease in the background
+type DHCPClient interface {
+	// AddOption adds an option sent with every request
+	AddOption(optionType layers.DHCPOpt, data []byte)
+
+	// AddParamRequest adds an option to the parameter request list
+	AddParamRequest(dhcpOpt layers.DHCPOpt)
+
+	Start()
+	Stop()
+}
+
+// NAKReporter is implemented by DHCPClients that report requests rejected
+// by the DHCP server. Clients of go-dhclient, which the default factory
+// creates for devices outside of a Namespace, do not report rejections and
+// their lost leases are only detected when they expire.
+type NAKReporter interface {
+	// OnNAK sets the function called when the server answers a request
+	// with a DHCPNAK. It must be called before the client is started.
+	OnNAK(fn func())
+}
+
+// DHCPClientFactory creates the DHCPv4 clients of a DHCPController
+type DHCPClientFactory interface {
+	// NewClient creates a client obtaining a lease on iface. onBound is
+	// called with the first lease and every renewed lease.
+	NewClient(iface *net.Interface, hostname string, onBound func(*dhclient.Lease)) DHCPClient
+}
+
+// DHCPv6Client obtains and renews a DHCPv6 lease of an IA_NA in the
+// background
+type DHCPv6Client interface {
+	Start() error
+	Stop()
+
+	// Lease returns the current lease or nil
+	Lease() *Lease6
+
+	// Release returns lease to the server and Decline rejects an address of
+	// lease that is already in use. The client must be stopped.
+	Release(lease *Lease6) error
+	Decline(lease *Lease6) error
+}
+
+// DHCPv6ClientFactory creates the DHCPv6 clients of a DHCPController
+type DHCPv6ClientFactory interface {
+	// NewClient6 creates a client obtaining a lease for the IA_NA iaid on
+	// iface. The client FQDN option carries fqdn or, if empty, hostname.
+	// onBound is called with the first lease and every renewed lease.
+	NewClient6(iface *net.Interface, iaid uint32, hostname, fqdn string, onBound func(*Lease6)) DHCPv6Client
+}
+
+// dhcpClientFactory creates clients talking to the DHCP servers of the
+// network with go-dhclient or, for devices in a namespace, dhcpv4Client.
+// DHCPv6 clients are always dhcpv6Clients.
+type dhcpClientFactory struct {
+	ns *Namespace
+}
+
+// NewDHCPClientFactory creates a DHCPClientFactory for clients on devices in
+// namespace ns or in the namespace of the controller if ns is nil
+func NewDHCPClientFactory(ns *Namespace) DHCPClientFactory {
+	return &dhcpClientFactory{ns: ns}
+}
+
+// NewDHCPv6ClientFactory creates a DHCPv6ClientFactory for clients on
+// devices in namespace ns or in the namespace of the controller if ns is nil
+func NewDHCPv6ClientFactory(ns *Namespace) DHCPv6ClientFactory {
+	return &dhcpClientFactory{ns: ns}
+}
+
+func (f *dhcpClientFactory) NewClient(iface *net.Interface, hostname string, onBound func(*dhclient.Lease)) DHCPClient {
+	if f.ns != nil {
+		// go-dhclient cannot open its sockets in another namespace
+		return &dhcpv4Client{Iface: iface, Hostname: hostname, OnBound: onBound, ns: f.ns}
+	}
+	return &dhclient.Client{Iface: iface, Hostname: hostname, OnBound: onBound}
+}
+
+// NewClient6 creates a client identified by a DUID derived from the hardware
+// address of iface, so that several clients can share an interface
+func (f *dhcpClientFactory) NewClient6(iface *net.Interface, iaid uint32, hostname, fqdn string, onBound func(*Lease6)) DHCPv6Client {
+	return &dhcpv6Client{
+		Iface:    iface,
+		DUID:     newDUID(iface.HardwareAddr),
+		IAID:     iaid,
+		Hostname: hostname,
+		FQDN:     fqdn,
+		OnBound:  onBound,
+		ns:       f.ns,
+	}
+}
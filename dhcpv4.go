@@ -0,0 +1,610 @@
+package dhcpmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// DHCP message types (RFC 2132, option 53) received by the dhcpv4Client
+const (
+	dhcpDiscover byte = 1
+	dhcpOffer    byte = 2
+	dhcpRequest  byte = 3
+	dhcpAck      byte = 5
+	dhcpNak      byte = 6
+)
+
+// DHCP options evaluated by the dhcpv4Client
+const (
+	dhcpOptSubnetMask  byte = 1
+	dhcpOptRouter      byte = 3
+	dhcpOptTimeServer  byte = 4
+	dhcpOptDNS         byte = 6
+	dhcpOptHostname    byte = 12
+	dhcpOptDomainName  byte = 15
+	dhcpOptMTU         byte = 26
+	dhcpOptBroadcast   byte = 28
+	dhcpOptLeaseTime   byte = 51
+	dhcpOptRenewalTime byte = 58
+	dhcpOptRebindTime  byte = 59
+	dhcpOptPad         byte = 0
+)
+
+const (
+	dhcpClientPort    = 68
+	dhcpBootReply     = 2
+	dhcpFlagBroadcast = 0x8000
+
+	// dhcpMinMessageLength is the minimum length of BOOTP messages accepted
+	// by all relay agents (RFC 1542, section 2.1)
+	dhcpMinMessageLength = 300
+
+	// dhcpv4RetransmitTimeout is the initial retransmission timeout of
+	// requests. It doubles with every retransmission up to
+	// dhcpv4MaxRetransmitTimeout (RFC 2131, section 4.1).
+	dhcpv4RetransmitTimeout    = 4 * time.Second
+	dhcpv4MaxRetransmitTimeout = 64 * time.Second
+)
+
+// errDHCPNak is returned for requests rejected by the DHCP server
+var errDHCPNak = errors.New("DHCP server rejected the request")
+
+// dhcpv4Peer is the destination of a unicast request. MAC is the hardware
+// address of the server or the router towards it and From the source IP of
+// the request.
+type dhcpv4Peer struct {
+	MAC  net.HardwareAddr
+	IP   net.IP
+	From net.IP
+}
+
+// dhcpv4Option is a single DHCP option
+type dhcpv4Option struct {
+	Code byte
+	Data []byte
+}
+
+// dhcpv4Message is a BOOTP message with DHCP options
+type dhcpv4Message struct {
+	Op      byte
+	XID     uint32
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options []dhcpv4Option
+}
+
+func (m *dhcpv4Message) marshal() []byte {
+	b := make([]byte, dhcpHeaderLength+4, dhcpHeaderLength+64)
+	b[0] = m.Op
+	b[1] = dhcpEthernet
+	b[2] = byte(len(m.CHAddr))
+	binary.BigEndian.PutUint32(b[4:8], m.XID)
+	binary.BigEndian.PutUint16(b[10:12], m.Flags)
+	copy(b[12:16], m.CIAddr.To4())
+	copy(b[16:20], m.YIAddr.To4())
+	copy(b[20:24], m.SIAddr.To4())
+	copy(b[28:44], m.CHAddr)
+	binary.BigEndian.PutUint32(b[dhcpHeaderLength:], dhcpMagicCookie)
+	for _, option := range m.Options {
+		b = append(append(b, option.Code, byte(len(option.Data))), option.Data...)
+	}
+	return append(b, dhcpOptEnd)
+}
+
+// option returns the data of the first option with code or nil
+func (m *dhcpv4Message) option(code byte) []byte {
+	for _, option := range m.Options {
+		if option.Code == code {
+			return option.Data
+		}
+	}
+	return nil
+}
+
+// messageType returns the DHCP message type of m
+func (m *dhcpv4Message) messageType() byte {
+	if t := m.option(dhcpOptMessageType); len(t) == 1 {
+		return t[0]
+	}
+	return 0
+}
+
+func parseDHCPv4Message(b []byte) (*dhcpv4Message, error) {
+	if len(b) < dhcpHeaderLength+4 || binary.BigEndian.Uint32(b[dhcpHeaderLength:]) != dhcpMagicCookie {
+		return nil, errors.New("Invalid DHCP message")
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		return nil, errors.New("Invalid hardware address length")
+	}
+	m := &dhcpv4Message{
+		Op:     b[0],
+		XID:    binary.BigEndian.Uint32(b[4:8]),
+		Flags:  binary.BigEndian.Uint16(b[10:12]),
+		CIAddr: net.IP(b[12:16]),
+		YIAddr: net.IP(b[16:20]),
+		SIAddr: net.IP(b[20:24]),
+		CHAddr: net.HardwareAddr(b[28 : 28+hlen]),
+	}
+	for b = b[dhcpHeaderLength+4:]; len(b) > 0 && b[0] != dhcpOptEnd; {
+		if b[0] == dhcpOptPad {
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errors.New("Truncated DHCP option")
+		}
+		m.Options = append(m.Options, dhcpv4Option{Code: b[0], Data: b[2 : 2+int(b[1])]})
+		b = b[2+int(b[1]):]
+	}
+	return m, nil
+}
+
+// parseIPs parses a list of IPv4 addresses
+func parseIPs(data []byte) []net.IP {
+	ips := make([]net.IP, 0, len(data)/4)
+	for i := 0; i+4 <= len(data); i += 4 {
+		ips = append(ips, net.IP(data[i:i+4]))
+	}
+	return ips
+}
+
+// parseLease4 extracts the lease from an acknowledgement received at now
+func parseLease4(m *dhcpv4Message, now time.Time) (*dhclient.Lease, error) {
+	if m.YIAddr.To4() == nil || m.YIAddr.Equal(net.IPv4zero) {
+		return nil, errors.New("Acknowledgement without address")
+	}
+
+	lease := &dhclient.Lease{
+		FixedAddress: m.YIAddr,
+		NextServer:   m.SIAddr,
+		Bound:        now,
+	}
+	var leaseTime, t1, t2 time.Duration
+	for _, option := range m.Options {
+		switch option.Code {
+		case dhcpOptMessageType:
+		case dhcpOptServerID:
+			lease.ServerID = net.IP(option.Data)
+		case dhcpOptSubnetMask:
+			lease.Netmask = net.IPMask(option.Data)
+		case dhcpOptBroadcast:
+			lease.Broadcast = net.IP(option.Data)
+		case dhcpOptRouter:
+			lease.Router = parseIPs(option.Data)
+		case dhcpOptDNS:
+			lease.DNS = parseIPs(option.Data)
+		case dhcpOptTimeServer:
+			lease.TimeServer = parseIPs(option.Data)
+		case dhcpOptDomainName:
+			lease.DomainName = string(option.Data)
+		case dhcpOptMTU:
+			if len(option.Data) == 2 {
+				lease.MTU = binary.BigEndian.Uint16(option.Data)
+			}
+		case dhcpOptLeaseTime, dhcpOptRenewalTime, dhcpOptRebindTime:
+			if len(option.Data) != 4 {
+				continue
+			}
+			d := time.Duration(binary.BigEndian.Uint32(option.Data)) * time.Second
+			switch option.Code {
+			case dhcpOptLeaseTime:
+				leaseTime = d
+			case dhcpOptRenewalTime:
+				t1 = d
+			default:
+				t2 = d
+			}
+		default:
+			lease.OtherOptions = append(lease.OtherOptions, layers.NewDHCPOption(layers.DHCPOpt(option.Code), option.Data))
+		}
+	}
+	if leaseTime == 0 {
+		return nil, errors.New("Acknowledgement without lease time")
+	}
+	if t1 == 0 || t1 > leaseTime {
+		t1 = leaseTime / 2
+	}
+	if t2 == 0 || t2 > leaseTime {
+		t2 = leaseTime * 7 / 8
+	}
+	lease.Renew = now.Add(t1)
+	lease.Rebind = now.Add(t2)
+	lease.Expire = now.Add(leaseTime)
+	return lease, nil
+}
+
+// dhcpv4Conn exchanges the messages of a dhcpv4Client with DHCP servers
+type dhcpv4Conn interface {
+	// exchange sends m to the peer to or broadcasts it if to is nil and
+	// returns the reply with the hardware address it was sent from
+	exchange(ctx context.Context, m *dhcpv4Message, to *dhcpv4Peer, deadline time.Time) (*dhcpv4Message, net.HardwareAddr, error)
+
+	Close() error
+}
+
+// dhcpv4Client obtains and renews a DHCPv4 lease with a packet socket that is
+// opened in the network namespace of the interface. It is used instead of
+// go-dhclient for devices in a Namespace (see the package documentation).
+// Leases are renewed with requests unicast to
+// the server that issued them. Servers reply to renewals at the leased IP,
+// which is only reachable if the IP is assigned to the interface. Leases
+// that are not renewed until the rebinding time are therefore extended with
+// broadcast requests for the leased IP, whose replies are received without
+// assigning the IP.
+type dhcpv4Client struct {
+	Iface    *net.Interface
+	Hostname string
+	OnBound  func(*dhclient.Lease)
+
+	ns      *Namespace
+	options []dhcpv4Option
+	params  []byte
+	onNAK   func()
+
+	// open opens the connection to the servers instead of a packet socket
+	// in ns if not nil
+	open func() (dhcpv4Conn, error)
+
+	mu     sync.Mutex
+	lease  *dhclient.Lease
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// AddOption adds an option sent with every request
+func (c *dhcpv4Client) AddOption(optionType layers.DHCPOpt, data []byte) {
+	c.options = append(c.options, dhcpv4Option{Code: byte(optionType), Data: data})
+}
+
+// AddParamRequest adds an option to the parameter request list
+func (c *dhcpv4Client) AddParamRequest(dhcpOpt layers.DHCPOpt) {
+	c.params = append(c.params, byte(dhcpOpt))
+}
+
+// OnNAK sets the function called when the server rejects a request
+func (c *dhcpv4Client) OnNAK(fn func()) {
+	c.onNAK = fn
+}
+
+// Start starts obtaining a lease in the background
+func (c *dhcpv4Client) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go c.run(ctx)
+}
+
+// Stop stops the client. The lease is kept on the server until it expires.
+func (c *dhcpv4Client) Stop() {
+	c.cancel()
+	<-c.done
+}
+
+// Lease returns the current lease or nil
+func (c *dhcpv4Client) Lease() *dhclient.Lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lease
+}
+
+// run obtains a lease and renews it until ctx is cancelled. A lost lease is
+// replaced with a new lease, preferably of the same IP.
+func (c *dhcpv4Client) run(ctx context.Context) {
+	defer close(c.done)
+
+	var lease *dhclient.Lease
+	var previous net.IP
+	var server net.HardwareAddr
+	for ctx.Err() == nil {
+		conn, err := c.openConn()
+		if err == nil {
+			if lease == nil {
+				lease, server, err = c.obtain(ctx, conn, previous)
+			} else {
+				lease, server, err = c.extend(ctx, conn, lease, server)
+			}
+			conn.Close()
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("DHCP: [%s] %s", c.Iface.Name, err.Error())
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		c.lease = lease
+		c.mu.Unlock()
+		previous = lease.FixedAddress
+		if c.OnBound != nil {
+			c.OnBound(lease)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(lease.Renew)):
+		}
+	}
+}
+
+// openConn opens the connection for a single exchange of leases
+func (c *dhcpv4Client) openConn() (dhcpv4Conn, error) {
+	if c.open != nil {
+		return c.open()
+	}
+	conn, err := openPacketConn(c.Iface, c.ns)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// obtain requests a new lease from the first server that offers one. The
+// previous IP of the client is requested again if not nil (RFC 2131,
+// section 4.4.1). The lease is returned with the hardware address it was
+// received from.
+func (c *dhcpv4Client) obtain(ctx context.Context, conn dhcpv4Conn, previous net.IP) (*dhclient.Lease, net.HardwareAddr, error) {
+
+	var options []dhcpv4Option
+	if previous != nil {
+		options = append(options, dhcpv4Option{Code: dhcpOptRequestedIP, Data: previous.To4()})
+	}
+	discover := c.newMessage(dhcpDiscover, options...)
+	offer, _, err := conn.exchange(ctx, discover, nil, time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if offer.messageType() != dhcpOffer {
+		return nil, nil, fmt.Errorf("Unexpected DHCP message type %d", offer.messageType())
+	}
+
+	request := c.newMessage(dhcpRequest,
+		dhcpv4Option{Code: dhcpOptRequestedIP, Data: offer.YIAddr.To4()},
+		dhcpv4Option{Code: dhcpOptServerID, Data: offer.option(dhcpOptServerID)})
+	return c.request(ctx, conn, request, nil, time.Now().Add(dhcpv4MaxRetransmitTimeout))
+}
+
+// extend renews lease until the rebinding time with requests unicast to the
+// server identifier through the hardware address server, which the lease
+// was received from (RFC 2131, section 4.4.5). Afterwards the leased IP is
+// requested again with broadcasts until lease expires. No lease is returned
+// if the server rejects the request or lease expired.
+func (c *dhcpv4Client) extend(ctx context.Context, conn dhcpv4Conn, lease *dhclient.Lease, server net.HardwareAddr) (*dhclient.Lease, net.HardwareAddr, error) {
+
+	if server != nil && lease.ServerID.To4() != nil && time.Now().Before(lease.Rebind) {
+		request := c.newMessage(dhcpRequest)
+		request.Flags = 0
+		request.CIAddr = lease.FixedAddress.To4()
+		to := &dhcpv4Peer{MAC: server, IP: lease.ServerID.To4(), From: request.CIAddr}
+		renewed, from, err := c.request(ctx, conn, request, to, lease.Rebind)
+		if err == nil {
+			return renewed, from, nil
+		}
+		if err == errDHCPNak || ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("Lease for %s not renewed - %s", lease.FixedAddress, err.Error())
+		}
+	}
+
+	request := c.newMessage(dhcpRequest, dhcpv4Option{Code: dhcpOptRequestedIP, Data: lease.FixedAddress.To4()})
+	renewed, from, err := c.request(ctx, conn, request, nil, lease.Expire)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Lease for %s not renewed - %s", lease.FixedAddress, err.Error())
+	}
+	return renewed, from, nil
+}
+
+// request sends request to the peer to or broadcasts it if to is nil. The
+// lease is returned with the hardware address it was received from.
+func (c *dhcpv4Client) request(ctx context.Context, conn dhcpv4Conn, request *dhcpv4Message, to *dhcpv4Peer, deadline time.Time) (*dhclient.Lease, net.HardwareAddr, error) {
+	ack, from, err := conn.exchange(ctx, request, to, deadline)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ack.messageType() == dhcpNak {
+		if c.onNAK != nil {
+			c.onNAK()
+		}
+		return nil, nil, errDHCPNak
+	}
+	if ack.messageType() != dhcpAck {
+		return nil, nil, fmt.Errorf("Unexpected DHCP message type %d", ack.messageType())
+	}
+	lease, err := parseLease4(ack, time.Now())
+	return lease, from, err
+}
+
+func (c *dhcpv4Client) newMessage(msgType byte, options ...dhcpv4Option) *dhcpv4Message {
+	xid := make([]byte, 4)
+	rand.Read(xid)
+
+	m := &dhcpv4Message{
+		Op:      dhcpBootRequest,
+		XID:     binary.BigEndian.Uint32(xid),
+		Flags:   dhcpFlagBroadcast,
+		CHAddr:  c.Iface.HardwareAddr,
+		Options: []dhcpv4Option{{Code: dhcpOptMessageType, Data: []byte{msgType}}},
+	}
+	m.Options = append(m.Options, options...)
+	m.Options = append(m.Options, c.options...)
+	if c.Hostname != "" {
+		m.Options = append(m.Options, dhcpv4Option{Code: dhcpOptHostname, Data: []byte(c.Hostname)})
+	}
+	if len(c.params) > 0 {
+		m.Options = append(m.Options, dhcpv4Option{Code: byte(layers.DHCPOptParamsRequest), Data: c.params})
+	}
+	return m
+}
+
+// packetConn is an IPv4 packet socket bound to an interface
+type packetConn struct {
+	iface *net.Interface
+	file  *os.File
+}
+
+// openPacketConn opens a packet socket on iface in namespace ns
+func openPacketConn(iface *net.Interface, ns *Namespace) (*packetConn, error) {
+	var fd int
+	err := ns.Do(func() error {
+		var err error
+		fd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_IP)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_IP), Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &packetConn{iface: iface, file: os.NewFile(uintptr(fd), "dhcp-"+iface.Name)}, nil
+}
+
+func (c *packetConn) Close() error {
+	return c.file.Close()
+}
+
+// exchange sends m to the peer to or broadcasts it if to is nil and
+// retransmits it until a reply is received, ctx is cancelled or deadline
+// passed. A zero deadline retransmits until a reply is received. The reply
+// is returned with the hardware address it was sent from.
+func (c *packetConn) exchange(ctx context.Context, m *dhcpv4Message, to *dhcpv4Peer, deadline time.Time) (*dhcpv4Message, net.HardwareAddr, error) {
+
+	stop := context.AfterFunc(ctx, func() { c.file.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	payload := m.marshal()
+	if len(payload) < dhcpMinMessageLength {
+		payload = append(payload, make([]byte, dhcpMinMessageLength-len(payload))...)
+	}
+	frame := newFrame(c.iface.HardwareAddr, payload)
+	if to != nil {
+		frame = newUnicastFrame(c.iface.HardwareAddr, to, payload)
+	}
+	b := make([]byte, 1500)
+	timeout := dhcpv4RetransmitTimeout
+	for {
+		if _, err := c.file.Write(frame); err != nil {
+			return nil, nil, err
+		}
+
+		wait := time.Now().Add(timeout)
+		if !deadline.IsZero() && deadline.Before(wait) {
+			wait = deadline
+		}
+		c.file.SetReadDeadline(wait)
+		for {
+			n, err := c.file.Read(b)
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			if err != nil {
+				break
+			}
+			if r := parseFrame(b[:n]); r != nil && r.Op == dhcpBootReply && r.XID == m.XID {
+				return r, append(net.HardwareAddr{}, b[6:12]...), nil
+			}
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, nil, errors.New("DHCP request timed out")
+		}
+		if timeout *= 2; timeout > dhcpv4MaxRetransmitTimeout {
+			timeout = dhcpv4MaxRetransmitTimeout
+		}
+	}
+}
+
+// newFrame wraps a DHCP message into an Ethernet broadcast frame from mac
+func newFrame(mac net.HardwareAddr, payload []byte) []byte {
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	return newUnicastFrame(mac, &dhcpv4Peer{MAC: broadcast, IP: net.IPv4bcast}, payload)
+}
+
+// newUnicastFrame wraps a DHCP message into an Ethernet frame from mac to
+// the peer to
+func newUnicastFrame(mac net.HardwareAddr, to *dhcpv4Peer, payload []byte) []byte {
+	frame := make([]byte, 42, 42+len(payload))
+	copy(frame[0:6], to.MAC)
+	copy(frame[6:12], mac)
+	binary.BigEndian.PutUint16(frame[12:14], unix.ETH_P_IP)
+
+	ip := frame[14:34]
+	ip[0] = 0x45 // IPv4, 20 byte header
+	binary.BigEndian.PutUint16(ip[2:4], uint16(28+len(payload)))
+	ip[8] = 64 // TTL
+	ip[9] = unix.IPPROTO_UDP
+	copy(ip[12:16], to.From.To4())
+	copy(ip[16:20], to.IP.To4())
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+
+	udp := frame[34:42]
+	binary.BigEndian.PutUint16(udp[0:2], dhcpClientPort)
+	binary.BigEndian.PutUint16(udp[2:4], dhcpServerPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	return append(frame, payload...)
+}
+
+// parseFrame returns the DHCP message of an Ethernet frame sent to the DHCP
+// client port or nil
+func parseFrame(frame []byte) *dhcpv4Message {
+	if len(frame) < 14 || binary.BigEndian.Uint16(frame[12:14]) != unix.ETH_P_IP {
+		return nil
+	}
+	ip := frame[14:]
+	if len(ip) < 20 || ip[0]>>4 != 4 || ip[9] != unix.IPPROTO_UDP {
+		return nil
+	}
+	ihl := int(ip[0]&0x0f) * 4
+	if len(ip) < ihl+8 {
+		return nil
+	}
+	udp := ip[ihl:]
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if binary.BigEndian.Uint16(udp[2:4]) != dhcpClientPort || length < 8 || length > len(udp) {
+		return nil
+	}
+	m, err := parseDHCPv4Message(append([]byte{}, udp[8:length]...))
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// checksum computes the Internet checksum of b (RFC 1071)
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,308 @@
+package dhcpmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/gopacket/layers"
+	"github.com/kramergroup/dhcpmanager/internal/dhcptest"
+)
+
+func TestDHCPv4Message(t *testing.T) {
+	mac, _ := net.ParseMAC("56:6a:e2:0b:01:8d")
+	m := &dhcpv4Message{
+		Op:     dhcpBootReply,
+		XID:    0x12345678,
+		Flags:  dhcpFlagBroadcast,
+		YIAddr: net.ParseIP("192.168.1.100"),
+		CHAddr: mac,
+		Options: []dhcpv4Option{
+			{Code: dhcpOptMessageType, Data: []byte{dhcpAck}},
+			{Code: dhcpOptServerID, Data: []byte{192, 168, 1, 1}},
+		},
+	}
+
+	frame := newFrame(mac, m.marshal())
+	if checksum(frame[14:34]) != 0 {
+		t.Error("Invalid IPv4 header checksum")
+	}
+	// Replies are sent to the client port
+	frame[34], frame[35], frame[36], frame[37] = frame[36], frame[37], frame[34], frame[35]
+
+	r := parseFrame(frame)
+	if r == nil {
+		t.Fatal("Expected message in frame")
+	}
+	if r.Op != m.Op || r.XID != m.XID || r.Flags != m.Flags {
+		t.Errorf("Expected header %d/%x/%x got %d/%x/%x", m.Op, m.XID, m.Flags, r.Op, r.XID, r.Flags)
+	}
+	if !r.YIAddr.Equal(m.YIAddr) || !bytes.Equal(r.CHAddr, mac) {
+		t.Errorf("Expected %s for %s got %s for %s", m.YIAddr, mac, r.YIAddr, r.CHAddr)
+	}
+	if r.messageType() != dhcpAck {
+		t.Errorf("Expected message type %d got %d", dhcpAck, r.messageType())
+	}
+	if !bytes.Equal(r.option(dhcpOptServerID), []byte{192, 168, 1, 1}) {
+		t.Errorf("Expected server identifier got %v", r.option(dhcpOptServerID))
+	}
+
+	// Frames sent to the server port are ignored
+	if parseFrame(newFrame(mac, m.marshal())) != nil {
+		t.Error("Expected no message in frame to server port")
+	}
+	if _, err := parseDHCPv4Message(m.marshal()[:100]); err == nil {
+		t.Error("Expected error for truncated message")
+	}
+}
+
+func TestDHCPv4UnicastFrame(t *testing.T) {
+	mac, _ := net.ParseMAC("56:6a:e2:0b:01:8d")
+	server, _ := net.ParseMAC("30:ba:33:c2:e3:c2")
+	m := &dhcpv4Message{Op: dhcpBootRequest, XID: 0x12345678, CIAddr: net.ParseIP("192.168.1.100"), CHAddr: mac}
+
+	// Renewals are sent from the leased IP to the server identifier
+	to := &dhcpv4Peer{MAC: server, IP: net.ParseIP("192.168.1.1"), From: m.CIAddr}
+	frame := newUnicastFrame(mac, to, m.marshal())
+	if !bytes.Equal(frame[0:6], server) || !bytes.Equal(frame[6:12], mac) {
+		t.Errorf("Expected frame from %s to %s got %v", mac, server, frame[0:12])
+	}
+	if !net.IP(frame[26:30]).Equal(to.From) || !net.IP(frame[30:34]).Equal(to.IP) {
+		t.Errorf("Expected packet from %s to %s got %s to %s", to.From, to.IP, net.IP(frame[26:30]), net.IP(frame[30:34]))
+	}
+	if checksum(frame[14:34]) != 0 {
+		t.Error("Invalid IPv4 header checksum")
+	}
+
+	frame = newFrame(mac, m.marshal())
+	if !bytes.Equal(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) || !net.IP(frame[30:34]).Equal(net.IPv4bcast) {
+		t.Errorf("Expected broadcast frame got %v", frame[0:34])
+	}
+}
+
+func TestParseLease4(t *testing.T) {
+	now := time.Now()
+	m := &dhcpv4Message{
+		YIAddr: net.ParseIP("192.168.1.100"),
+		Options: []dhcpv4Option{
+			{Code: dhcpOptMessageType, Data: []byte{dhcpAck}},
+			{Code: dhcpOptServerID, Data: []byte{192, 168, 1, 1}},
+			{Code: dhcpOptSubnetMask, Data: []byte{255, 255, 255, 0}},
+			{Code: dhcpOptRouter, Data: []byte{192, 168, 1, 1}},
+			{Code: dhcpOptDNS, Data: []byte{192, 168, 1, 2, 192, 168, 1, 3}},
+			{Code: dhcpOptDomainName, Data: []byte("example.com")},
+			{Code: dhcpOptLeaseTime, Data: []byte{0, 0, 0x0e, 0x10}},
+			{Code: 42, Data: []byte{192, 168, 1, 4}},
+		},
+	}
+
+	lease, err := parseLease4(m, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lease.FixedAddress.Equal(m.YIAddr) || !lease.ServerID.Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("Unexpected lease %s from %s", lease.FixedAddress, lease.ServerID)
+	}
+	if lease.Netmask.String() != "ffffff00" || len(lease.Router) != 1 || len(lease.DNS) != 2 {
+		t.Errorf("Unexpected network configuration %s %v %v", lease.Netmask, lease.Router, lease.DNS)
+	}
+	if lease.DomainName != "example.com" {
+		t.Errorf("Expected domain example.com got %s", lease.DomainName)
+	}
+	if !lease.Expire.Equal(now.Add(time.Hour)) || !lease.Renew.Equal(now.Add(30*time.Minute)) {
+		t.Errorf("Unexpected lease times %s %s", lease.Renew, lease.Expire)
+	}
+	if config := NewNetworkConfig(lease); len(config.NTP) != 1 {
+		t.Errorf("Expected NTP server in other options got %v", config.NTP)
+	}
+
+	m.Options = m.Options[:2]
+	if _, err := parseLease4(m, now); err == nil {
+		t.Error("Expected error for acknowledgement without lease time")
+	}
+}
+
+// serverConn exchanges the messages of a dhcpv4Client with a dhcptest.Server
+// and records the peers of the requests, which are nil for broadcasts
+type serverConn struct {
+	server *dhcptest.Server
+	mac    net.HardwareAddr
+
+	mu    sync.Mutex
+	peers []*dhcpv4Peer
+}
+
+func (c *serverConn) exchange(ctx context.Context, m *dhcpv4Message, to *dhcpv4Peer, deadline time.Time) (*dhcpv4Message, net.HardwareAddr, error) {
+	c.mu.Lock()
+	c.peers = append(c.peers, to)
+	c.mu.Unlock()
+
+	key := m.CHAddr.String()
+	if id := m.option(dhcpOptClientID); id != nil {
+		key = string(id)
+	}
+	response, lease := c.server.Respond(key)
+	wait := response.Delay
+	if response.Ignore {
+		// The request is retransmitted without reply until the deadline
+		if deadline.IsZero() {
+			<-ctx.Done()
+			return nil, nil, ctx.Err()
+		}
+		wait = time.Until(deadline)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-time.After(wait):
+	}
+	if response.Ignore {
+		return nil, nil, errors.New("DHCP request timed out")
+	}
+
+	reply := &dhcpv4Message{Op: dhcpBootReply, XID: m.XID, CHAddr: m.CHAddr}
+	if response.NAK {
+		reply.Options = []dhcpv4Option{{Code: dhcpOptMessageType, Data: []byte{dhcpNak}}}
+		return reply, c.mac, nil
+	}
+	msgType := dhcpAck
+	if m.messageType() == dhcpDiscover {
+		msgType = dhcpOffer
+	}
+	leaseTime := make([]byte, 4)
+	binary.BigEndian.PutUint32(leaseTime, uint32(lease.Expire.Sub(lease.Bound)/time.Second))
+	reply.YIAddr = lease.FixedAddress
+	reply.Options = []dhcpv4Option{
+		{Code: dhcpOptMessageType, Data: []byte{msgType}},
+		{Code: dhcpOptServerID, Data: lease.ServerID.To4()},
+		{Code: dhcpOptSubnetMask, Data: lease.Netmask},
+		{Code: dhcpOptLeaseTime, Data: leaseTime},
+	}
+	return reply, c.mac, nil
+}
+
+func (c *serverConn) Close() error {
+	return nil
+}
+
+// sent returns the peers of the requests sent since the first n requests
+func (c *serverConn) sent(n int) []*dhcpv4Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*dhcpv4Peer{}, c.peers[n:]...)
+}
+
+func newServerConn(leaseTime time.Duration) *serverConn {
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	mac, _ := net.ParseMAC("30:ba:33:c2:e3:c2")
+	return &serverConn{server: dhcptest.NewServer(*network, leaseTime), mac: mac}
+}
+
+func TestDHCPv4ClientObtain(t *testing.T) {
+	conn := newServerConn(time.Hour)
+	leases := make(chan *dhclient.Lease, 1)
+	client := &dhcpv4Client{
+		Iface:   newFakeInterface("vf-a", "56:6a:e2:0b:01:8d"),
+		OnBound: func(lease *dhclient.Lease) { leases <- lease },
+		open:    func() (dhcpv4Conn, error) { return conn, nil },
+	}
+	client.AddOption(layers.DHCPOptClientID, []byte("web"))
+	client.Start()
+	defer client.Stop()
+
+	select {
+	case lease := <-leases:
+		if !lease.FixedAddress.Equal(conn.server.Binding("web")) || !lease.ServerID.Equal(net.ParseIP("192.168.1.1")) {
+			t.Errorf("Expected lease of %s bound to the client identifier got %s", conn.server.Binding("web"), lease.FixedAddress)
+		}
+		if client.Lease() != lease {
+			t.Error("Expected client to keep the lease")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for lease")
+	}
+	// Leases are obtained with broadcasts
+	for _, to := range conn.sent(0) {
+		if to != nil {
+			t.Errorf("Expected broadcast got request to %s", to.IP)
+		}
+	}
+}
+
+func TestDHCPv4ClientRenew(t *testing.T) {
+	conn := newServerConn(time.Hour)
+	client := &dhcpv4Client{Iface: newFakeInterface("vf-a", "56:6a:e2:0b:01:8d")}
+	naks := 0
+	client.OnNAK(func() { naks++ })
+	ctx := context.Background()
+
+	lease, server, err := client.obtain(ctx, conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server, conn.mac) {
+		t.Errorf("Expected lease from %s got %s", conn.mac, server)
+	}
+
+	// Before the rebinding time leases are renewed with the issuing server
+	n := len(conn.sent(0))
+	renewed, _, err := client.extend(ctx, conn, lease, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed.FixedAddress.Equal(lease.FixedAddress) {
+		t.Errorf("Expected renewed lease of %s got %s", lease.FixedAddress, renewed.FixedAddress)
+	}
+	if sent := conn.sent(n); len(sent) != 1 || sent[0] == nil || !sent[0].IP.Equal(lease.ServerID) ||
+		!bytes.Equal(sent[0].MAC, conn.mac) || !sent[0].From.Equal(lease.FixedAddress) {
+		t.Errorf("Expected renewal unicast to %s got %v", lease.ServerID, sent)
+	}
+
+	// Renewals without reply are broadcast from the rebinding time
+	conn.server.Script(dhcptest.Response{Ignore: true})
+	lease.Rebind = time.Now().Add(50 * time.Millisecond)
+	n = len(conn.sent(0))
+	if renewed, _, err = client.extend(ctx, conn, lease, server); err != nil {
+		t.Fatal(err)
+	}
+	if sent := conn.sent(n); len(sent) != 2 || sent[0] == nil || sent[1] != nil {
+		t.Errorf("Expected unicast renewal and broadcast rebinding got %v", sent)
+	}
+	if !renewed.FixedAddress.Equal(lease.FixedAddress) {
+		t.Errorf("Expected rebound lease of %s got %s", lease.FixedAddress, renewed.FixedAddress)
+	}
+
+	// Leases past the rebinding time are only extended with broadcasts
+	lease.Rebind = time.Now().Add(-time.Second)
+	n = len(conn.sent(0))
+	if _, _, err = client.extend(ctx, conn, lease, server); err != nil {
+		t.Fatal(err)
+	}
+	if sent := conn.sent(n); len(sent) != 1 || sent[0] != nil {
+		t.Errorf("Expected broadcast rebinding got %v", sent)
+	}
+
+	// Rebinding gives up when the lease expires
+	conn.server.Script(dhcptest.Response{Ignore: true})
+	lease.Expire = time.Now().Add(50 * time.Millisecond)
+	if _, _, err = client.extend(ctx, conn, lease, server); err == nil {
+		t.Error("Expected expired lease not to be extended")
+	}
+
+	// Rejected renewals are not rebound
+	conn.server.Script(dhcptest.Response{NAK: true})
+	lease.Rebind, lease.Expire = time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)
+	n = len(conn.sent(0))
+	if _, _, err = client.extend(ctx, conn, lease, server); err == nil || naks != 1 {
+		t.Errorf("Expected rejected renewal got %v and %d NAKs", err, naks)
+	}
+	if sent := conn.sent(n); len(sent) != 1 {
+		t.Errorf("Expected no rebinding after rejection got %v", sent)
+	}
+}
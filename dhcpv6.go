@@ -0,0 +1,590 @@
+package dhcpmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lease6 is a DHCPv6 lease of a non-temporary address (IA_NA)
+type Lease6 struct {
+	Address           net.IP
+	ServerID          []byte
+	IAID              uint32
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+	Bound             time.Time
+	Renew             time.Time
+	Rebind            time.Time
+	Expire            time.Time
+}
+
+// DHCPv6 message types (RFC 8415, section 7.3)
+const (
+	dhcpv6Solicit   byte = 1
+	dhcpv6Advertise byte = 2
+	dhcpv6Request   byte = 3
+	dhcpv6Renew     byte = 5
+	dhcpv6Rebind    byte = 6
+	dhcpv6Reply     byte = 7
+	dhcpv6Release   byte = 8
+	dhcpv6Decline   byte = 9
+)
+
+// DHCPv6 options (RFC 8415, section 21 and RFC 4704)
+const (
+	dhcpv6OptClientID    uint16 = 1
+	dhcpv6OptServerID    uint16 = 2
+	dhcpv6OptIANA        uint16 = 3
+	dhcpv6OptIAAddr      uint16 = 5
+	dhcpv6OptElapsedTime uint16 = 8
+	dhcpv6OptStatusCode  uint16 = 13
+	dhcpv6OptClientFQDN  uint16 = 39
+)
+
+const (
+	dhcpv6ClientPort = 546
+	dhcpv6ServerPort = 547
+
+	// dhcpv6RetransmitTimeout is the initial retransmission timeout of
+	// requests. It doubles with every retransmission up to
+	// dhcpv6MaxRetransmitTimeout.
+	dhcpv6RetransmitTimeout    = time.Second
+	dhcpv6MaxRetransmitTimeout = 30 * time.Second
+
+	// dhcpv6LinkLocalTimeout limits the time to wait for the link-local
+	// address of a new device to become usable
+	dhcpv6LinkLocalTimeout = 5 * time.Second
+)
+
+// dhcpv6Servers is the All_DHCP_Relay_Agents_and_Servers multicast address
+var dhcpv6Servers = net.ParseIP("ff02::1:2")
+
+// dhcpv6Option is a single DHCPv6 option
+type dhcpv6Option struct {
+	Code uint16
+	Data []byte
+}
+
+// dhcpv6Message is a DHCPv6 client/server message
+type dhcpv6Message struct {
+	Type    byte
+	XID     uint32
+	Options []dhcpv6Option
+}
+
+func (m *dhcpv6Message) marshal() []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, m.XID&0xffffff)
+	b[0] = m.Type
+	return append(b, marshalDHCPv6Options(m.Options)...)
+}
+
+// option returns the data of the first option with code or nil
+func (m *dhcpv6Message) option(code uint16) []byte {
+	for _, o := range m.Options {
+		if o.Code == code {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+func parseDHCPv6Message(b []byte) (*dhcpv6Message, error) {
+	if len(b) < 4 {
+		return nil, errors.New("DHCPv6 message too short")
+	}
+	options, err := parseDHCPv6Options(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	return &dhcpv6Message{
+		Type:    b[0],
+		XID:     binary.BigEndian.Uint32(b[:4]) & 0xffffff,
+		Options: options,
+	}, nil
+}
+
+func marshalDHCPv6Options(options []dhcpv6Option) []byte {
+	b := make([]byte, 0)
+	for _, o := range options {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint16(header[0:2], o.Code)
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(o.Data)))
+		b = append(append(b, header...), o.Data...)
+	}
+	return b
+}
+
+func parseDHCPv6Options(b []byte) ([]dhcpv6Option, error) {
+	options := make([]dhcpv6Option, 0)
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("DHCPv6 option truncated")
+		}
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+length {
+			return nil, errors.New("DHCPv6 option truncated")
+		}
+		options = append(options, dhcpv6Option{
+			Code: binary.BigEndian.Uint16(b[0:2]),
+			Data: b[4 : 4+length],
+		})
+		b = b[4+length:]
+	}
+	return options, nil
+}
+
+// newDUID returns the link-layer address DUID (DUID-LL) of mac
+func newDUID(mac net.HardwareAddr) []byte {
+	duid := []byte{0, 3, 0, 1}
+	return append(duid, mac...)
+}
+
+// newIANA encodes an IA_NA option for iaid. The address of lease is included
+// if lease is not nil.
+func newIANA(iaid uint32, lease *Lease6) dhcpv6Option {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:4], iaid)
+	if lease != nil {
+		addr := make([]byte, 24)
+		copy(addr[0:16], lease.Address.To16())
+		binary.BigEndian.PutUint32(addr[16:20], uint32(lease.PreferredLifetime/time.Second))
+		binary.BigEndian.PutUint32(addr[20:24], uint32(lease.ValidLifetime/time.Second))
+		data = append(data, marshalDHCPv6Options([]dhcpv6Option{{Code: dhcpv6OptIAAddr, Data: addr}})...)
+	}
+	return dhcpv6Option{Code: dhcpv6OptIANA, Data: data}
+}
+
+// newClientFQDN encodes a Client FQDN option asking the server to update the
+// DNS records of name (RFC 4704). Unqualified names are completed by the
+// server.
+func newClientFQDN(name string, qualified bool) dhcpv6Option {
+	data := []byte{fqdnFlagServerUpdate} // server performs the AAAA update
+	return dhcpv6Option{Code: dhcpv6OptClientFQDN, Data: append(data, encodeDomainName(name, qualified)...)}
+}
+
+func splitLabels(name string) []string {
+	labels := make([]string, 0)
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			if i > start && i-start < 64 {
+				labels = append(labels, name[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return labels
+}
+
+// statusError returns an error if data is a status code option with a
+// status other than success
+func statusError(data []byte) error {
+	if len(data) < 2 || binary.BigEndian.Uint16(data[0:2]) == 0 {
+		return nil
+	}
+	return fmt.Errorf("DHCPv6 status %d: %s", binary.BigEndian.Uint16(data[0:2]), string(data[2:]))
+}
+
+// parseLease6 extracts the lease of IA_NA iaid from a reply or advertise
+// message received at now
+func parseLease6(m *dhcpv6Message, iaid uint32, now time.Time) (*Lease6, error) {
+
+	if err := statusError(m.option(dhcpv6OptStatusCode)); err != nil {
+		return nil, err
+	}
+
+	for _, o := range m.Options {
+		if o.Code != dhcpv6OptIANA || len(o.Data) < 12 || binary.BigEndian.Uint32(o.Data[0:4]) != iaid {
+			continue
+		}
+		t1 := time.Duration(binary.BigEndian.Uint32(o.Data[4:8])) * time.Second
+		t2 := time.Duration(binary.BigEndian.Uint32(o.Data[8:12])) * time.Second
+		options, err := parseDHCPv6Options(o.Data[12:])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, io := range options {
+			if io.Code == dhcpv6OptStatusCode {
+				if err := statusError(io.Data); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, io := range options {
+			if io.Code != dhcpv6OptIAAddr || len(io.Data) < 24 {
+				continue
+			}
+			lease := &Lease6{
+				Address:           net.IP(append([]byte{}, io.Data[0:16]...)),
+				ServerID:          append([]byte{}, m.option(dhcpv6OptServerID)...),
+				IAID:              iaid,
+				PreferredLifetime: time.Duration(binary.BigEndian.Uint32(io.Data[16:20])) * time.Second,
+				ValidLifetime:     time.Duration(binary.BigEndian.Uint32(io.Data[20:24])) * time.Second,
+				Bound:             now,
+			}
+			// Servers may leave T1 and T2 to the client (RFC 8415, section 21.4)
+			if t1 == 0 {
+				t1 = lease.PreferredLifetime / 2
+			}
+			if t2 == 0 {
+				t2 = lease.PreferredLifetime * 4 / 5
+			}
+			lease.Renew = now.Add(t1)
+			lease.Rebind = now.Add(t2)
+			lease.Expire = now.Add(lease.ValidLifetime)
+			return lease, nil
+		}
+	}
+	return nil, errors.New("No address assigned")
+}
+
+// dhcpv6Client obtains and renews the lease of a single IA_NA on an
+// interface. Several clients can share an interface if they use different
+// IAIDs.
+type dhcpv6Client struct {
+	Iface    *net.Interface
+	DUID     []byte
+	IAID     uint32
+	Hostname string
+	FQDN     string
+	OnBound  func(*Lease6)
+
+	ns     *Namespace
+	mu     sync.Mutex
+	lease  *Lease6
+	conn   *dhcpv6Conn
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start starts obtaining a lease in the background
+func (c *dhcpv6Client) Start() error {
+	conn, err := acquireDHCPv6Conn(c.Iface, c.ns)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.conn = conn
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go c.run(ctx)
+	return nil
+}
+
+// Stop stops the client. The lease is kept on the server until it expires.
+func (c *dhcpv6Client) Stop() {
+	c.cancel()
+	<-c.done
+	c.conn.release()
+}
+
+// Lease returns the current lease or nil
+func (c *dhcpv6Client) Lease() *Lease6 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lease
+}
+
+// Release sends a release message for lease without waiting for the reply.
+// The client must be stopped.
+func (c *dhcpv6Client) Release(lease *Lease6) error {
+	return c.notify(dhcpv6Release, lease)
+}
+
+// Decline sends a decline message for lease without waiting for the reply.
+// The client must be stopped.
+func (c *dhcpv6Client) Decline(lease *Lease6) error {
+	return c.notify(dhcpv6Decline, lease)
+}
+
+// notify sends a release or decline message for lease without waiting for
+// the reply. The client must be stopped.
+func (c *dhcpv6Client) notify(msgType byte, lease *Lease6) error {
+	conn, err := acquireDHCPv6Conn(c.Iface, c.ns)
+	if err != nil {
+		return err
+	}
+	defer conn.release()
+
+	m := c.newMessage(msgType, lease)
+	m.Options = append(m.Options, dhcpv6Option{Code: dhcpv6OptServerID, Data: lease.ServerID})
+	return conn.send(m)
+}
+
+func (c *dhcpv6Client) newMessage(msgType byte, lease *Lease6) *dhcpv6Message {
+	xid := make([]byte, 4)
+	rand.Read(xid)
+	return &dhcpv6Message{
+		Type: msgType,
+		XID:  binary.BigEndian.Uint32(xid) & 0xffffff,
+		Options: []dhcpv6Option{
+			{Code: dhcpv6OptClientID, Data: c.DUID},
+			{Code: dhcpv6OptElapsedTime, Data: []byte{0, 0}},
+			newIANA(c.IAID, lease),
+		},
+	}
+}
+
+// clientFQDN returns the Client FQDN option with FQDN or Hostname
+func (c *dhcpv6Client) clientFQDN() dhcpv6Option {
+	if c.FQDN != "" {
+		return newClientFQDN(c.FQDN, true)
+	}
+	return newClientFQDN(c.Hostname, false)
+}
+
+// run obtains a lease and renews it until ctx is cancelled
+func (c *dhcpv6Client) run(ctx context.Context) {
+	defer close(c.done)
+
+	var lease *Lease6
+	for ctx.Err() == nil {
+		var err error
+		if lease == nil {
+			lease, err = c.solicit(ctx)
+		} else {
+			lease, err = c.extend(ctx, lease)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("DHCPv6: [%s] %s", c.Iface.Name, err.Error())
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(dhcpv6RetransmitTimeout):
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		c.lease = lease
+		c.mu.Unlock()
+		if c.OnBound != nil {
+			c.OnBound(lease)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(lease.Renew)):
+		}
+	}
+}
+
+// solicit obtains a new lease from the first server that advertises one
+func (c *dhcpv6Client) solicit(ctx context.Context) (*Lease6, error) {
+
+	solicit := c.newMessage(dhcpv6Solicit, nil)
+	solicit.Options = append(solicit.Options, c.clientFQDN())
+	advertise, err := c.conn.exchange(ctx, solicit, dhcpv6Advertise, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseLease6(advertise, c.IAID, time.Now()); err != nil {
+		return nil, err
+	}
+
+	request := c.newMessage(dhcpv6Request, nil)
+	request.Options = append(request.Options,
+		dhcpv6Option{Code: dhcpv6OptServerID, Data: advertise.option(dhcpv6OptServerID)},
+		c.clientFQDN())
+	reply, err := c.conn.exchange(ctx, request, dhcpv6Reply, time.Now().Add(dhcpv6MaxRetransmitTimeout))
+	if err != nil {
+		return nil, err
+	}
+	return parseLease6(reply, c.IAID, time.Now())
+}
+
+// extend renews lease with the server that issued it until the rebind time
+// and with any server afterwards. No lease is returned once lease expired.
+func (c *dhcpv6Client) extend(ctx context.Context, lease *Lease6) (*Lease6, error) {
+
+	if time.Now().Before(lease.Rebind) {
+		renew := c.newMessage(dhcpv6Renew, lease)
+		renew.Options = append(renew.Options, dhcpv6Option{Code: dhcpv6OptServerID, Data: lease.ServerID})
+		if reply, err := c.conn.exchange(ctx, renew, dhcpv6Reply, lease.Rebind); err == nil {
+			return parseLease6(reply, c.IAID, time.Now())
+		}
+	}
+
+	rebind := c.newMessage(dhcpv6Rebind, lease)
+	reply, err := c.conn.exchange(ctx, rebind, dhcpv6Reply, lease.Expire)
+	if err != nil {
+		return nil, fmt.Errorf("Lease for %s expired", lease.Address)
+	}
+	return parseLease6(reply, c.IAID, time.Now())
+}
+
+// dhcpv6Conn is a DHCPv6 client socket bound to the link-local address of an
+// interface. It is shared by all clients on the interface and dispatches
+// messages by transaction ID.
+type dhcpv6Conn struct {
+	iface *net.Interface
+	conn  *net.UDPConn
+
+	mu       sync.Mutex
+	refs     int
+	handlers map[uint32]chan *dhcpv6Message
+}
+
+var (
+	dhcpv6ConnsMu sync.Mutex
+	dhcpv6Conns   = make(map[string]*dhcpv6Conn)
+)
+
+// acquireDHCPv6Conn returns the socket of iface in namespace ns. The socket
+// must be released with release.
+func acquireDHCPv6Conn(iface *net.Interface, ns *Namespace) (*dhcpv6Conn, error) {
+	dhcpv6ConnsMu.Lock()
+	defer dhcpv6ConnsMu.Unlock()
+
+	if c, ok := dhcpv6Conns[iface.Name]; ok {
+		c.refs++
+		return c, nil
+	}
+
+	var conn *net.UDPConn
+	err := ns.Do(func() error {
+		addr, err := linkLocalAddress(iface)
+		if err != nil {
+			return err
+		}
+		// Zones are given by index, because names are resolved in the
+		// namespace of the calling thread
+		conn, err = net.ListenUDP("udp6", &net.UDPAddr{IP: addr, Port: dhcpv6ClientPort, Zone: strconv.Itoa(iface.Index)})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &dhcpv6Conn{
+		iface:    iface,
+		conn:     conn,
+		refs:     1,
+		handlers: make(map[uint32]chan *dhcpv6Message),
+	}
+	dhcpv6Conns[iface.Name] = c
+	go c.receive()
+	return c, nil
+}
+
+// linkLocalAddress waits until iface has a link-local IPv6 address and
+// returns it
+func linkLocalAddress(iface *net.Interface) (net.IP, error) {
+	deadline := time.Now().Add(dhcpv6LinkLocalTimeout)
+	for {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				return ipnet.IP, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("No link-local address on %s", iface.Name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (c *dhcpv6Conn) release() {
+	dhcpv6ConnsMu.Lock()
+	defer dhcpv6ConnsMu.Unlock()
+
+	c.refs--
+	if c.refs == 0 {
+		delete(dhcpv6Conns, c.iface.Name)
+		c.conn.Close()
+	}
+}
+
+// receive dispatches received messages until the socket is closed
+func (c *dhcpv6Conn) receive() {
+	b := make([]byte, 1500)
+	for {
+		n, _, err := c.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		m, err := parseDHCPv6Message(append([]byte{}, b[:n]...))
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		if ch, ok := c.handlers[m.XID]; ok {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *dhcpv6Conn) send(m *dhcpv6Message) error {
+	_, err := c.conn.WriteToUDP(m.marshal(), &net.UDPAddr{IP: dhcpv6Servers, Port: dhcpv6ServerPort, Zone: strconv.Itoa(c.iface.Index)})
+	return err
+}
+
+// exchange sends m and retransmits it until a response of responseType is
+// received, ctx is cancelled or deadline passed. A zero deadline retransmits
+// until a response is received.
+func (c *dhcpv6Conn) exchange(ctx context.Context, m *dhcpv6Message, responseType byte, deadline time.Time) (*dhcpv6Message, error) {
+
+	responses := make(chan *dhcpv6Message, 1)
+	c.mu.Lock()
+	c.handlers[m.XID] = responses
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.handlers, m.XID)
+		c.mu.Unlock()
+	}()
+
+	timeout := dhcpv6RetransmitTimeout
+	for {
+		if err := c.send(m); err != nil {
+			return nil, err
+		}
+
+		wait := timeout
+		if !deadline.IsZero() && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+		timer := time.NewTimer(wait)
+		for expired := false; !expired; {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case r := <-responses:
+				if r.Type == responseType {
+					timer.Stop()
+					return r, nil
+				}
+			case <-timer.C:
+				expired = true
+			}
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, errors.New("DHCPv6 request timed out")
+		}
+		if timeout *= 2; timeout > dhcpv6MaxRetransmitTimeout {
+			timeout = dhcpv6MaxRetransmitTimeout
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package dhcpmanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDHCPv6MessageRoundTrip(t *testing.T) {
+	mac, _ := net.ParseMAC("56:6a:e2:0b:01:8d")
+	m := &dhcpv6Message{
+		Type: dhcpv6Solicit,
+		XID:  0x123456,
+		Options: []dhcpv6Option{
+			{Code: dhcpv6OptClientID, Data: newDUID(mac)},
+			newIANA(42, nil),
+			newClientFQDN("svc.namespace", false),
+		},
+	}
+
+	b := m.marshal()
+	if b[0] != dhcpv6Solicit || b[1] != 0x12 || b[2] != 0x34 || b[3] != 0x56 {
+		t.Fatalf("Invalid header %v", b[:4])
+	}
+
+	parsed, err := parseDHCPv6Message(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Type != m.Type || parsed.XID != m.XID || len(parsed.Options) != 3 {
+		t.Fatalf("Expected %+v got %+v", m, parsed)
+	}
+	if !bytes.Equal(parsed.option(dhcpv6OptClientID), []byte{0, 3, 0, 1, 0x56, 0x6a, 0xe2, 0x0b, 0x01, 0x8d}) {
+		t.Errorf("Invalid DUID %v", parsed.option(dhcpv6OptClientID))
+	}
+	fqdn := []byte{1, 3, 's', 'v', 'c', 9, 'n', 'a', 'm', 'e', 's', 'p', 'a', 'c', 'e'}
+	if !bytes.Equal(parsed.option(dhcpv6OptClientFQDN), fqdn) {
+		t.Errorf("Expected FQDN %v got %v", fqdn, parsed.option(dhcpv6OptClientFQDN))
+	}
+
+	if _, err := parseDHCPv6Message(b[:len(b)-1]); err == nil {
+		t.Error("Expected error for truncated message")
+	}
+}
+
+func TestParseLease6(t *testing.T) {
+	now := time.Now()
+	offered := &Lease6{
+		Address:           net.ParseIP("2001:db8::100"),
+		PreferredLifetime: 3600 * time.Second,
+		ValidLifetime:     7200 * time.Second,
+	}
+	iana := newIANA(42, offered)
+	binary.BigEndian.PutUint32(iana.Data[4:8], 1000)
+	reply := &dhcpv6Message{
+		Type: dhcpv6Reply,
+		Options: []dhcpv6Option{
+			{Code: dhcpv6OptServerID, Data: []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6}},
+			newIANA(7, offered),
+			iana,
+		},
+	}
+
+	lease, err := parseLease6(reply, 42, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lease.Address.Equal(offered.Address) || lease.IAID != 42 {
+		t.Errorf("Expected address %s got %s", offered.Address, lease.Address)
+	}
+	if !lease.Renew.Equal(now.Add(1000 * time.Second)) {
+		t.Errorf("Expected renewal with T1 got %s", lease.Renew.Sub(now))
+	}
+	if !lease.Rebind.Equal(now.Add(2880 * time.Second)) {
+		t.Errorf("Expected default rebind time got %s", lease.Rebind.Sub(now))
+	}
+	if !lease.Expire.Equal(now.Add(offered.ValidLifetime)) {
+		t.Errorf("Expected expiry after valid lifetime got %s", lease.Expire.Sub(now))
+	}
+	if !bytes.Equal(lease.ServerID, reply.option(dhcpv6OptServerID)) {
+		t.Errorf("Server ID not recorded")
+	}
+
+	if _, err := parseLease6(reply, 1, now); err == nil {
+		t.Error("Expected error for unknown IAID")
+	}
+
+	reply.Options = append(reply.Options, dhcpv6Option{Code: dhcpv6OptStatusCode, Data: append([]byte{0, 2}, "NoAddrsAvail"...)})
+	if _, err := parseLease6(reply, 42, now); err == nil {
+		t.Error("Expected error for status NoAddrsAvail")
+	}
+}
@@ -0,0 +1,13 @@
+// Package dhcpmanager obtains IPs for services from DHCP servers. Allocations
+// are persisted by a StateManager and bound by a DHCPController, which
+// creates a virtual device for every allocation and keeps its leases alive.
+//
+// DHCPv4 leases of devices in the namespace of the controller are obtained
+// with go-dhclient. Devices in another Namespace use a client of this package
+// instead. go-dhclient opens its packet socket in the goroutine started by
+// Client.Start and again for every renewal, so it cannot be run inside
+// Namespace.Do, which only switches the namespace of the calling thread for
+// the duration of the call, and it provides no way to pass in a socket. The
+// client of this package opens its socket inside Namespace.Do, after which it
+// stays bound to the device on any thread.
+package dhcpmanager
@@ -0,0 +1,123 @@
+package dhcpmanager
+
+import (
+	"context"
+	"net"
+
+	"github.com/google/uuid"
+)
+
+// EventType gives information regarding the kind of change reported by an
+// AllocationEvent
+type EventType int
+
+const (
+	// EventCreated = The allocation has been created
+	EventCreated EventType = 0
+
+	// EventModified = The allocation has been modified
+	EventModified EventType = 1
+
+	// EventDeleted = The allocation has been deleted
+	EventDeleted EventType = 2
+)
+
+// AllocationEvent is a change of an allocation. Old is nil for created
+// allocations and New is nil for deleted allocations.
+type AllocationEvent struct {
+	Type EventType
+	Old  *Allocation
+	New  *Allocation
+
+	// Revision of the store at which the change happened
+	Revision int64
+}
+
+// AllocationFilter selects the allocations reported by WatchEvents
+type AllocationFilter struct {
+
+	// ID selects a single allocation. uuid.Nil selects all allocations.
+	ID uuid.UUID
+}
+
+func (f AllocationFilter) matches(id uuid.UUID) bool {
+	return f.ID == uuid.Nil || f.ID == id
+}
+
+// MACPoolEventType gives information regarding the kind of change reported
+// by a MACPoolEvent
+type MACPoolEventType int
+
+const (
+	// MACPushed = The MAC has been added to the pool
+	MACPushed MACPoolEventType = 0
+
+	// MACPopped = The MAC has been taken out of the pool
+	MACPopped MACPoolEventType = 1
+)
+
+// MACPoolEvent is a change of the MAC pool
+type MACPoolEvent struct {
+	Type MACPoolEventType
+	MAC  net.HardwareAddr
+
+	// Revision of the store at which the change happened. Stores that do
+	// not version the MAC pool report 0.
+	Revision int64
+}
+
+// watchContext returns a context that is cancelled if ctx is cancelled or
+// stopped is closed
+func watchContext(ctx context.Context, stopped <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// watchAllocations implements the callback based watch API on top of
+// WatchEvents. The returned stop function can be called more than once.
+func watchAllocations(sm StateManager, filter AllocationFilter, watcher *AllocationWatcher) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := sm.WatchEvents(ctx, filter)
+	go func() {
+		for ev := range events {
+			ev.dispatch(watcher)
+		}
+	}()
+	return cancel
+}
+
+func (ev AllocationEvent) dispatch(watcher *AllocationWatcher) {
+	switch {
+	case ev.Type == EventCreated && watcher.OnCreate != nil:
+		watcher.OnCreate(ev.New)
+	case ev.Type == EventModified && watcher.OnModify != nil:
+		watcher.OnModify(ev.New)
+	case ev.Type == EventDeleted && watcher.OnDelete != nil:
+		watcher.OnDelete(ev.Old)
+	}
+}
+
+// watchMACPool implements the callback based MAC pool watch API on top of
+// WatchMACPoolEvents. The returned stop function can be called more than once.
+func watchMACPool(sm StateManager, watcher *MACPoolWatcher) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := sm.WatchMACPoolEvents(ctx)
+	go func() {
+		for ev := range events {
+			switch {
+			case ev.Type == MACPushed && watcher.OnPush != nil:
+				watcher.OnPush(ev.MAC)
+			case ev.Type == MACPopped && watcher.OnPop != nil:
+				watcher.OnPop(ev.MAC)
+			}
+		}
+	}()
+	return cancel
+}
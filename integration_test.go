@@ -0,0 +1,495 @@
+//go:build integration
+
+package dhcpmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.etcd.io/etcd/server/v3/embed"
+	"golang.org/x/sys/unix"
+)
+
+// The integration test runs the controller and the apiserver against a DHCP
+// server in a network namespace connected to the host with a veth pair:
+//
+//	host: e2e-host (10.99.0.254) <-> dhcpmanager-e2e: e2e-srv (10.99.0.1)
+//
+// Run it as root with
+//
+//	go test -tags integration -run TestIntegration -v .
+const (
+	e2eNamespace = "dhcpmanager-e2e"
+	e2eHost      = "e2e-host"
+	e2eServer    = "e2e-srv"
+	e2eLeaseTime = 6 * time.Second
+	e2eTimeout   = 30 * time.Second
+)
+
+var e2eMACs = []string{"02:99:00:00:00:01", "02:99:00:00:00:02"}
+
+func TestIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Integration test requires root")
+	}
+
+	ns := setupE2ENetwork(t)
+	server := startTestDHCPServer(t, ns, e2eServer, e2eLeaseTime)
+	endpoint := startEtcd(t)
+	bin := buildBinaries(t)
+
+	sm, err := NewStateManager([]string{endpoint}, 5*time.Second, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Stop()
+
+	port := freePort(t)
+	api := fmt.Sprintf("http://127.0.0.1:%d", port)
+	apiserver := startProcess(t, filepath.Join(bin, "apiserver"),
+		"DHCP_ETCD="+endpoint, fmt.Sprintf("DHCP_PORT=%d", port), "DHCP_CIDRS=10.99.0.0/24")
+	defer stopProcess(t, apiserver, syscall.SIGTERM)
+	controllerEnv := []string{"DHCP_ETCD=" + endpoint, "DHCP_INTERFACE=" + e2eHost, "DHCP_IDENTITY=e2e"}
+	controller := startProcess(t, filepath.Join(bin, "controller"), controllerEnv...)
+	defer func() { stopProcess(t, controller, syscall.SIGTERM) }()
+
+	eventually(t, "apiserver listening", func() bool {
+		_, err := http.Get(api + "/v1/status")
+		return err == nil
+	})
+
+	// Register the MAC pool
+	var registered struct{ Status string }
+	apiCall(t, http.MethodPost, api+"/v1/mac", map[string][]string{"MACs": e2eMACs}, &registered)
+	if registered.Status != "success" {
+		t.Fatalf("Could not register MACs - %s", registered.Status)
+	}
+	eventually(t, "MAC pool filled", func() bool { return len(availableMACs(t, api)) == len(e2eMACs) })
+
+	// Obtain an IP
+	var obtained struct {
+		IP     string
+		ID     string
+		Status string
+	}
+	apiCall(t, http.MethodPost, api+"/v1/ip", map[string]string{"service": "web"}, &obtained)
+	if obtained.Status != "success" {
+		t.Fatalf("Could not obtain IP - %s", obtained.Status)
+	}
+	ip := net.ParseIP(obtained.IP)
+	id := uuid.MustParse(obtained.ID)
+	if ip == nil || !ip.Mask(net.CIDRMask(24, 32)).Equal(net.ParseIP("10.99.0.0")) {
+		t.Fatalf("Expected IP of 10.99.0.0/24 got %s", obtained.IP)
+	}
+
+	allocation, err := sm.Get(id)
+	if err != nil || allocation.State != Bound {
+		t.Fatalf("Expected bound allocation got %v (%v)", allocation, err)
+	}
+	mac := allocation.Interface.HardwareAddr
+	if !server.leased(mac).Equal(ip) {
+		t.Errorf("Expected lease of %s for %s got %s", ip, mac, server.leased(mac))
+	}
+	link := assertDevice(t, DeviceName(id, 0), mac)
+	if link.Attrs().Alias != DeviceAlias(allocation) {
+		t.Errorf("Expected alias %s got %s", DeviceAlias(allocation), link.Attrs().Alias)
+	}
+	if macs := availableMACs(t, api); len(macs) != len(e2eMACs)-1 || strings.EqualFold(macs[0], mac.String()) {
+		t.Errorf("Expected MAC %s to be taken from the pool %v", mac, macs)
+	}
+
+	// The lease is renewed and the renewal persisted
+	acks := server.acks(mac)
+	eventually(t, "lease renewed", func() bool {
+		renewed, err := sm.Get(id)
+		return err == nil && server.acks(mac) > acks && renewed.Lease.Renew.After(allocation.Lease.Renew)
+	})
+
+	// A stopped controller removes its devices and binds the allocation
+	// again on restart
+	stopProcess(t, controller, syscall.SIGTERM)
+	if stopped, err := sm.Get(id); err != nil || stopped.State != Stopped {
+		t.Errorf("Expected stopped allocation got %v (%v)", stopped, err)
+	}
+	assertNoDevice(t, DeviceName(id, 0))
+	controller = startProcess(t, filepath.Join(bin, "controller"), controllerEnv...)
+	eventually(t, "allocation bound after restart", func() bool {
+		restarted, err := sm.Get(id)
+		return err == nil && restarted.State == Bound && restarted.Lease.FixedAddress.Equal(ip)
+	})
+	link = assertDevice(t, DeviceName(id, 0), mac)
+
+	// The device of a killed controller is adopted by the next controller
+	stopProcess(t, controller, syscall.SIGKILL)
+	acks = server.acks(mac)
+	controller = startProcess(t, filepath.Join(bin, "controller"), controllerEnv...)
+	eventually(t, "allocation bound after crash", func() bool {
+		recovered, err := sm.Get(id)
+		return err == nil && recovered.State == Bound && server.acks(mac) > acks
+	})
+	if adopted := assertDevice(t, DeviceName(id, 0), mac); adopted.Attrs().Index != link.Attrs().Index {
+		t.Errorf("Expected device %s to be adopted", DeviceName(id, 0))
+	}
+
+	// Returning the IP releases the lease, the device and the MAC
+	var returned struct{ Status string }
+	apiCall(t, http.MethodDelete, api+"/v1/ip", map[string]string{"ip": ip.String()}, &returned)
+	if returned.Status != "success" {
+		t.Fatalf("Could not return IP - %s", returned.Status)
+	}
+	eventually(t, "allocation released", func() bool {
+		_, err := sm.Get(id)
+		return err == ErrNotFound && server.isReleased(ip) && len(availableMACs(t, api)) == len(e2eMACs)
+	})
+	assertNoDevice(t, DeviceName(id, 0))
+}
+
+// setupE2ENetwork creates the namespace of the DHCP server and connects it
+// to the host with a veth pair
+func setupE2ENetwork(t *testing.T) *Namespace {
+	t.Helper()
+
+	ns, err := OpenNamespace(e2eNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ns.Close()
+		netns.DeleteNamed(e2eNamespace)
+	})
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: e2eHost}, PeerName: e2eServer}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { netlink.LinkDel(veth) })
+
+	peer, err := netlink.LinkByName(e2eServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns.handle)); err != nil {
+		t.Fatal(err)
+	}
+	configure := func(h *netlink.Handle, name, cidr string) {
+		link, err := h.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, _ := netlink.ParseAddr(cidr)
+		if err := h.AddrAdd(link, addr); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.LinkSetUp(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configure(ns.Handle(), e2eServer, "10.99.0.1/24")
+	configure(&netlink.Handle{}, e2eHost, "10.99.0.254/24")
+	return ns
+}
+
+// startEtcd starts an embedded etcd and returns its client endpoint
+func startEtcd(t *testing.T) string {
+	t.Helper()
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	client, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	peer, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*client}, []url.URL{*client}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peer}, []url.URL{*peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(e2eTimeout):
+		t.Fatal("etcd not ready")
+	}
+	return client.Host
+}
+
+// buildBinaries builds the controller and the apiserver
+func buildBinaries(t *testing.T) string {
+	t.Helper()
+
+	bin := t.TempDir()
+	for _, cmd := range []string{"controller", "apiserver"} {
+		build := exec.Command("go", "build", "-o", filepath.Join(bin, cmd), "./cmd/"+cmd)
+		if out, err := build.CombinedOutput(); err != nil {
+			t.Fatalf("Could not build %s - %s\n%s", cmd, err.Error(), out)
+		}
+	}
+	return bin
+}
+
+func startProcess(t *testing.T, binary string, env ...string) *exec.Cmd {
+	t.Helper()
+
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+// stopProcess sends sig to a process and waits for it to terminate
+func stopProcess(t *testing.T, cmd *exec.Cmd, sig syscall.Signal) {
+	t.Helper()
+
+	if cmd.ProcessState != nil {
+		return
+	}
+	cmd.Process.Signal(sig)
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(e2eTimeout):
+		cmd.Process.Kill()
+		<-done
+		t.Errorf("Process %s did not terminate", cmd.Path)
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func apiCall(t *testing.T, method, url string, request, response interface{}) {
+	t.Helper()
+
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatalf("Invalid response from %s %s - %s", method, url, err.Error())
+	}
+}
+
+func availableMACs(t *testing.T, api string) []string {
+	var status struct{ AvailableMACs []string }
+	apiCall(t, http.MethodGet, api+"/v1/status", nil, &status)
+	return status.AvailableMACs
+}
+
+// eventually polls condition until it holds or the test times out
+func eventually(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(e2eTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", description)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// assertDevice checks that the device name exists on the host with mac
+func assertDevice(t *testing.T, name string, mac net.HardwareAddr) netlink.Link {
+	t.Helper()
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatalf("Expected device %s - %s", name, err.Error())
+	}
+	if !bytes.Equal(link.Attrs().HardwareAddr, mac) {
+		t.Errorf("Expected MAC %s of %s got %s", mac, name, link.Attrs().HardwareAddr)
+	}
+	return link
+}
+
+func assertNoDevice(t *testing.T, name string) {
+	t.Helper()
+
+	eventually(t, "device "+name+" removed", func() bool {
+		_, err := netlink.LinkByName(name)
+		return err != nil
+	})
+}
+
+// testDHCPServer is a minimal DHCP server leasing IPs of 10.99.0.0/24 by MAC
+// address. Replies are broadcast, because the leased IPs are not assigned to
+// the devices.
+type testDHCPServer struct {
+	conn      net.PacketConn
+	leaseTime time.Duration
+
+	mu       sync.Mutex
+	next     byte
+	bindings map[string]net.IP
+	acked    map[string]int
+	released map[string]bool
+}
+
+var (
+	testServerIP = net.IPv4(10, 99, 0, 1).To4()
+	testNetmask  = net.CIDRMask(24, 32)
+)
+
+func startTestDHCPServer(t *testing.T, ns *Namespace, iface string, leaseTime time.Duration) *testDHCPServer {
+	t.Helper()
+
+	s := &testDHCPServer{
+		leaseTime: leaseTime,
+		next:      100,
+		bindings:  make(map[string]net.IP),
+		acked:     make(map[string]int),
+		released:  make(map[string]bool),
+	}
+	err := ns.Do(func() error {
+		lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) { err = unix.BindToDevice(int(fd), iface) })
+			return err
+		}}
+		var err error
+		s.conn, err = lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", dhcpServerPort))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *testDHCPServer) serve() {
+	b := make([]byte, 1500)
+	for {
+		n, _, err := s.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		m, err := parseDHCPv4Message(append([]byte{}, b[:n]...))
+		if err != nil || m.Op != dhcpBootRequest {
+			continue
+		}
+		if reply := s.handle(m); reply != nil {
+			payload := reply.marshal()
+			if len(payload) < dhcpMinMessageLength {
+				payload = append(payload, make([]byte, dhcpMinMessageLength-len(payload))...)
+			}
+			s.conn.WriteTo(payload, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort})
+		}
+	}
+}
+
+func (s *testDHCPServer) handle(m *dhcpv4Message) *dhcpv4Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mac := m.CHAddr.String()
+	switch m.messageType() {
+	case dhcpDiscover:
+		return s.reply(m, dhcpOffer, s.lease(mac))
+	case dhcpRequest:
+		requested := net.IP(m.option(dhcpOptRequestedIP))
+		if requested == nil {
+			requested = m.CIAddr
+		}
+		ip := s.lease(mac)
+		if !requested.Equal(ip) {
+			return s.reply(m, dhcpNak, nil)
+		}
+		s.acked[mac]++
+		return s.reply(m, dhcpAck, ip)
+	case dhcpRelease:
+		delete(s.bindings, mac)
+		s.released[m.CIAddr.String()] = true
+	}
+	return nil
+}
+
+// lease returns the IP bound to mac. The server must be locked.
+func (s *testDHCPServer) lease(mac string) net.IP {
+	if ip, ok := s.bindings[mac]; ok {
+		return ip
+	}
+	ip := net.IPv4(10, 99, 0, s.next).To4()
+	s.next++
+	s.bindings[mac] = ip
+	return ip
+}
+
+func (s *testDHCPServer) reply(m *dhcpv4Message, msgType byte, ip net.IP) *dhcpv4Message {
+	leaseTime := make([]byte, 4)
+	leaseTime[0], leaseTime[1], leaseTime[2], leaseTime[3] = 0, 0, 0, byte(s.leaseTime/time.Second)
+	reply := &dhcpv4Message{
+		Op:     dhcpBootReply,
+		XID:    m.XID,
+		Flags:  m.Flags,
+		YIAddr: ip,
+		SIAddr: testServerIP,
+		CHAddr: m.CHAddr,
+		Options: []dhcpv4Option{
+			{Code: dhcpOptMessageType, Data: []byte{msgType}},
+			{Code: dhcpOptServerID, Data: testServerIP},
+		},
+	}
+	if ip != nil {
+		reply.Options = append(reply.Options,
+			dhcpv4Option{Code: dhcpOptLeaseTime, Data: leaseTime},
+			dhcpv4Option{Code: dhcpOptSubnetMask, Data: testNetmask},
+			dhcpv4Option{Code: dhcpOptRouter, Data: testServerIP})
+	}
+	return reply
+}
+
+func (s *testDHCPServer) leased(mac net.HardwareAddr) net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bindings[mac.String()]
+}
+
+func (s *testDHCPServer) acks(mac net.HardwareAddr) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked[mac.String()]
+}
+
+func (s *testDHCPServer) isReleased(ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.released[ip.String()]
+}
@@ -0,0 +1,279 @@
+// Package dhcptest provides an in-process DHCP server for tests of the
+// DHCPController and the controllers built on it. Its clients implement
+// dhcpmanager.DHCPClient and dhcpmanager.NAKReporter.
+package dhcptest
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/gopacket/layers"
+)
+
+// retryDelay is the time clients wait before requesting a lease again after
+// a NAK or an expired lease
+const retryDelay = 10 * time.Millisecond
+
+// Response scripts the reply of a Server to a single request
+type Response struct {
+	// IP is the leased IP. The IP already leased to the client or the next
+	// free IP of the network is used if IP is nil.
+	IP net.IP
+
+	// LeaseTime overrides the lease time of the server if not zero
+	LeaseTime time.Duration
+
+	// Delay is the time before the reply is received
+	Delay time.Duration
+
+	// NAK rejects the request and removes the binding of the client.
+	// Clients request a new lease.
+	NAK bool
+
+	// Ignore drops the request. Clients keep their lease until it expires.
+	Ignore bool
+}
+
+// Server creates clients obtaining leases from an in-process server instead
+// of the network. Requests are answered by the scripted responses in order
+// and with deterministic leases from network once the script is exhausted.
+// Clients keep their IP on renewal.
+type Server struct {
+	mu        sync.Mutex
+	network   net.IPNet
+	leaseTime time.Duration
+	next      uint32
+	script    []Response
+	bindings  map[string]net.IP
+	clients   map[*Client]bool
+	requests  int
+}
+
+// NewServer creates a server leasing IPs of network for leaseTime. The first
+// IP of network is the server identifier.
+func NewServer(network net.IPNet, leaseTime time.Duration) *Server {
+	return &Server{
+		network:   network,
+		leaseTime: leaseTime,
+		next:      2,
+		bindings:  make(map[string]net.IP),
+		clients:   make(map[*Client]bool),
+	}
+}
+
+// Script appends responses to the script of the server
+func (s *Server) Script(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, responses...)
+}
+
+// Running returns the number of started clients that have not been stopped
+func (s *Server) Running() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// Requests returns the number of requests received by the server
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Binding returns the IP bound to the client with the client identifier or
+// hardware address key or nil
+func (s *Server) Binding(key string) net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bindings[key]
+}
+
+// NewClient creates a client obtaining leases from the server. onBound is
+// called with the first lease and every renewed lease.
+func (s *Server) NewClient(iface *net.Interface, hostname string, onBound func(*dhclient.Lease)) *Client {
+	return &Client{
+		server:   s,
+		iface:    iface,
+		hostname: hostname,
+		onBound:  onBound,
+		options:  make(map[layers.DHCPOpt][]byte),
+	}
+}
+
+// Respond returns the response to a request of the client with the client
+// identifier or hardware address key and the lease it grants. It serves
+// clients that exchange DHCP messages themselves, the clients of the server
+// call it for every request.
+func (s *Server) Respond(key string) (Response, *dhclient.Lease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	var response Response
+	if len(s.script) > 0 {
+		response = s.script[0]
+		s.script = s.script[1:]
+	}
+	if response.NAK {
+		// The client is offered another IP after a rejection
+		delete(s.bindings, key)
+		return response, nil
+	}
+	if response.Ignore {
+		return response, nil
+	}
+
+	ip := response.IP
+	if ip == nil {
+		ip = s.bindings[key]
+	}
+	if ip == nil {
+		ip = make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(s.network.IP.To4())+s.next)
+		s.next++
+	}
+	s.bindings[key] = ip
+
+	leaseTime := s.leaseTime
+	if response.LeaseTime > 0 {
+		leaseTime = response.LeaseTime
+	}
+	server := make(net.IP, 4)
+	binary.BigEndian.PutUint32(server, binary.BigEndian.Uint32(s.network.IP.To4())+1)
+
+	now := time.Now()
+	return response, &dhclient.Lease{
+		ServerID:     server,
+		FixedAddress: ip,
+		Netmask:      s.network.Mask,
+		Router:       []net.IP{server},
+		DNS:          []net.IP{server},
+		Bound:        now,
+		Renew:        now.Add(leaseTime / 2),
+		Rebind:       now.Add(leaseTime * 7 / 8),
+		Expire:       now.Add(leaseTime),
+	}
+}
+
+// Client is a DHCP client of a Server
+type Client struct {
+	server   *Server
+	iface    *net.Interface
+	hostname string
+	onBound  func(*dhclient.Lease)
+	onNAK    func()
+
+	mu      sync.Mutex
+	options map[layers.DHCPOpt][]byte
+	params  []layers.DHCPOpt
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// AddOption adds an option sent with every request
+func (c *Client) AddOption(optionType layers.DHCPOpt, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.options[optionType] = data
+}
+
+// AddParamRequest adds an option to the parameter request list
+func (c *Client) AddParamRequest(dhcpOpt layers.DHCPOpt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.params = append(c.params, dhcpOpt)
+}
+
+// OnNAK sets the function called when the server rejects a request
+func (c *Client) OnNAK(fn func()) {
+	c.onNAK = fn
+}
+
+// Start starts obtaining a lease in the background
+func (c *Client) Start() {
+	c.done = make(chan struct{})
+	c.stopped = make(chan struct{})
+	c.server.mu.Lock()
+	c.server.clients[c] = true
+	c.server.mu.Unlock()
+	go c.run()
+}
+
+// Stop stops the client
+func (c *Client) Stop() {
+	close(c.done)
+	<-c.stopped
+	c.server.mu.Lock()
+	delete(c.server.clients, c)
+	c.server.mu.Unlock()
+}
+
+// key identifies the bindings of the client by client identifier or MAC
+func (c *Client) key() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id, ok := c.options[layers.DHCPOptClientID]; ok {
+		return string(id)
+	}
+	return c.iface.HardwareAddr.String()
+}
+
+// run obtains and renews leases like a real client until the client is
+// stopped
+func (c *Client) run() {
+	defer close(c.stopped)
+
+	var lease *dhclient.Lease
+	for {
+		response, renewed := c.server.Respond(c.key())
+		if !c.wait(response.Delay) {
+			return
+		}
+
+		if response.NAK && c.onNAK != nil {
+			c.onNAK()
+		}
+		var next time.Time
+		switch {
+		case renewed != nil:
+			lease = renewed
+			c.onBound(lease)
+			next = lease.Renew
+		case response.NAK || lease == nil || !time.Now().Before(lease.Expire):
+			lease = nil
+			next = time.Now().Add(retryDelay)
+		default:
+			// Retry until the lease expires
+			next = lease.Rebind
+			if !time.Now().Before(next) {
+				next = lease.Expire
+			}
+		}
+		if !c.wait(time.Until(next)) {
+			return
+		}
+	}
+}
+
+// wait waits for d and returns false if the client has been stopped
+func (c *Client) wait(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-c.done:
+			return false
+		default:
+			return true
+		}
+	}
+	select {
+	case <-c.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
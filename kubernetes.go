@@ -0,0 +1,1189 @@
+package dhcpmanager
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	kubernetesGroup        = "dhcpmanager.kramergroup.science"
+	kubernetesVersion      = "v1alpha1"
+	kubernetesIPLabel      = kubernetesGroup + "/ip"
+	kubernetesIPv6Label    = kubernetesGroup + "/ipv6"
+	kubernetesMACPoolName  = "default"
+	kubernetesRetryBackoff = time.Second
+
+	// kubernetesExpiryInterval is the interval in which expired allocations
+	// are removed
+	kubernetesExpiryInterval = 10 * time.Second
+
+	// kubernetesLeaseName is the name of the Lease used for leader election.
+	// The leadership of an unresponsive controller expires after
+	// kubernetesLeaseDuration.
+	kubernetesLeaseName     = "dhcpmanager-controller"
+	kubernetesLeaseDuration = 15 * time.Second
+	kubernetesRenewDeadline = 10 * time.Second
+	kubernetesRetryPeriod   = 2 * time.Second
+
+	// kubernetesNodeLabel marks the Leases used to register nodes. A node
+	// registration expires kubernetesLeaseDuration after the last renewal.
+	kubernetesNodeLabel       = kubernetesGroup + "/node"
+	kubernetesNodeLeasePrefix = "dhcpmanager-node-"
+)
+
+var (
+	// allocationResource is the DHCPAllocation custom resource. Each
+	// allocation is stored in an object named after the allocation ID.
+	allocationResource = schema.GroupVersionResource{
+		Group:    kubernetesGroup,
+		Version:  kubernetesVersion,
+		Resource: "dhcpallocations",
+	}
+
+	// macPoolResource is the MACPool custom resource. The pool is stored in a
+	// single object named kubernetesMACPoolName.
+	macPoolResource = schema.GroupVersionResource{
+		Group:    kubernetesGroup,
+		Version:  kubernetesVersion,
+		Resource: "macpools",
+	}
+
+	// leaseResource is the Lease resource used for leader election
+	leaseResource = schema.GroupVersionResource{
+		Group:    "coordination.k8s.io",
+		Version:  "v1",
+		Resource: "leases",
+	}
+)
+
+// kubernetesStateManager implements the StateManager interface using custom
+// resources stored through the Kubernetes API (see deployments/crds.yaml)
+type kubernetesStateManager struct {
+	client         dynamic.Interface
+	namespace      string
+	requestTimeout time.Duration
+
+	// ctx is cancelled when the state manager is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewKubernetesStateManager creates a new StateManager storing allocations
+// and the MAC pool as custom resources in namespace
+func NewKubernetesStateManager(client dynamic.Interface, namespace string, requestTimeout time.Duration) StateManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kubernetesStateManager{
+		client:         client,
+		namespace:      namespace,
+		requestTimeout: requestTimeout,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+func (s *kubernetesStateManager) allocations() dynamic.ResourceInterface {
+	return s.client.Resource(allocationResource).Namespace(s.namespace)
+}
+
+func (s *kubernetesStateManager) macPool() dynamic.ResourceInterface {
+	return s.client.Resource(macPoolResource).Namespace(s.namespace)
+}
+
+// MaintainIndices removes allocations with expired leases. The IP lookup is
+// maintained with labels on the allocation objects.
+func (s *kubernetesStateManager) MaintainIndices() {
+	go func() {
+		ticker := time.NewTicker(kubernetesExpiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.removeExpired()
+			}
+		}
+	}()
+}
+
+func (s *kubernetesStateManager) removeExpired() {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	list, err := s.allocations().List(ctx, metav1.ListOptions{})
+	cancel()
+	if err != nil {
+		log.Printf("State: error listing allocations [%s]", err.Error())
+		return
+	}
+	now := time.Now()
+	for i := range list.Items {
+		allocation, err := objectToAllocation(&list.Items[i])
+		if err != nil {
+			log.Printf("State: error decoding allocation %s [%s]", list.Items[i].GetName(), err.Error())
+			continue
+		}
+		if expire, ok := allocation.RecordExpiry(); !ok || !expire.Before(now) {
+			continue
+		}
+		err = s.removeUnchanged(&list.Items[i])
+		if apierrors.IsConflict(err) {
+			// The lease has been renewed since listing
+			continue
+		}
+		if err != nil {
+			log.Printf("State: error removing expired allocation %s [%s]", allocation.ID, err.Error())
+		}
+	}
+}
+
+// removeUnchanged deletes obj if it has not been modified since it was read
+func (s *kubernetesStateManager) removeUnchanged(obj *unstructured.Unstructured) error {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	version := obj.GetResourceVersion()
+	err := s.allocations().Delete(ctx, obj.GetName(), metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &version},
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Stop stops all watchers and the expiry thread
+func (s *kubernetesStateManager) Stop() {
+	s.cancel()
+}
+
+// Campaign elects a leader using a Lease in the namespace of the state manager
+func (s *kubernetesStateManager) Campaign(ctx context.Context, identity string) (context.Context, func(), error) {
+
+	elected := make(chan context.Context, 1)
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &kubernetesLeaseLock{
+			resource:       s.leases(),
+			name:           kubernetesLeaseName,
+			namespace:      s.namespace,
+			identity:       identity,
+			requestTimeout: s.requestTimeout,
+		},
+		LeaseDuration:   kubernetesLeaseDuration,
+		RenewDeadline:   kubernetesRenewDeadline,
+		RetryPeriod:     kubernetesRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            kubernetesLeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leading context.Context) { elected <- leading },
+			OnStoppedLeading: func() {},
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The election runs until resign is called, independent of ctx
+	runCtx, stop := context.WithCancel(s.ctx)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		le.Run(runCtx)
+	}()
+
+	select {
+	case leading := <-elected:
+		leaderCtx, cancel := watchContext(ctx, leading.Done())
+		var once sync.Once
+		resign := func() {
+			once.Do(func() {
+				cancel()
+				stop()
+				<-finished
+			})
+		}
+		return leaderCtx, resign, nil
+	case <-ctx.Done():
+		stop()
+		<-finished
+		return nil, nil, ctx.Err()
+	case <-finished:
+		stop()
+		return nil, nil, errors.New("Leader election stopped")
+	}
+}
+
+// RegisterNode registers node with a Lease that is renewed until ctx is
+// cancelled
+func (s *kubernetesStateManager) RegisterNode(ctx context.Context, node string) error {
+
+	if err := s.renewNode(node); err != nil {
+		return err
+	}
+
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(kubernetesLeaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				rctx, rcancel := context.WithTimeout(context.Background(), s.requestTimeout)
+				defer rcancel()
+				err := s.leases().Delete(rctx, nodeLeaseName(node), metav1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					log.Printf("State: error removing node %s [%s]", node, err.Error())
+				}
+				return
+			case <-ticker.C:
+			}
+			if err := s.renewNode(node); err != nil {
+				log.Printf("State: error renewing node %s [%s]", node, err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// renewNode creates or renews the Lease of node
+func (s *kubernetesStateManager) renewNode(node string) error {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(kubernetesLeaseDuration / time.Second)
+	lease := &coordinationv1.Lease{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      nodeLeaseName(node),
+			Namespace: s.namespace,
+			Labels:    map[string]string{kubernetesNodeLabel: ""},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &node,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &now,
+		},
+	}
+
+	existing, err := s.leases().Get(ctx, lease.Name, metav1.GetOptions{})
+	found := err == nil
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if found {
+		lease.ResourceVersion = existing.GetResourceVersion()
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(lease)
+	if err != nil {
+		return err
+	}
+	if !found {
+		_, err = s.leases().Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	} else {
+		_, err = s.leases().Update(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// Nodes returns the names of all nodes with an unexpired Lease
+func (s *kubernetesStateManager) Nodes() ([]string, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	list, err := s.leases().List(ctx, metav1.ListOptions{LabelSelector: kubernetesNodeLabel})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]string, 0, len(list.Items))
+	now := time.Now()
+	for _, item := range list.Items {
+		lease := &coordinationv1.Lease{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, lease); err != nil {
+			log.Printf("State: error decoding node lease %s [%s]", item.GetName(), err.Error())
+			continue
+		}
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		if spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second).After(now) {
+			nodes = append(nodes, *spec.HolderIdentity)
+		}
+	}
+	return nodes, nil
+}
+
+func (s *kubernetesStateManager) leases() dynamic.ResourceInterface {
+	return s.client.Resource(leaseResource).Namespace(s.namespace)
+}
+
+// nodeLeaseName converts a node name into a valid Lease name
+func nodeLeaseName(node string) string {
+	name := []rune(strings.ToLower(node))
+	for i, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '.' {
+			name[i] = '-'
+		}
+	}
+	return kubernetesNodeLeasePrefix + string(name)
+}
+
+// kubernetesLeaseLock implements resourcelock.Interface for a Lease accessed
+// through the dynamic client
+type kubernetesLeaseLock struct {
+	resource       dynamic.ResourceInterface
+	name           string
+	namespace      string
+	identity       string
+	requestTimeout time.Duration
+
+	// lease is the last observed Lease
+	lease *coordinationv1.Lease
+}
+
+func (l *kubernetesLeaseLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.requestTimeout)
+	defer cancel()
+	obj, err := l.resource.Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	lease := &coordinationv1.Lease{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, lease); err != nil {
+		return nil, nil, err
+	}
+	l.lease = lease
+
+	record := resourcelock.LeaseSpecToLeaderElectionRecord(&lease.Spec)
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, raw, nil
+}
+
+func (l *kubernetesLeaseLock) Create(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	lease := &coordinationv1.Lease{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.name,
+			Namespace: l.namespace,
+		},
+		Spec: resourcelock.LeaderElectionRecordToLeaseSpec(&ler),
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(lease)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.requestTimeout)
+	defer cancel()
+	result, err := l.resource.Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	l.lease = &coordinationv1.Lease{}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(result.Object, l.lease)
+}
+
+func (l *kubernetesLeaseLock) Update(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+	l.lease.Spec = resourcelock.LeaderElectionRecordToLeaseSpec(&ler)
+	l.lease.APIVersion = "coordination.k8s.io/v1"
+	l.lease.Kind = "Lease"
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(l.lease)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.requestTimeout)
+	defer cancel()
+	result, err := l.resource.Update(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(result.Object, l.lease)
+}
+
+func (l *kubernetesLeaseLock) RecordEvent(string) {}
+
+func (l *kubernetesLeaseLock) Identity() string {
+	return l.identity
+}
+
+func (l *kubernetesLeaseLock) Describe() string {
+	return fmt.Sprintf("%s/%s", l.namespace, l.name)
+}
+
+// WatchEvents reports changes of the allocations selected by filter
+func (s *kubernetesStateManager) WatchEvents(ctx context.Context, filter AllocationFilter) <-chan AllocationEvent {
+	opts := metav1.ListOptions{}
+	if filter.ID != uuid.Nil {
+		opts.FieldSelector = fmt.Sprintf("metadata.name=%s", filter.ID)
+	}
+
+	events := make(chan AllocationEvent)
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	w := s.newWatch(ctx, s.allocations(), opts)
+	go func() {
+		defer close(events)
+		defer cancel()
+		w.run(ctx, func(ev kubernetesEvent) {
+			if id, err := uuid.Parse(ev.name()); err != nil || !filter.matches(id) {
+				return
+			}
+			event, err := ev.allocationEvent()
+			if err != nil {
+				log.Printf("Error decoding allocation from kubernetes object: %s", err.Error())
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return events
+}
+
+// WatchMACPoolEvents reports changes of the MAC pool
+func (s *kubernetesStateManager) WatchMACPoolEvents(ctx context.Context) <-chan MACPoolEvent {
+	opts := metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", kubernetesMACPoolName),
+	}
+
+	events := make(chan MACPoolEvent)
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	w := s.newWatch(ctx, s.macPool(), opts)
+	go func() {
+		defer close(events)
+		defer cancel()
+		w.run(ctx, func(ev kubernetesEvent) {
+			if ev.name() != kubernetesMACPoolName {
+				return
+			}
+
+			// Changes to the pool are reported as updates of the pool object.
+			// Translate these into push and pop events.
+			known, current := poolMACs(ev.old), poolMACs(ev.obj)
+			changes := make([]MACPoolEvent, 0)
+			for k, mac := range current {
+				if _, ok := known[k]; !ok {
+					changes = append(changes, MACPoolEvent{Type: MACPushed, MAC: mac})
+				}
+			}
+			for k, mac := range known {
+				if _, ok := current[k]; !ok {
+					changes = append(changes, MACPoolEvent{Type: MACPopped, MAC: mac})
+				}
+			}
+			for _, event := range changes {
+				event.Revision = ev.revision
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}()
+	return events
+}
+
+// poolMACs returns the MACs in the spec of a MACPool object
+func poolMACs(obj *unstructured.Unstructured) map[string]net.HardwareAddr {
+	macs := make(map[string]net.HardwareAddr)
+	if obj == nil {
+		return macs
+	}
+	values, _, _ := unstructured.NestedStringSlice(obj.Object, "spec", "macs")
+	for _, v := range values {
+		if mac, err := net.ParseMAC(v); err == nil {
+			macs[v] = mac
+		}
+	}
+	return macs
+}
+
+// WatchAllocation watches state changes of the allocation with the given ID
+func (s *kubernetesStateManager) WatchAllocation(allocationID uuid.UUID, watcher *AllocationWatcher) func() {
+	return watchAllocations(s, AllocationFilter{ID: allocationID}, watcher)
+}
+
+// Watch uses the supplied AllocationWatcher to watch all allocations
+func (s *kubernetesStateManager) Watch(watcher *AllocationWatcher) func() {
+	return watchAllocations(s, AllocationFilter{}, watcher)
+}
+
+// WatchMACPool watches the MAC pool
+func (s *kubernetesStateManager) WatchMACPool(watcher *MACPoolWatcher) func() {
+	return watchMACPool(s, watcher)
+}
+
+// kubernetesEvent is a change of a watched object. old is nil for created
+// objects and obj is nil for deleted objects.
+type kubernetesEvent struct {
+	old      *unstructured.Unstructured
+	obj      *unstructured.Unstructured
+	revision int64
+}
+
+func (ev kubernetesEvent) name() string {
+	if ev.obj != nil {
+		return ev.obj.GetName()
+	}
+	return ev.old.GetName()
+}
+
+func (ev kubernetesEvent) allocationEvent() (AllocationEvent, error) {
+	event := AllocationEvent{Type: EventModified, Revision: ev.revision}
+	var err error
+	if ev.obj == nil {
+		event.Type = EventDeleted
+	} else if event.New, err = objectToAllocation(ev.obj); err != nil {
+		return event, err
+	}
+	if ev.old == nil {
+		event.Type = EventCreated
+	} else if event.Old, err = objectToAllocation(ev.old); err != nil {
+		return event, err
+	}
+	return event, nil
+}
+
+// kubernetesWatch watches objects of a resource. It keeps track of the known
+// objects to report previous states and to recover from expired resource
+// versions by relisting.
+type kubernetesWatch struct {
+	resource       dynamic.ResourceInterface
+	opts           metav1.ListOptions
+	known          map[string]*unstructured.Unstructured
+	requestTimeout time.Duration
+
+	// w is the established watch or nil if establishing it failed with err
+	w   watch.Interface
+	err error
+}
+
+// newWatch lists the current objects of resource and establishes the first
+// watch, so that no change after the call to newWatch is missed
+func (s *kubernetesStateManager) newWatch(ctx context.Context, resource dynamic.ResourceInterface, opts metav1.ListOptions) *kubernetesWatch {
+	kw := &kubernetesWatch{
+		resource:       resource,
+		opts:           opts,
+		known:          make(map[string]*unstructured.Unstructured),
+		requestTimeout: s.requestTimeout,
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+	defer cancel()
+	if list, err := resource.List(lctx, opts); err == nil {
+		for i := range list.Items {
+			kw.known[list.Items[i].GetName()] = &list.Items[i]
+		}
+		kw.opts.ResourceVersion = list.GetResourceVersion()
+	} else {
+		log.Printf("State: error listing objects [%s]", err.Error())
+	}
+
+	kw.w, kw.err = resource.Watch(ctx, kw.opts)
+	return kw
+}
+
+// run hands all changes to handle until ctx is cancelled. Watches are
+// re-established if the API server closes them.
+func (kw *kubernetesWatch) run(ctx context.Context, handle func(kubernetesEvent)) {
+	for {
+		if kw.err == nil {
+			kw.consume(ctx, handle)
+		} else {
+			log.Printf("State: error watching objects [%s]", kw.err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(kubernetesRetryBackoff):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if kw.opts.ResourceVersion == "" {
+			if err := kw.relist(ctx, handle); err != nil {
+				log.Printf("State: error listing objects [%s]", err.Error())
+			}
+		}
+		kw.w, kw.err = kw.resource.Watch(ctx, kw.opts)
+	}
+}
+
+// consume handles events until the watch is closed. The resource version to
+// resume from is reset if it has expired.
+func (kw *kubernetesWatch) consume(ctx context.Context, handle func(kubernetesEvent)) {
+	defer kw.w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-kw.w.ResultChan():
+			if !ok {
+				return
+			}
+			if ev.Type == watch.Error {
+				err := apierrors.FromObject(ev.Object)
+				log.Printf("State: watch error [%s]", err.Error())
+				if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+					// Resume from the current state
+					kw.opts.ResourceVersion = ""
+				}
+				return
+			}
+			obj, ok := ev.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			kw.opts.ResourceVersion = obj.GetResourceVersion()
+
+			old := kw.known[obj.GetName()]
+			if ev.Type == watch.Deleted {
+				delete(kw.known, obj.GetName())
+				if old == nil {
+					old = obj
+				}
+				handle(kubernetesEvent{old: old, revision: objectRevision(obj)})
+				continue
+			}
+			kw.known[obj.GetName()] = obj
+			if changed(old, obj) {
+				handle(kubernetesEvent{old: old, obj: obj, revision: objectRevision(obj)})
+			}
+		}
+	}
+}
+
+// changed reports whether obj differs from the known object old. Objects
+// without resource version are always considered changed.
+func changed(old, obj *unstructured.Unstructured) bool {
+	return old == nil || obj.GetResourceVersion() == "" ||
+		old.GetResourceVersion() != obj.GetResourceVersion()
+}
+
+// relist replaces the known objects with the current objects and reports all
+// differences to handle
+func (kw *kubernetesWatch) relist(ctx context.Context, handle func(kubernetesEvent)) error {
+	lctx, cancel := context.WithTimeout(ctx, kw.requestTimeout)
+	defer cancel()
+	list, err := kw.resource.List(lctx, kw.opts)
+	if err != nil {
+		return err
+	}
+	revision := resourceRevision(list.GetResourceVersion())
+
+	current := make(map[string]*unstructured.Unstructured)
+	for i := range list.Items {
+		obj := &list.Items[i]
+		current[obj.GetName()] = obj
+		old := kw.known[obj.GetName()]
+		if changed(old, obj) {
+			handle(kubernetesEvent{old: old, obj: obj, revision: objectRevision(obj)})
+		}
+	}
+	for name, old := range kw.known {
+		if _, ok := current[name]; !ok {
+			handle(kubernetesEvent{old: old, revision: revision})
+		}
+	}
+
+	kw.known = current
+	kw.opts.ResourceVersion = list.GetResourceVersion()
+	return nil
+}
+
+// Put persists an allocation
+func (s *kubernetesStateManager) Put(allocation *Allocation) error {
+
+	obj, err := allocationToObject(allocation, s.namespace)
+	if err != nil {
+		log.Printf("State: error econding lease [%s]", err.Error())
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	result, err := s.allocations().Create(ctx, obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			current, err := s.allocations().Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			obj.SetResourceVersion(current.GetResourceVersion())
+			result, err = s.allocations().Update(ctx, obj, metav1.UpdateOptions{})
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	allocation.Revision = objectRevision(result)
+	return nil
+}
+
+// Update persists an allocation if the stored allocation is still at
+// expectedRevision. The object is replaced with the resource version it has
+// been read with, so the API server rejects concurrent modifications between
+// the check and the update.
+func (s *kubernetesStateManager) Update(allocation *Allocation, expectedRevision int64) error {
+
+	obj, err := allocationToObject(allocation, s.namespace)
+	if err != nil {
+		log.Printf("State: error econding lease [%s]", err.Error())
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	var result *unstructured.Unstructured
+	if expectedRevision == 0 {
+		result, err = s.allocations().Create(ctx, obj, metav1.CreateOptions{})
+	} else {
+		var version string
+		if version, err = s.storedVersion(ctx, allocation, expectedRevision); err != nil {
+			return err
+		}
+		obj.SetResourceVersion(version)
+		result, err = s.allocations().Update(ctx, obj, metav1.UpdateOptions{})
+	}
+	if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	allocation.Revision = objectRevision(result)
+	return nil
+}
+
+// storedVersion returns the resource version of the stored allocation if it
+// is still at expectedRevision and may be changed to allocation
+func (s *kubernetesStateManager) storedVersion(ctx context.Context, allocation *Allocation, expectedRevision int64) (string, error) {
+	current, err := s.allocations().Get(ctx, allocation.ID.String(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", ErrConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	stored, err := objectToAllocation(current)
+	if err != nil {
+		return "", err
+	}
+	if stored.Revision != expectedRevision {
+		return "", ErrConflict
+	}
+	if err := checkUpdate(stored, allocation); err != nil {
+		return "", err
+	}
+	return current.GetResourceVersion(), nil
+}
+
+// Remove deletes an allocation
+func (s *kubernetesStateManager) Remove(allocation *Allocation) error {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	err := s.allocations().Delete(ctx, allocation.ID.String(), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Allocations returns a list of all allocations
+func (s *kubernetesStateManager) Allocations() ([]*Allocation, error) {
+	return s.list(metav1.ListOptions{})
+}
+
+func (s *kubernetesStateManager) list(opts metav1.ListOptions) ([]*Allocation, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	list, err := s.allocations().List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations := make([]*Allocation, len(list.Items))
+	for i := range list.Items {
+		allocations[i], err = objectToAllocation(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return allocations, nil
+}
+
+// Get returns the allocation with ID
+func (s *kubernetesStateManager) Get(id uuid.UUID) (*Allocation, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	obj, err := s.allocations().Get(ctx, id.String(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return objectToAllocation(obj)
+}
+
+// GetByIP returns the allocation assigned to ip
+func (s *kubernetesStateManager) GetByIP(ip *net.IP) (*Allocation, error) {
+
+	if ip == nil {
+		return nil, errors.New("invalid argument. ip must not be nil")
+	}
+
+	label := kubernetesIPLabel
+	if ip.To4() == nil {
+		label = kubernetesIPv6Label
+	}
+	allocations, err := s.list(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", label, ipLabelValue(*ip)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(allocations) == 0 {
+		return nil, fmt.Errorf("No allocation for IP %s in index", ip.String())
+	}
+	return allocations[0], nil
+}
+
+// MACPool returns a list of available MAC addresses
+func (s *kubernetesStateManager) MACPool() ([]string, error) {
+	pool, err := s.getMACPool()
+	if apierrors.IsNotFound(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	macs, _, err := unstructured.NestedStringSlice(pool.Object, "spec", "macs")
+	if err != nil {
+		return nil, err
+	}
+	if macs == nil {
+		macs = []string{}
+	}
+	return macs, nil
+}
+
+// Claims returns the claimed MACs and the IDs of the claiming allocations
+func (s *kubernetesStateManager) Claims() (map[string]uuid.UUID, error) {
+	claims := make(map[string]uuid.UUID)
+	pool, err := s.getMACPool()
+	if apierrors.IsNotFound(err) {
+		return claims, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, _, err := unstructured.NestedStringMap(pool.Object, "spec", "claims")
+	if err != nil {
+		return nil, err
+	}
+	for mac, v := range values {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			log.Printf("Error deserialising claim of MAC [%s]", mac)
+			continue
+		}
+		claims[mac] = id
+	}
+	return claims, nil
+}
+
+// PutMAC puts a MAC into the pool of available MAC addresses
+func (s *kubernetesStateManager) PutMAC(mac net.HardwareAddr) error {
+
+	if len(mac) == 0 {
+		return fmt.Errorf("Empty MAC")
+	}
+	amac := strings.ToLower(mac.String())
+
+	// Check if MAC is already in use
+	allocations, err := s.Allocations()
+	if err != nil {
+		return err
+	}
+	for _, al := range allocations {
+		if strings.ToLower(al.Interface.HardwareAddr.String()) == amac {
+			return fmt.Errorf("MAC address already in use by allocation [%s]", al.ID)
+		}
+	}
+
+	return s.updateMACPool(true, func(macs []string, claims map[string]string) ([]string, error) {
+		delete(claims, amac)
+		for _, m := range macs {
+			if m == amac {
+				return macs, nil
+			}
+		}
+		return append(macs, amac), nil
+	})
+}
+
+// SeedMAC puts a MAC into the pool of available MAC addresses if it is
+// neither pooled, claimed nor used by an allocation
+func (s *kubernetesStateManager) SeedMAC(mac net.HardwareAddr) (bool, error) {
+
+	if len(mac) == 0 {
+		return false, fmt.Errorf("Empty MAC")
+	}
+	amac := strings.ToLower(mac.String())
+
+	allocations, err := s.Allocations()
+	if err != nil {
+		return false, err
+	}
+	if allocationWithMAC(allocations, amac) != nil {
+		return false, nil
+	}
+
+	seeded := false
+	err = s.updateMACPool(true, func(macs []string, claims map[string]string) ([]string, error) {
+		seeded = false
+		if _, ok := claims[amac]; ok {
+			return macs, nil
+		}
+		for _, m := range macs {
+			if m == amac {
+				return macs, nil
+			}
+		}
+		seeded = true
+		return append(macs, amac), nil
+	})
+	return seeded, err
+}
+
+// RemoveMAC removes a MAC and its claim from the pool
+func (s *kubernetesStateManager) RemoveMAC(mac net.HardwareAddr) error {
+	amac := strings.ToLower(mac.String())
+
+	err := s.updateMACPool(false, func(macs []string, claims map[string]string) ([]string, error) {
+		delete(claims, amac)
+		remaining := make([]string, 0, len(macs))
+		for _, m := range macs {
+			if m != amac {
+				remaining = append(remaining, m)
+			}
+		}
+		return remaining, nil
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// PopMAC retrieves a MAC from the pool of available MAC addresses and records
+// the claim by the allocation with ID claimant. Concurrent modifications of
+// the pool are detected using the resource version of the pool object.
+func (s *kubernetesStateManager) PopMAC(claimant uuid.UUID, accept func(net.HardwareAddr) bool) (net.HardwareAddr, error) {
+	var amac string
+	err := s.updateMACPool(false, func(macs []string, claims map[string]string) ([]string, error) {
+		for i, mac := range macs {
+			if !acceptMAC(accept, mac) {
+				continue
+			}
+			amac = mac
+			claims[amac] = claimant.String()
+			return append(macs[:i:i], macs[i+1:]...), nil
+		}
+		return nil, errors.New("No available MAC")
+	})
+	if apierrors.IsNotFound(err) {
+		return nil, errors.New("No available MAC")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseMAC(amac)
+}
+
+func (s *kubernetesStateManager) getMACPool() (*unstructured.Unstructured, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+	return s.macPool().Get(ctx, kubernetesMACPoolName, metav1.GetOptions{})
+}
+
+// updateMACPool applies modify to the MAC pool and retries on conflicting
+// updates. The pool object is created if it does not exist and create is true.
+func (s *kubernetesStateManager) updateMACPool(create bool, modify func(macs []string, claims map[string]string) ([]string, error)) error {
+	ctx, cancel := context.WithTimeout(s.ctx, s.requestTimeout)
+	defer cancel()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := s.macPool().Get(ctx, kubernetesMACPoolName, metav1.GetOptions{})
+		exists := err == nil
+		if apierrors.IsNotFound(err) && create {
+			pool = &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": kubernetesGroup + "/" + kubernetesVersion,
+				"kind":       "MACPool",
+				"metadata": map[string]interface{}{
+					"name":      kubernetesMACPoolName,
+					"namespace": s.namespace,
+				},
+			}}
+		} else if err != nil {
+			return err
+		}
+
+		macs, _, _ := unstructured.NestedStringSlice(pool.Object, "spec", "macs")
+		claims, _, _ := unstructured.NestedStringMap(pool.Object, "spec", "claims")
+		if claims == nil {
+			claims = make(map[string]string)
+		}
+
+		if macs, err = modify(macs, claims); err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedStringSlice(pool.Object, macs, "spec", "macs"); err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedStringMap(pool.Object, claims, "spec", "claims"); err != nil {
+			return err
+		}
+
+		if exists {
+			_, err = s.macPool().Update(ctx, pool, metav1.UpdateOptions{})
+		} else {
+			_, err = s.macPool().Create(ctx, pool, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Somebody else created the pool - retry as update
+				err = apierrors.NewConflict(macPoolResource.GroupResource(), kubernetesMACPoolName, err)
+			}
+		}
+		return err
+	})
+}
+
+// allocationToObject converts an allocation into a DHCPAllocation object
+func allocationToObject(allocation *Allocation, namespace string) (*unstructured.Unstructured, error) {
+	b, err := encode(allocation)
+	if err != nil {
+		return nil, err
+	}
+	spec := make(map[string]interface{})
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return nil, err
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": kubernetesGroup + "/" + kubernetesVersion,
+		"kind":       "DHCPAllocation",
+		"metadata": map[string]interface{}{
+			"name":      allocation.ID.String(),
+			"namespace": namespace,
+		},
+		"spec": spec,
+	}}
+	labels := make(map[string]string)
+	if allocation.Lease != nil {
+		labels[kubernetesIPLabel] = ipLabelValue(allocation.Lease.FixedAddress)
+	}
+	if allocation.Lease6 != nil {
+		labels[kubernetesIPv6Label] = ipLabelValue(allocation.Lease6.Address)
+	}
+	if len(labels) > 0 {
+		obj.SetLabels(labels)
+	}
+	return obj, nil
+}
+
+// objectToAllocation converts a DHCPAllocation object into an allocation
+func objectToAllocation(obj *unstructured.Unstructured) (*Allocation, error) {
+	spec, found, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("Object %s has no spec", obj.GetName())
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	allocation, err := decode(b)
+	if err != nil {
+		return nil, err
+	}
+	allocation.Revision = objectRevision(obj)
+	return allocation, nil
+}
+
+// objectRevision returns the revision of obj
+func objectRevision(obj *unstructured.Unstructured) int64 {
+	return resourceRevision(obj.GetResourceVersion())
+}
+
+// resourceRevision derives a revision from a resource version. Resource
+// versions are opaque strings, which can only be compared for equality, so
+// the revision is a non-zero hash of the resource version. Revisions of
+// Kubernetes objects must therefore not be compared for order.
+func resourceRevision(version string) int64 {
+	if version == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(version))
+	if revision := int64(h.Sum64() &^ (1 << 63)); revision != 0 {
+		return revision
+	}
+	return 1
+}
+
+// ipLabelValue converts ip into a valid label value. IPv6 addresses are
+// written as 32 hex digits, because label values cannot start or end with
+// a separator.
+func ipLabelValue(ip net.IP) string {
+	if ip.To4() == nil {
+		return hex.EncodeToString(ip.To16())
+	}
+	return ip.String()
+}
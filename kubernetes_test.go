@@ -0,0 +1,286 @@
+package dhcpmanager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestKubernetesStateManager() StateManager {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			allocationResource: "DHCPAllocationList",
+			macPoolResource:    "MACPoolList",
+			leaseResource:      "LeaseList",
+		})
+	versionObjects(client, allocationResource, macPoolResource)
+	return NewKubernetesStateManager(client, "dhcpmanager", time.Second)
+}
+
+// versionObjects maintains the resource versions of the objects of resources
+// like the API server, which the fake client does not do. Resource versions
+// are not numeric to make sure they are treated as opaque strings.
+func versionObjects(client *dynamicfake.FakeDynamicClient, resources ...schema.GroupVersionResource) {
+	var mu sync.Mutex
+	version := 0
+	next := func() string {
+		version++
+		return fmt.Sprintf("rv-%d", version)
+	}
+
+	// storedVersion returns the resource version of the stored object
+	storedVersion := func(action k8stesting.Action, name string) (string, error) {
+		stored, err := client.Tracker().Get(action.GetResource(), action.GetNamespace(), name)
+		if err != nil {
+			return "", err
+		}
+		accessor, err := meta.Accessor(stored)
+		if err != nil {
+			return "", err
+		}
+		return accessor.GetResourceVersion(), nil
+	}
+
+	for _, resource := range resources {
+		client.PrependReactor("create", resource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			obj := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+			obj.SetResourceVersion(next())
+			return false, nil, nil
+		})
+		client.PrependReactor("update", resource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			obj := action.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+			stored, err := storedVersion(action, obj.GetName())
+			if err != nil {
+				return true, nil, err
+			}
+			if obj.GetResourceVersion() != "" && obj.GetResourceVersion() != stored {
+				return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), obj.GetName(),
+					fmt.Errorf("resource version %s is not %s", obj.GetResourceVersion(), stored))
+			}
+			obj.SetResourceVersion(next())
+			return false, nil, nil
+		})
+		client.PrependReactor("delete", resource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			del := action.(k8stesting.DeleteAction)
+			preconditions := del.GetDeleteOptions().Preconditions
+			if preconditions == nil || preconditions.ResourceVersion == nil {
+				return false, nil, nil
+			}
+			stored, err := storedVersion(action, del.GetName())
+			if err != nil {
+				return true, nil, err
+			}
+			if *preconditions.ResourceVersion != stored {
+				return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), del.GetName(),
+					fmt.Errorf("resource version %s is not %s", *preconditions.ResourceVersion, stored))
+			}
+			return false, nil, nil
+		})
+	}
+}
+
+func TestKubernetesPutGet(t *testing.T) {
+
+	sm := newTestKubernetesStateManager()
+	defer sm.Stop()
+
+	alloc := NewAllocation("test")
+	if err := sm.Put(alloc); err != nil {
+		t.Fatal(err)
+	}
+
+	alloc.State = Bound
+	alloc.Lease = &dhclient.Lease{
+		FixedAddress: net.ParseIP("192.168.1.100"),
+		Expire:       time.Now().Add(time.Hour),
+	}
+	if err := sm.Put(alloc); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := sm.Get(alloc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(alloc, stored, t)
+
+	ip := net.ParseIP("192.168.1.100")
+	byIP, err := sm.GetByIP(&ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(alloc, byIP, t)
+
+	alloc.Family = FamilyDual
+	alloc.Lease6 = &Lease6{
+		Address: net.ParseIP("2001:db8::"),
+		Expire:  time.Now().Add(time.Hour),
+	}
+	if err := sm.Put(alloc); err != nil {
+		t.Fatal(err)
+	}
+	ip6 := net.ParseIP("2001:db8::")
+	byIP, err = sm.GetByIP(&ip6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(alloc, byIP, t)
+
+	if err := sm.Remove(alloc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Get(alloc.ID); err == nil {
+		t.Error("Allocation not removed")
+	}
+}
+
+func TestKubernetesWatch(t *testing.T) {
+
+	sm := newTestKubernetesStateManager()
+	defer sm.Stop()
+
+	created := make(chan *Allocation, 1)
+	modified := make(chan *Allocation, 1)
+	deleted := make(chan *Allocation, 1)
+	stop := sm.Watch(&AllocationWatcher{
+		OnCreate: func(a *Allocation) { created <- a },
+		OnModify: func(a *Allocation) { modified <- a },
+		OnDelete: func(a *Allocation) { deleted <- a },
+	})
+	defer stop()
+
+	alloc := NewAllocation("test")
+	sm.Put(alloc)
+	assertEvent(t, created, alloc)
+
+	alloc.State = Bound
+	sm.Put(alloc)
+	if a := assertEvent(t, modified, alloc); a.State != Bound {
+		t.Errorf("Expected state %d got %d", Bound, a.State)
+	}
+
+	sm.Remove(alloc)
+	assertEvent(t, deleted, alloc)
+}
+
+func TestKubernetesMACPool(t *testing.T) {
+
+	sm := newTestKubernetesStateManager()
+	defer sm.Stop()
+
+	pushed := make(chan net.HardwareAddr, 2)
+	stop := sm.WatchMACPool(&MACPoolWatcher{
+		OnPush: func(mac net.HardwareAddr) { pushed <- mac },
+	})
+	defer stop()
+
+	mac1, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	mac2, _ := net.ParseMAC("aa:bb:cc:dd:ee:02")
+	for _, mac := range []net.HardwareAddr{mac1, mac2} {
+		if err := sm.PutMAC(mac); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	macs, err := sm.MACPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macs) != 2 {
+		t.Errorf("Expected 2 MACs in pool got %d", len(macs))
+	}
+
+	claimed, err := sm.PopMAC(NewAllocation("test").ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.String() != mac1.String() {
+		t.Errorf("Expected [%s] got [%s]", mac1, claimed)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for MAC pool event")
+		}
+	}
+}
+
+func TestKubernetesLeaseExpiry(t *testing.T) {
+
+	sm := newTestKubernetesStateManager().(*kubernetesStateManager)
+	defer sm.Stop()
+
+	alloc := NewAllocation("test")
+	alloc.Lease = &dhclient.Lease{
+		FixedAddress: net.ParseIP("192.168.1.100"),
+		Expire:       time.Now().Add(-expiredRecordGrace - time.Second),
+	}
+	sm.Put(alloc)
+	expired, err := sm.allocations().Get(context.Background(), alloc.ID.String(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A lease renewed after the allocation has been read must not be removed
+	alloc.Lease.Expire = time.Now().Add(time.Hour)
+	sm.Put(alloc)
+	if err := sm.removeUnchanged(expired); !apierrors.IsConflict(err) {
+		t.Errorf("Expected conflict removing renewed allocation got %v", err)
+	}
+	sm.removeExpired()
+	if _, err := sm.Get(alloc.ID); err != nil {
+		t.Errorf("Expected renewed allocation to be kept - %v", err)
+	}
+
+	alloc.Lease.Expire = time.Now().Add(-expiredRecordGrace - time.Second)
+	sm.Put(alloc)
+	sm.removeExpired()
+	if _, err := sm.Get(alloc.ID); err != ErrNotFound {
+		t.Errorf("Expected expired allocation to be removed got %v", err)
+	}
+}
+
+func TestKubernetesUpdateConflict(t *testing.T) {
+	testUpdateConflict(newTestKubernetesStateManager(), t)
+}
+
+func TestKubernetesWatchEvents(t *testing.T) {
+	testWatchEvents(newTestKubernetesStateManager(), t)
+}
+
+func TestKubernetesClaims(t *testing.T) {
+	testClaims(newTestKubernetesStateManager(), t)
+}
+
+func TestKubernetesSeedMAC(t *testing.T) {
+	testSeedMAC(newTestKubernetesStateManager(), t)
+}
+
+func TestKubernetesCampaign(t *testing.T) {
+	testCampaign(newTestKubernetesStateManager(), t)
+}
+
+func TestKubernetesNodes(t *testing.T) {
+	testNodes(newTestKubernetesStateManager(), t)
+}
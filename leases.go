@@ -0,0 +1,97 @@
+package dhcpmanager
+
+import (
+	"net"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/uuid"
+)
+
+// defaultLeaseReportDelay is the time a lease has to stay in the renewing,
+// rebinding or expired state before it is reported. Renewals that succeed
+// within the delay are not reported.
+const defaultLeaseReportDelay = 2 * time.Second
+
+// LeaseEventType gives information regarding the kind of problem reported by
+// a LeaseEvent
+type LeaseEventType int
+
+const (
+	// LeaseStateChanged = The lease has not been renewed in time and entered
+	// the renewing, rebinding or expired state
+	LeaseStateChanged LeaseEventType = 0
+
+	// LeaseRejected = The DHCP server rejected a request with a DHCPNAK
+	LeaseRejected LeaseEventType = 1
+
+	// LeaseIPChanged = The client obtained a lease of another IP
+	LeaseIPChanged LeaseEventType = 2
+)
+
+// LeaseEvent reports a problem keeping the lease of an allocation alive
+type LeaseEvent struct {
+	Type       LeaseEventType
+	Allocation uuid.UUID
+	Interface  string
+
+	// IP is the IP of the allocation kept alive by the client
+	IP net.IP
+
+	// State is the state of the lease of IP
+	State LeaseState
+
+	// Lease is the lease of the other IP of LeaseIPChanged events
+	Lease *dhclient.Lease
+}
+
+// OnLeaseEvent sets the function called with the lease problems of bound
+// allocations. It is called from the DHCP clients and must not stop them.
+// It must be called before allocations are bound.
+func (c *DHCPController) OnLeaseEvent(fn func(LeaseEvent)) {
+	c.onLeaseEvent = fn
+}
+
+func (c *DHCPController) emit(ev LeaseEvent) {
+	if c.onLeaseEvent != nil {
+		c.onLeaseEvent(ev)
+	}
+}
+
+// monitorLease reports the lease of managed entering the renewing, rebinding
+// and expired states until the client is stopped. Renewals are reported by
+// the DHCP client itself.
+func (c *DHCPController) monitorLease(managed *managedClient) {
+	reported := LeaseBound
+	for {
+		now := time.Now()
+		info := c.clients.describe(managed, now.Add(-c.reportDelay))
+		if info.State != reported && info.State != LeaseBound {
+			c.emit(LeaseEvent{
+				Type:       LeaseStateChanged,
+				Allocation: info.Allocation,
+				Interface:  info.Interface,
+				IP:         info.IP,
+				State:      info.State,
+			})
+		}
+		reported = info.State
+
+		// Wait for the next state change or renewal
+		wait := time.Hour
+		for _, t := range []time.Time{info.Renew, info.Rebind, info.Expire} {
+			if d := t.Add(c.reportDelay).Sub(now); d > 0 && d < wait {
+				wait = d
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-managed.done:
+			timer.Stop()
+			return
+		case <-managed.renewed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,94 @@
+package dhcpmanager
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/kramergroup/dhcpmanager/internal/dhcptest"
+)
+
+// nextLeaseEvent waits for the next event of type eventType
+func nextLeaseEvent(t *testing.T, events <-chan LeaseEvent, eventType LeaseEventType) LeaseEvent {
+	t.Helper()
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == eventType {
+				return ev
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No lease event of type %d", eventType)
+		}
+	}
+}
+
+func TestLeaseEvents(t *testing.T) {
+	c, server := newFakeController(400 * time.Millisecond)
+	c.reportDelay = 20 * time.Millisecond
+	events := make(chan LeaseEvent, 10)
+	c.OnLeaseEvent(func(ev LeaseEvent) { events <- ev })
+	renewed := make(chan *dhclient.Lease, 10)
+	allocation := NewAllocation("web")
+
+	lease, err := c.BindAllocationToInterface(allocation, newFakeInterface("vf-a", "56:6a:e2:0b:01:8d"), func(_ *net.Interface, lease *dhclient.Lease) {
+		renewed <- lease
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { c.Stop(&lease.FixedAddress) }()
+
+	// Renewals in time are not reported
+	select {
+	case <-renewed:
+	case <-time.After(time.Second):
+		t.Fatal("Lease not renewed")
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("Unexpected event %+v", ev)
+	default:
+	}
+
+	// Unanswered requests move the lease through the renewing, rebinding and
+	// expired states before the same IP is obtained again
+	server.Script(dhcptest.Response{Ignore: true}, dhcptest.Response{Ignore: true}, dhcptest.Response{Ignore: true}, dhcptest.Response{Delay: 100 * time.Millisecond})
+	for _, state := range []LeaseState{LeaseRenewing, LeaseRebinding, LeaseExpired} {
+		ev := nextLeaseEvent(t, events, LeaseStateChanged)
+		if ev.State != state || ev.Allocation != allocation.ID || !ev.IP.Equal(lease.FixedAddress) {
+			t.Errorf("Expected %s event got %+v", state, ev)
+		}
+	}
+	select {
+	case reacquired := <-renewed:
+		if !reacquired.FixedAddress.Equal(lease.FixedAddress) {
+			t.Errorf("Expected IP %s got %s", lease.FixedAddress, reacquired.FixedAddress)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Lease not obtained again")
+	}
+
+	// A rejected renewal is reported and so is the other IP obtained afterwards
+	server.Script(dhcptest.Response{NAK: true})
+	if ev := nextLeaseEvent(t, events, LeaseRejected); !ev.IP.Equal(lease.FixedAddress) {
+		t.Errorf("Expected rejected lease of %s got %s", lease.FixedAddress, ev.IP)
+	}
+	ev := nextLeaseEvent(t, events, LeaseIPChanged)
+	if !ev.IP.Equal(lease.FixedAddress) || ev.Lease == nil || ev.Lease.FixedAddress.Equal(lease.FixedAddress) {
+		t.Errorf("Expected other IP than %s got %+v", lease.FixedAddress, ev)
+	}
+	// The client of the other IP is stopped instead of keeping it alive for
+	// the allocation
+	if _, ok := c.Client(lease.FixedAddress); ok || len(c.ManagedIPs()) != 0 {
+		t.Errorf("Expected client to be unregistered, managing %v", c.ManagedIPs())
+	}
+	deadline := time.Now().Add(time.Second)
+	for server.Running() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.Running() != 0 {
+		t.Errorf("Expected client of other IP to be stopped, %d running", server.Running())
+	}
+}
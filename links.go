@@ -0,0 +1,187 @@
+package dhcpmanager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+)
+
+// LinkManager creates, lists and removes the virtual devices of a
+// DHCPController
+type LinkManager interface {
+	// CreateLink creates the device name with alias on the interface parent.
+	// mac is the MAC address of the device or nil to generate one. Errors
+	// satisfy errors.Is(err, os.ErrExist) if a device named name exists.
+	CreateLink(parent, name, alias string, mac net.HardwareAddr, device DeviceConfig) (*net.Interface, error)
+
+	// DeleteLink removes the device name
+	DeleteLink(name string) error
+
+	// AddAddress assigns addr to the device name
+	AddAddress(name string, addr net.IPNet) error
+
+	// Links lists the devices created on parent or on all interfaces if
+	// parent is empty
+	Links(parent string) ([]net.Interface, error)
+}
+
+// netlinkLinkManager manages devices with netlink. Devices are created in
+// namespace ns.
+type netlinkLinkManager struct {
+	ns *Namespace
+}
+
+// NewNetlinkLinkManager creates a LinkManager for the devices of the host.
+// Devices are moved into ns unless ns is nil.
+func NewNetlinkLinkManager(ns *Namespace) LinkManager {
+	return &netlinkLinkManager{ns: ns}
+}
+
+func (m *netlinkLinkManager) CreateLink(parent, name, alias string, mac net.HardwareAddr, device DeviceConfig) (*net.Interface, error) {
+
+	// The parent is always in the namespace of the controller
+	parentLink, err := netlink.LinkByName(parent)
+	if err != nil {
+		return nil, err
+	}
+	if device.VLAN != 0 {
+		if parentLink, err = m.vlanLink(parentLink, device); err != nil {
+			return nil, err
+		}
+	}
+	la := netlink.LinkAttrs{
+		Name:         name,
+		Alias:        alias,
+		HardwareAddr: mac,
+		ParentIndex:  parentLink.Attrs().Index,
+		Namespace:    m.ns.nsFd(),
+	}
+
+	if err := netlink.LinkAdd(device.newLink(la)); err != nil {
+		log.Printf("could not add interface %s: %v\n", la.Name, err)
+		return nil, err
+	}
+
+	h := m.ns.Handle()
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	var iface *net.Interface
+	err = m.ns.Do(func() error {
+		var err error
+		iface, err = net.InterfaceByName(name)
+		return err
+	})
+	if err == nil {
+		err = h.LinkSetUp(link)
+	}
+
+	if err != nil {
+		// try to remove device if setup failed to avoid orphaned devices
+		h.LinkDel(link)
+		return nil, err
+	}
+	return iface, nil
+}
+
+// vlanLink returns the VLAN sub-interface of parent for device and creates
+// it if it does not exist. It stays in the namespace of the controller and is
+// kept when devices are removed, as other devices may use it.
+func (m *netlinkLinkManager) vlanLink(parent netlink.Link, device DeviceConfig) (netlink.Link, error) {
+	vlan := device.newVlan(parent.Attrs().Name, parent.Attrs().Index)
+	link, err := netlink.LinkByName(vlan.Name)
+	if err != nil {
+		// Another device may have created it concurrently
+		if err := netlink.LinkAdd(vlan); err != nil && !errors.Is(err, os.ErrExist) {
+			log.Printf("could not add VLAN interface %s: %v\n", vlan.Name, err)
+			return nil, err
+		}
+		if link, err = netlink.LinkByName(vlan.Name); err != nil {
+			return nil, err
+		}
+	}
+	if l, ok := link.(*netlink.Vlan); !ok || l.ParentIndex != vlan.ParentIndex || l.VlanId != vlan.VlanId {
+		return nil, fmt.Errorf("Link %s is not VLAN %d of %s", vlan.Name, vlan.VlanId, parent.Attrs().Name)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, err
+		}
+	}
+	return link, nil
+}
+
+func (m *netlinkLinkManager) DeleteLink(name string) error {
+	h := m.ns.Handle()
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return h.LinkDel(link)
+}
+
+func (m *netlinkLinkManager) AddAddress(name string, addr net.IPNet) error {
+	h := m.ns.Handle()
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return h.AddrAdd(link, &netlink.Addr{IPNet: &addr})
+}
+
+func (m *netlinkLinkManager) Links(parent string) ([]net.Interface, error) {
+
+	var parents map[int]bool
+	if parent != "" {
+		parentLink, err := netlink.LinkByName(parent)
+		if err != nil {
+			return nil, err
+		}
+		parents, err = vlanParents(parentLink.Attrs().Index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	links, err := m.ns.Handle().LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces := make([]net.Interface, 0)
+	for _, link := range links {
+		attrs := link.Attrs()
+		if !isDevice(link) || (parents != nil && !parents[attrs.ParentIndex]) {
+			continue
+		}
+		ifaces = append(ifaces, net.Interface{
+			Index:        attrs.Index,
+			MTU:          attrs.MTU,
+			Name:         attrs.Name,
+			HardwareAddr: attrs.HardwareAddr,
+			Flags:        attrs.Flags,
+		})
+	}
+	return ifaces, nil
+}
+
+// vlanParents returns the index of the parent interface and of its VLAN
+// sub-interfaces, which are the parents of devices with a VLAN ID
+func vlanParents(index int) (map[int]bool, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	parents := map[int]bool{index: true}
+	for _, link := range links {
+		if _, ok := link.(*netlink.Vlan); ok && link.Attrs().ParentIndex == index {
+			parents[link.Attrs().Index] = true
+		}
+	}
+	return parents, nil
+}
@@ -0,0 +1,182 @@
+package dhcpmanager
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryLinkManager keeps devices in memory. It is used to test the
+// controller without root privileges.
+type memoryLinkManager struct {
+	mu        sync.Mutex
+	parents   map[string]net.Interface
+	vlans     map[string]*memoryVlan
+	links     map[string]*memoryLink
+	nextIndex int
+}
+
+// memoryVlan is a VLAN sub-interface shared by the devices on a VLAN
+type memoryVlan struct {
+	iface  net.Interface
+	parent string
+	vlan   int
+}
+
+// memoryLink is a device of the memoryLinkManager. lower is the name of the
+// VLAN sub-interface the device is stacked on or of the parent.
+type memoryLink struct {
+	iface  net.Interface
+	parent string
+	lower  string
+	alias  string
+	device DeviceConfig
+	addrs  []net.IPNet
+}
+
+// NewInMemoryLinkManager creates a LinkManager that keeps devices in memory.
+// Devices can be created on the interfaces parents.
+func NewInMemoryLinkManager(parents ...string) LinkManager {
+	m := &memoryLinkManager{
+		parents:   make(map[string]net.Interface),
+		vlans:     make(map[string]*memoryVlan),
+		links:     make(map[string]*memoryLink),
+		nextIndex: 1,
+	}
+	for _, parent := range parents {
+		m.parents[parent] = net.Interface{Index: m.nextIndex, Name: parent, HardwareAddr: randomMAC(), MTU: 1500}
+		m.nextIndex++
+	}
+	return m
+}
+
+func (m *memoryLinkManager) CreateLink(parent, name, alias string, mac net.HardwareAddr, device DeviceConfig) (*net.Interface, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.parents[parent]
+	if !ok {
+		return nil, fmt.Errorf("Link %s not found", parent)
+	}
+	if len(name) > maxDeviceNameLength {
+		return nil, fmt.Errorf("Invalid link name %s", name)
+	}
+	if _, ok := m.links[name]; ok {
+		return nil, fmt.Errorf("Link %s - %w", name, os.ErrExist)
+	}
+	if _, ok := m.parents[name]; ok {
+		return nil, fmt.Errorf("Link %s - %w", name, os.ErrExist)
+	}
+	if _, ok := m.vlans[name]; ok {
+		return nil, fmt.Errorf("Link %s - %w", name, os.ErrExist)
+	}
+
+	lower := p
+	if device.VLAN != 0 {
+		vlan, err := m.vlanLink(parent, device.VLAN)
+		if err != nil {
+			return nil, err
+		}
+		lower = vlan.iface
+	}
+
+	switch {
+	case device.Mode == IPvlan:
+		mac = lower.HardwareAddr
+	case len(mac) == 0:
+		mac = randomMAC()
+	}
+	iface := net.Interface{
+		Index:        m.nextIndex,
+		MTU:          lower.MTU,
+		Name:         name,
+		HardwareAddr: mac,
+		Flags:        net.FlagUp | net.FlagBroadcast | net.FlagMulticast,
+	}
+	m.nextIndex++
+	m.links[name] = &memoryLink{iface: iface, parent: parent, lower: lower.Name, alias: alias, device: device}
+	return &iface, nil
+}
+
+// vlanLink returns the VLAN sub-interface of parent tagged with vlan and
+// creates it if it does not exist. Like VLAN devices of the kernel, there is
+// a single sub-interface per parent and VLAN ID.
+func (m *memoryLinkManager) vlanLink(parent string, vlan int) (*memoryVlan, error) {
+	name := vlanName(parent, vlan)
+	if v, ok := m.vlans[name]; ok {
+		if v.parent != parent || v.vlan != vlan {
+			return nil, fmt.Errorf("Link %s is not VLAN %d of %s", name, vlan, parent)
+		}
+		return v, nil
+	}
+	if _, ok := m.links[name]; ok {
+		return nil, fmt.Errorf("Link %s - %w", name, os.ErrExist)
+	}
+	p := m.parents[parent]
+	v := &memoryVlan{
+		iface: net.Interface{
+			Index:        m.nextIndex,
+			MTU:          p.MTU,
+			Name:         name,
+			HardwareAddr: p.HardwareAddr,
+			Flags:        net.FlagUp | net.FlagBroadcast | net.FlagMulticast,
+		},
+		parent: parent,
+		vlan:   vlan,
+	}
+	m.nextIndex++
+	m.vlans[name] = v
+	return v, nil
+}
+
+func (m *memoryLinkManager) DeleteLink(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.links[name]; !ok {
+		return fmt.Errorf("Link %s not found", name)
+	}
+	delete(m.links, name)
+	return nil
+}
+
+func (m *memoryLinkManager) AddAddress(name string, addr net.IPNet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.links[name]
+	if !ok {
+		return fmt.Errorf("Link %s not found", name)
+	}
+	link.addrs = append(link.addrs, addr)
+	return nil
+}
+
+func (m *memoryLinkManager) Links(parent string) ([]net.Interface, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.parents[parent]; parent != "" && !ok {
+		return nil, fmt.Errorf("Link %s not found", parent)
+	}
+	ifaces := make([]net.Interface, 0, len(m.links))
+	for _, link := range m.links {
+		if (parent == "" || link.parent == parent) && strings.HasPrefix(link.iface.Name, DevicePrefix) {
+			ifaces = append(ifaces, link.iface)
+		}
+	}
+	sort.Slice(ifaces, func(i, j int) bool { return ifaces[i].Name < ifaces[j].Name })
+	return ifaces, nil
+}
+
+// randomMAC returns a random locally administered unicast MAC address
+func randomMAC() net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	rand.Read(mac)
+	mac[0] = mac[0]&0xfe | 0x02
+	return mac
+}
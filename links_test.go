@@ -0,0 +1,95 @@
+package dhcpmanager
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+)
+
+func TestDevices(t *testing.T) {
+	mac, _ := net.ParseMAC("56:6a:e2:0b:01:8d")
+
+	links := NewInMemoryLinkManager("eth0", "eth1")
+	c := NewDHCPController([]Pool{
+		{Name: DefaultPool, Interface: "eth0"},
+		{Name: "ipvlan", Interface: "eth0", Device: DeviceConfig{Mode: IPvlan}},
+		{Name: "mgmt", Interface: "eth1"},
+		{Name: "vlan", Interface: "eth1", Device: DeviceConfig{Mode: VLAN, VLAN: 100}},
+		{Name: "missing", Interface: "eth2"},
+	}, time.Second, true, true, true, false)
+	c.UseLinkManager(links)
+
+	iface, err := c.CreateDevice("vf-a", "dhcpmanager a", &mac, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(iface.HardwareAddr, mac) {
+		t.Errorf("Expected MAC %s got %s", mac, iface.HardwareAddr)
+	}
+	if _, err := c.CreateDevice("vf-a", "dhcpmanager a", &mac, "mgmt", nil); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expected existing device got %v", err)
+	}
+
+	// ipvlan devices share the MAC of the parent
+	shared, err := c.CreateDevice("vf-b", "dhcpmanager b", nil, "ipvlan", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := links.(*memoryLinkManager).parents["eth0"]
+	if !bytes.Equal(shared.HardwareAddr, parent.HardwareAddr) {
+		t.Errorf("Expected MAC of parent %s got %s", parent.HardwareAddr, shared.HardwareAddr)
+	}
+	if _, err := c.CreateDevice("vf-c", "dhcpmanager c", nil, "mgmt", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateDevice("vf-d", "dhcpmanager d", nil, "missing", nil); err == nil {
+		t.Error("Expected error for missing parent interface")
+	}
+
+	// Devices on a VLAN share its sub-interface
+	for _, name := range []string{"vf-e", "vf-f"} {
+		if _, err := c.CreateDevice(name, "dhcpmanager "+name, nil, "vlan", nil); err != nil {
+			t.Fatal(err)
+		}
+		if lower := links.(*memoryLinkManager).links[name].lower; lower != "eth1.100" {
+			t.Errorf("Expected %s on eth1.100 got %s", name, lower)
+		}
+	}
+	if vlans := links.(*memoryLinkManager).vlans; len(vlans) != 1 {
+		t.Errorf("Expected one VLAN sub-interface got %v", vlans)
+	}
+
+	if devices, err := c.Devices(); err != nil || len(devices) != 5 {
+		t.Errorf("Expected 5 devices got %v (%v)", devices, err)
+	}
+	// Pools sharing a parent list its devices once
+	if devices, err := c.PoolDevices(); err != nil || len(devices) != 5 {
+		t.Errorf("Expected 5 pool devices got %v (%v)", devices, err)
+	}
+
+	lease := &dhclient.Lease{FixedAddress: net.ParseIP("192.168.1.100"), Netmask: net.CIDRMask(24, 32)}
+	if err := c.associateLeasewithDevice(lease, iface); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := links.(*memoryLinkManager).links["vf-a"].addrs; len(addrs) != 1 || addrs[0].String() != "192.168.1.100/24" {
+		t.Errorf("Expected address 192.168.1.100/24 got %v", addrs)
+	}
+
+	if err := c.RemoveDevice(iface); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveDevice(iface); err == nil {
+		t.Error("Expected error removing removed device")
+	}
+	if err := c.associateLeasewithDevice(lease, iface); err == nil {
+		t.Error("Expected error adding address to removed device")
+	}
+	if devices, err := c.Devices(); err != nil || len(devices) != 4 {
+		t.Errorf("Expected 4 devices got %v (%v)", devices, err)
+	}
+}
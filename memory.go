@@ -0,0 +1,595 @@
+package dhcpmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryStateManager is an in-memory implementation of the StateManager
+// interface. It is safe for concurrent use and mirrors the semantics of the
+// etcd-backed implementation, which makes it suitable for tests and embedded
+// use where running etcd is not an option.
+type memoryStateManager struct {
+	mu sync.Mutex
+
+	// Allocations are stored encoded to decouple the stored state from the
+	// objects handed to callers (just like a round-trip through etcd)
+	allocations map[uuid.UUID]memoryEntry
+	revision    int64
+	expiry      map[uuid.UUID]*time.Timer
+	macs        map[string]net.HardwareAddr
+	claims      map[string]uuid.UUID
+
+	// nodes counts the registrations of each live node
+	nodes map[string]int
+
+	watchers    map[*memoryWatcher]bool
+	macWatchers map[*memoryMACWatcher]bool
+
+	// leader is full while a leader is elected
+	leader chan struct{}
+
+	// ctx is cancelled when the state manager is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// memoryEntry is a stored allocation and the revision it was written at
+type memoryEntry struct {
+	value    []byte
+	revision int64
+}
+
+// memoryWatcher delivers allocation events to a WatchEvents channel
+type memoryWatcher struct {
+	ctx    context.Context
+	filter AllocationFilter
+	events chan AllocationEvent
+	queue  *eventQueue
+}
+
+// memoryMACWatcher delivers MAC pool events to a WatchMACPoolEvents channel
+type memoryMACWatcher struct {
+	ctx    context.Context
+	events chan MACPoolEvent
+	queue  *eventQueue
+}
+
+// NewInMemoryStateManager creates a new StateManager that keeps all state in
+// memory. State is lost when the process terminates.
+func NewInMemoryStateManager() StateManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &memoryStateManager{
+		allocations: make(map[uuid.UUID]memoryEntry),
+		expiry:      make(map[uuid.UUID]*time.Timer),
+		macs:        make(map[string]net.HardwareAddr),
+		claims:      make(map[string]uuid.UUID),
+		nodes:       make(map[string]int),
+		watchers:    make(map[*memoryWatcher]bool),
+		macWatchers: make(map[*memoryMACWatcher]bool),
+		leader:      make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// MaintainIndices is a no-op, because the in-memory state manager does not
+// maintain separate indices
+func (s *memoryStateManager) MaintainIndices() {}
+
+// Stop stops all watchers and pending expiry timers
+func (s *memoryStateManager) Stop() {
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.expiry {
+		t.Stop()
+	}
+	s.expiry = make(map[uuid.UUID]*time.Timer)
+}
+
+// Campaign elects a leader among the controllers sharing this state manager
+func (s *memoryStateManager) Campaign(ctx context.Context, identity string) (context.Context, func(), error) {
+	select {
+	case s.leader <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	leaderCtx, cancel := watchContext(ctx, s.ctx.Done())
+	var once sync.Once
+	resign := func() {
+		once.Do(func() {
+			cancel()
+			<-s.leader
+		})
+	}
+	return leaderCtx, resign, nil
+}
+
+// RegisterNode registers node until ctx is cancelled or the state manager is
+// stopped
+func (s *memoryStateManager) RegisterNode(ctx context.Context, node string) error {
+	s.mu.Lock()
+	s.nodes[node]++
+	s.mu.Unlock()
+
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	go func() {
+		<-ctx.Done()
+		cancel()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.nodes[node]--; s.nodes[node] <= 0 {
+			delete(s.nodes, node)
+		}
+	}()
+	return nil
+}
+
+// Nodes returns the names of all registered nodes
+func (s *memoryStateManager) Nodes() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes := make([]string, 0, len(s.nodes))
+	for node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// WatchEvents reports changes of the allocations selected by filter
+func (s *memoryStateManager) WatchEvents(ctx context.Context, filter AllocationFilter) <-chan AllocationEvent {
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	w := &memoryWatcher{
+		ctx:    ctx,
+		filter: filter,
+		events: make(chan AllocationEvent),
+		queue:  newEventQueue(),
+	}
+
+	s.mu.Lock()
+	s.watchers[w] = true
+	s.mu.Unlock()
+
+	go func() {
+		defer close(w.events)
+		defer cancel()
+		w.queue.run(ctx)
+
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}()
+	return w.events
+}
+
+// WatchMACPoolEvents reports changes of the MAC pool
+func (s *memoryStateManager) WatchMACPoolEvents(ctx context.Context) <-chan MACPoolEvent {
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	w := &memoryMACWatcher{
+		ctx:    ctx,
+		events: make(chan MACPoolEvent),
+		queue:  newEventQueue(),
+	}
+
+	s.mu.Lock()
+	s.macWatchers[w] = true
+	s.mu.Unlock()
+
+	go func() {
+		defer close(w.events)
+		defer cancel()
+		w.queue.run(ctx)
+
+		s.mu.Lock()
+		delete(s.macWatchers, w)
+		s.mu.Unlock()
+	}()
+	return w.events
+}
+
+// WatchAllocation watches state changes of the allocation with the given ID
+func (s *memoryStateManager) WatchAllocation(allocationID uuid.UUID, watcher *AllocationWatcher) func() {
+	return watchAllocations(s, AllocationFilter{ID: allocationID}, watcher)
+}
+
+// Watch uses the supplied AllocationWatcher to watch all allocations
+func (s *memoryStateManager) Watch(watcher *AllocationWatcher) func() {
+	return watchAllocations(s, AllocationFilter{}, watcher)
+}
+
+// WatchMACPool watches the MAC pool
+func (s *memoryStateManager) WatchMACPool(watcher *MACPoolWatcher) func() {
+	return watchMACPool(s, watcher)
+}
+
+// notify and notifyMAC have to be called with s.mu held. prev is nil for
+// created allocations and entry is nil for deleted allocations. Each watcher
+// receives its own copy of the allocations.
+func (s *memoryStateManager) notify(id uuid.UUID, prev, entry *memoryEntry) {
+	revision := s.revision
+	for w := range s.watchers {
+		if !w.filter.matches(id) {
+			continue
+		}
+		w := w
+		w.queue.push(func() {
+			ev, err := newMemoryEvent(prev, entry, revision)
+			if err != nil {
+				return
+			}
+			select {
+			case w.events <- ev:
+			case <-w.ctx.Done():
+			}
+		})
+	}
+}
+
+func newMemoryEvent(prev, entry *memoryEntry, revision int64) (AllocationEvent, error) {
+	ev := AllocationEvent{Type: EventModified, Revision: revision}
+	var err error
+	if entry == nil {
+		ev.Type = EventDeleted
+	} else if ev.New, err = entry.decode(); err != nil {
+		return ev, err
+	}
+	if prev == nil {
+		ev.Type = EventCreated
+	} else if ev.Old, err = prev.decode(); err != nil {
+		return ev, err
+	}
+	return ev, nil
+}
+
+func (e memoryEntry) decode() (*Allocation, error) {
+	allocation, err := decode(e.value)
+	if err != nil {
+		return nil, err
+	}
+	allocation.Revision = e.revision
+	return allocation, nil
+}
+
+func (s *memoryStateManager) notifyMAC(t MACPoolEventType, mac net.HardwareAddr) {
+	s.revision++
+	ev := MACPoolEvent{Type: t, MAC: mac, Revision: s.revision}
+	for w := range s.macWatchers {
+		w := w
+		w.queue.push(func() {
+			select {
+			case w.events <- ev:
+			case <-w.ctx.Done():
+			}
+		})
+	}
+}
+
+// Put persists an allocation. Allocations with a lease are removed
+// automatically when their record expires.
+func (s *memoryStateManager) Put(allocation *Allocation) error {
+	return s.put(allocation, false, 0)
+}
+
+// Update persists an allocation if the stored allocation is still at
+// expectedRevision
+func (s *memoryStateManager) Update(allocation *Allocation, expectedRevision int64) error {
+	return s.put(allocation, true, expectedRevision)
+}
+
+func (s *memoryStateManager) put(allocation *Allocation, checkRevision bool, expectedRevision int64) error {
+
+	b, err := encode(allocation)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, exists := s.allocations[allocation.ID]
+	if checkRevision && prev.revision != expectedRevision {
+		return ErrConflict
+	}
+	if checkRevision && exists {
+		stored, err := decode(prev.value)
+		if err != nil {
+			return err
+		}
+		if err := checkUpdate(stored, allocation); err != nil {
+			return err
+		}
+	}
+
+	s.revision++
+	entry := memoryEntry{value: b, revision: s.revision}
+	s.allocations[allocation.ID] = entry
+	allocation.Revision = entry.revision
+
+	if t, ok := s.expiry[allocation.ID]; ok {
+		t.Stop()
+		delete(s.expiry, allocation.ID)
+	}
+	if expire, ok := allocation.RecordExpiry(); ok {
+		id := allocation.ID
+		var t *time.Timer
+		t = time.AfterFunc(time.Until(expire), func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.expire(id, t)
+		})
+		s.expiry[id] = t
+	}
+
+	if exists {
+		s.notify(allocation.ID, &prev, &entry)
+	} else {
+		s.notify(allocation.ID, nil, &entry)
+	}
+	return nil
+}
+
+// expire removes the allocation with id if timer t is still its active
+// expiry timer. It has to be called with s.mu held.
+func (s *memoryStateManager) expire(id uuid.UUID, t *time.Timer) {
+	if s.expiry[id] != t {
+		return
+	}
+	delete(s.expiry, id)
+	if entry, ok := s.allocations[id]; ok {
+		delete(s.allocations, id)
+		s.revision++
+		s.notify(id, &entry, nil)
+	}
+}
+
+// Remove deletes an allocation
+func (s *memoryStateManager) Remove(allocation *Allocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.expiry[allocation.ID]; ok {
+		t.Stop()
+		delete(s.expiry, allocation.ID)
+	}
+	if entry, ok := s.allocations[allocation.ID]; ok {
+		delete(s.allocations, allocation.ID)
+		s.revision++
+		s.notify(allocation.ID, &entry, nil)
+	}
+	return nil
+}
+
+// Allocations returns a list of all allocations
+func (s *memoryStateManager) Allocations() ([]*Allocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	allocations := make([]*Allocation, 0, len(s.allocations))
+	for _, entry := range s.allocations {
+		allocation, err := entry.decode()
+		if err != nil {
+			return nil, err
+		}
+		allocations = append(allocations, allocation)
+	}
+	return allocations, nil
+}
+
+// Get returns the allocation with ID
+func (s *memoryStateManager) Get(id uuid.UUID) (*Allocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.allocations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return entry.decode()
+}
+
+// GetByIP returns the allocation assigned to ip
+func (s *memoryStateManager) GetByIP(ip *net.IP) (*Allocation, error) {
+
+	if ip == nil {
+		return nil, errors.New("invalid argument. ip must not be nil")
+	}
+
+	allocations, err := s.Allocations()
+	if err != nil {
+		return nil, err
+	}
+	for _, allocation := range allocations {
+		for _, aip := range allocation.IPs() {
+			if aip.Equal(*ip) {
+				return allocation, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No allocation for IP %s in index", ip.String())
+}
+
+// MACPool returns a list of available MAC addresses
+func (s *memoryStateManager) MACPool() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	macs := make([]string, 0, len(s.macs))
+	for k := range s.macs {
+		macs = append(macs, k)
+	}
+	return macs, nil
+}
+
+// Claims returns the claimed MACs and the IDs of the claiming allocations
+func (s *memoryStateManager) Claims() (map[string]uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claims := make(map[string]uuid.UUID, len(s.claims))
+	for k, id := range s.claims {
+		claims[k] = id
+	}
+	return claims, nil
+}
+
+// PutMAC puts a MAC into the pool of available MAC addresses
+func (s *memoryStateManager) PutMAC(mac net.HardwareAddr) error {
+
+	if len(mac) == 0 {
+		return fmt.Errorf("Empty MAC")
+	}
+	amac := strings.ToLower(mac.String())
+
+	// Check if MAC is already in use
+	allocations, err := s.Allocations()
+	if err != nil {
+		return err
+	}
+	for _, al := range allocations {
+		if strings.ToLower(al.Interface.HardwareAddr.String()) == amac {
+			return fmt.Errorf("MAC address already in use by allocation [%s]", al.ID)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.claims, amac)
+	if _, ok := s.macs[amac]; !ok {
+		s.macs[amac] = mac
+		s.notifyMAC(MACPushed, mac)
+	}
+	return nil
+}
+
+// SeedMAC puts a MAC into the pool of available MAC addresses if it is
+// neither pooled, claimed nor used by an allocation
+func (s *memoryStateManager) SeedMAC(mac net.HardwareAddr) (bool, error) {
+
+	if len(mac) == 0 {
+		return false, fmt.Errorf("Empty MAC")
+	}
+	amac := strings.ToLower(mac.String())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.macs[amac]; ok {
+		return false, nil
+	}
+	if _, ok := s.claims[amac]; ok {
+		return false, nil
+	}
+	for _, entry := range s.allocations {
+		al, err := entry.decode()
+		if err != nil {
+			return false, err
+		}
+		if strings.ToLower(al.Interface.HardwareAddr.String()) == amac {
+			return false, nil
+		}
+	}
+	s.macs[amac] = mac
+	s.notifyMAC(MACPushed, mac)
+	return true, nil
+}
+
+// RemoveMAC removes a MAC and its claim from the pool
+func (s *memoryStateManager) RemoveMAC(mac net.HardwareAddr) error {
+	amac := strings.ToLower(mac.String())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.claims, amac)
+	if m, ok := s.macs[amac]; ok {
+		delete(s.macs, amac)
+		s.notifyMAC(MACPopped, m)
+	}
+	return nil
+}
+
+// PopMAC retrieves a MAC from the pool of available MAC addresses and records
+// the claim by the allocation with ID claimant
+func (s *memoryStateManager) PopMAC(claimant uuid.UUID, accept func(net.HardwareAddr) bool) (net.HardwareAddr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, mac := range s.macs {
+		if accept != nil && !accept(mac) {
+			continue
+		}
+		delete(s.macs, k)
+		s.claims[k] = claimant
+		s.notifyMAC(MACPopped, mac)
+		return mac, nil
+	}
+	return nil, errors.New("No available MAC")
+}
+
+// eventQueue runs queued functions in order. Pushing never blocks, which
+// allows watchers to modify the state without deadlocking.
+type eventQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	signal  chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (q *eventQueue) push(f func()) {
+	q.mu.Lock()
+	q.pending = append(q.pending, f)
+	q.mu.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// run runs queued functions until ctx is cancelled. Pending functions are
+// discarded.
+func (q *eventQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.signal:
+		}
+
+		for {
+			q.mu.Lock()
+			if len(q.pending) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			f := q.pending[0]
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+
+			if ctx.Err() != nil {
+				return
+			}
+			f()
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package dhcpmanager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+)
+
+func TestInMemoryWatch(t *testing.T) {
+
+	sm := NewInMemoryStateManager()
+	defer sm.Stop()
+
+	created := make(chan *Allocation, 1)
+	modified := make(chan *Allocation, 1)
+	deleted := make(chan *Allocation, 1)
+	stop := sm.Watch(&AllocationWatcher{
+		OnCreate: func(a *Allocation) { created <- a },
+		OnModify: func(a *Allocation) { modified <- a },
+		OnDelete: func(a *Allocation) { deleted <- a },
+	})
+	defer stop()
+
+	alloc := NewAllocation("test")
+	if err := sm.Put(alloc); err != nil {
+		t.Fatal(err)
+	}
+	assertEvent(t, created, alloc)
+
+	alloc.State = Bound
+	if err := sm.Put(alloc); err != nil {
+		t.Fatal(err)
+	}
+	a := assertEvent(t, modified, alloc)
+	if a.State != Bound {
+		t.Errorf("Expected state %d got %d", Bound, a.State)
+	}
+
+	if err := sm.Remove(alloc); err != nil {
+		t.Fatal(err)
+	}
+	assertEvent(t, deleted, alloc)
+}
+
+func TestInMemoryWatchAllocation(t *testing.T) {
+
+	sm := NewInMemoryStateManager()
+	defer sm.Stop()
+
+	alloc := NewAllocation("watched")
+	created := make(chan *Allocation, 2)
+	stop := sm.WatchAllocation(alloc.ID, &AllocationWatcher{
+		OnCreate: func(a *Allocation) { created <- a },
+	})
+	defer stop()
+
+	sm.Put(NewAllocation("other"))
+	sm.Put(alloc)
+
+	assertEvent(t, created, alloc)
+	select {
+	case a := <-created:
+		t.Errorf("Unexpected event for allocation %s", a.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestInMemoryCopiesAllocations(t *testing.T) {
+
+	sm := NewInMemoryStateManager()
+	defer sm.Stop()
+
+	alloc := NewAllocation("test")
+	sm.Put(alloc)
+	alloc.Hostname = "changed"
+
+	stored, err := sm.Get(alloc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Hostname != "test" {
+		t.Errorf("Stored allocation modified outside of Put [%s]", stored.Hostname)
+	}
+}
+
+func TestInMemoryLeaseExpiry(t *testing.T) {
+
+	sm := NewInMemoryStateManager()
+	defer sm.Stop()
+
+	deleted := make(chan *Allocation, 1)
+	stop := sm.Watch(&AllocationWatcher{
+		OnDelete: func(a *Allocation) { deleted <- a },
+	})
+	defer stop()
+
+	alloc := NewAllocation("test")
+	alloc.Lease = &dhclient.Lease{
+		FixedAddress: net.ParseIP("192.168.1.100"),
+		Expire:       time.Now().Add(10*time.Millisecond - expiredRecordGrace),
+	}
+	sm.Put(alloc)
+
+	assertEvent(t, deleted, alloc)
+	if _, err := sm.Get(alloc.ID); err == nil {
+		t.Error("Expired allocation still present")
+	}
+}
+
+func TestInMemoryPopMACConcurrent(t *testing.T) {
+
+	sm := NewInMemoryStateManager()
+	defer sm.Stop()
+
+	n := 20
+	for i := 0; i < n; i++ {
+		mac, _ := net.ParseMAC(fmt.Sprintf("02:00:00:00:00:%02x", i))
+		if err := sm.PutMAC(mac); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for i := 0; i < 2*n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mac, err := sm.PopMAC(NewAllocation("test").ID, nil)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[mac.String()] {
+				t.Errorf("MAC %s popped twice", mac)
+			}
+			seen[mac.String()] = true
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != n {
+		t.Errorf("Expected %d MACs got %d", n, len(seen))
+	}
+}
+
+func TestInMemoryMACPoolWatch(t *testing.T) {
+
+	sm := NewInMemoryStateManager()
+	defer sm.Stop()
+
+	pushed := make(chan net.HardwareAddr, 1)
+	popped := make(chan net.HardwareAddr, 1)
+	stop := sm.WatchMACPool(&MACPoolWatcher{
+		OnPush: func(mac net.HardwareAddr) { pushed <- mac },
+		OnPop:  func(mac net.HardwareAddr) { popped <- mac },
+	})
+	defer stop()
+
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	sm.PutMAC(mac)
+	sm.PopMAC(NewAllocation("test").ID, nil)
+
+	for _, ch := range []chan net.HardwareAddr{pushed, popped} {
+		select {
+		case m := <-ch:
+			if m.String() != mac.String() {
+				t.Errorf("Expected [%s] got [%s]", mac, m)
+			}
+		case <-time.After(time.Second):
+			t.Error("Timeout waiting for MAC pool event")
+		}
+	}
+}
+
+func assertEvent(t *testing.T, ch chan *Allocation, expected *Allocation) *Allocation {
+	t.Helper()
+	select {
+	case a := <-ch:
+		if a.ID != expected.ID {
+			t.Errorf("Expected allocation %s got %s", expected.ID, a.ID)
+		}
+		return a
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for event on allocation %s", expected.ID)
+	}
+	return nil
+}
+
+func TestInMemoryUpdateConflict(t *testing.T) {
+	testUpdateConflict(NewInMemoryStateManager(), t)
+}
+
+func testUpdateConflict(sm StateManager, t *testing.T) {
+	defer sm.Stop()
+
+	alloc := NewAllocation("test")
+	if err := sm.Update(alloc, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Update(alloc, 0); err != ErrConflict {
+		t.Errorf("Expected conflict creating existing allocation got %v", err)
+	}
+
+	// A stale copy must not overwrite a newer revision
+	stale, _ := sm.Get(alloc.ID)
+	alloc.Transition(Binding, "binding")
+	if err := sm.Update(alloc, alloc.Revision); err != nil {
+		t.Fatal(err)
+	}
+	stale.State = Stale
+	if err := sm.Update(stale, stale.Revision); err != ErrConflict {
+		t.Errorf("Expected conflict updating stale copy got %v", err)
+	}
+
+	// A removed allocation must not be resurrected
+	sm.Remove(alloc)
+	if err := sm.Update(alloc, alloc.Revision); err != ErrConflict {
+		t.Errorf("Expected conflict updating removed allocation got %v", err)
+	}
+	if _, err := sm.Get(alloc.ID); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound got %v", err)
+	}
+}
+
+func TestInMemoryWatchEvents(t *testing.T) {
+	testWatchEvents(NewInMemoryStateManager(), t)
+}
+
+func testWatchEvents(sm StateManager, t *testing.T) {
+
+	alloc := NewAllocation("test")
+	ctx, cancel := context.WithCancel(context.Background())
+	events := sm.WatchEvents(ctx, AllocationFilter{ID: alloc.ID})
+	all := sm.WatchEvents(context.Background(), AllocationFilter{})
+
+	next := func(ch <-chan AllocationEvent) AllocationEvent {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for allocation event")
+		}
+		return AllocationEvent{}
+	}
+
+	sm.Put(NewAllocation("other"))
+	sm.Put(alloc)
+	alloc.State = Bound
+	sm.Put(alloc)
+	sm.Remove(alloc)
+
+	ev := next(events)
+	if ev.Type != EventCreated || ev.Old != nil || ev.New.ID != alloc.ID {
+		t.Errorf("Expected create event for %s got %+v", alloc.ID, ev)
+	}
+	ev = next(events)
+	if ev.Type != EventModified || ev.Old.State != Unbound || ev.New.State != Bound {
+		t.Errorf("Expected modify event from %d to %d got %+v", Unbound, Bound, ev)
+	}
+	if ev.Revision != ev.New.Revision {
+		t.Errorf("Expected event revision %d got %d", ev.New.Revision, ev.Revision)
+	}
+	ev = next(events)
+	if ev.Type != EventDeleted || ev.New != nil || ev.Old.ID != alloc.ID {
+		t.Errorf("Expected delete event for %s got %+v", alloc.ID, ev)
+	}
+	if ev = next(all); ev.New.Hostname != "other" {
+		t.Errorf("Expected first event for allocation other got %s", ev.New.Hostname)
+	}
+
+	// Cancelling the context closes the channel
+	cancel()
+	cancel()
+	for range events {
+	}
+
+	// Stopping the state manager closes all remaining channels
+	sm.Stop()
+	sm.Stop()
+	for range all {
+	}
+}
+
+func TestInMemoryClaims(t *testing.T) {
+	testClaims(NewInMemoryStateManager(), t)
+}
+
+func testClaims(sm StateManager, t *testing.T) {
+	defer sm.Stop()
+
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	sm.PutMAC(mac)
+	claimant := NewAllocation("test").ID
+	if _, err := sm.PopMAC(claimant, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := sm.Claims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims[mac.String()] != claimant {
+		t.Errorf("Expected claim of %s by %s got %v", mac, claimant, claims)
+	}
+
+	// Returning the MAC releases the claim
+	sm.PutMAC(mac)
+	if claims, _ = sm.Claims(); len(claims) != 0 {
+		t.Errorf("Expected no claims got %v", claims)
+	}
+
+	// Removing a claimed MAC from the pool removes its claim
+	if _, err := sm.PopMAC(claimant, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.RemoveMAC(mac); err != nil {
+		t.Fatal(err)
+	}
+	if claims, _ = sm.Claims(); len(claims) != 0 {
+		t.Errorf("Expected no claims after removal got %v", claims)
+	}
+}
+
+func TestInMemorySeedMAC(t *testing.T) {
+	testSeedMAC(NewInMemoryStateManager(), t)
+}
+
+// testSeedMAC checks that seeding keeps claimed and pooled MACs
+func testSeedMAC(sm StateManager, t *testing.T) {
+	defer sm.Stop()
+
+	claimed, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	pooled, _ := net.ParseMAC("aa:bb:cc:dd:ee:00")
+	if seeded, err := sm.SeedMAC(claimed); err != nil || !seeded {
+		t.Fatalf("Expected MAC to be seeded (%v)", err)
+	}
+	claimant := NewAllocation("test").ID
+	if _, err := sm.PopMAC(claimant, nil); err != nil {
+		t.Fatal(err)
+	}
+	if seeded, err := sm.SeedMAC(pooled); err != nil || !seeded {
+		t.Fatalf("Expected MAC to be seeded (%v)", err)
+	}
+
+	// Seeding again neither releases the claim nor duplicates the pooled MAC
+	for _, mac := range []net.HardwareAddr{claimed, pooled} {
+		if seeded, err := sm.SeedMAC(mac); err != nil || seeded {
+			t.Errorf("Expected MAC %s not to be seeded again (%v)", mac, err)
+		}
+	}
+	if claims, _ := sm.Claims(); claims[claimed.String()] != claimant {
+		t.Errorf("Expected claim of %s by %s got %v", claimed, claimant, claims)
+	}
+	if pool, _ := sm.MACPool(); len(pool) != 1 || pool[0] != pooled.String() {
+		t.Errorf("Expected pool [%s] got %v", pooled, pool)
+	}
+}
+
+func TestInMemoryCampaign(t *testing.T) {
+	testCampaign(NewInMemoryStateManager(), t)
+}
+
+func testCampaign(sm StateManager, t *testing.T) {
+	defer sm.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leader, resign, err := sm.Campaign(ctx, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one leader at a time
+	tctx, tcancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer tcancel()
+	if _, _, err := sm.Campaign(tctx, "second"); err == nil {
+		t.Fatal("Expected second campaign to fail while first is leader")
+	}
+
+	resign()
+	select {
+	case <-leader.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Leader context not cancelled on resign")
+	}
+
+	tctx, tcancel = context.WithTimeout(ctx, 5*time.Second)
+	defer tcancel()
+	leader, resign, err = sm.Campaign(tctx, "second")
+	if err != nil {
+		t.Fatalf("Expected second campaign to succeed after resign got %v", err)
+	}
+	defer resign()
+
+	cancel()
+	select {
+	case <-leader.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Leader context not cancelled with campaign context")
+	}
+}
+
+func TestInMemoryNodes(t *testing.T) {
+	testNodes(NewInMemoryStateManager(), t)
+}
+
+// testNodes checks that nodes are registered until their context is cancelled
+func testNodes(sm StateManager, t *testing.T) {
+	defer sm.Stop()
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	if err := sm.RegisterNode(ctxA, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.RegisterNode(ctxB, "node-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := sm.Nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(nodes)
+	if len(nodes) != 2 || nodes[0] != "node-a" || nodes[1] != "node-b" {
+		t.Fatalf("Expected nodes [node-a node-b] got %v", nodes)
+	}
+
+	cancelA()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		nodes, err = sm.Nodes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) == 1 && nodes[0] == "node-b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected nodes [node-b] after cancelling node-a got %v", nodes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancelB()
+	for {
+		nodes, err = sm.Nodes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no nodes after cancelling node-b got %v", nodes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -9,14 +9,19 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/coreos/etcd/clientv3"
 	dhclient "github.com/digineo/go-dhclient"
 	"github.com/google/uuid"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
-// AllocationState gives information regarding the state of an Allocation
+// AllocationState gives information regarding the state of an Allocation.
+// States change through Allocation.Transition and are encoded as names in
+// JSON.
 type AllocationState int
 
 const (
@@ -31,8 +36,66 @@ const (
 
 	// Stopped = This allocation has been gracefully stopped
 	Stopped AllocationState = 3
+
+	// Failed = The allocation could not be bound (error state)
+	Failed AllocationState = 4
+
+	// Renewing = The lease is overdue for renewal with the server that issued it
+	Renewing AllocationState = 5
+
+	// Rebinding = The renewal failed and the lease is extended with any server
+	Rebinding AllocationState = 6
+
+	// Lost = The lease expired or was rejected and the IP is being reacquired
+	Lost AllocationState = 7
+
+	// Binding = A controller is obtaining the leases
+	Binding AllocationState = 8
+
+	// Releasing = The allocation has been returned and its leases, device
+	// and MAC are being released
+	Releasing AllocationState = 9
+
+	// Released = The leases, device and MAC have been released and the
+	// allocation is removed
+	Released AllocationState = 10
 )
 
+// AddressFamily selects the IP versions an allocation obtains addresses for
+type AddressFamily string
+
+const (
+	// FamilyIPv4 = An IPv4 address is obtained with DHCP (default)
+	FamilyIPv4 AddressFamily = "ipv4"
+
+	// FamilyIPv6 = An IPv6 address is obtained with DHCPv6
+	FamilyIPv6 AddressFamily = "ipv6"
+
+	// FamilyDual = Both an IPv4 and an IPv6 address are obtained
+	FamilyDual AddressFamily = "dual"
+)
+
+// ParseAddressFamily parses ipv4, ipv6 or dual. An empty string selects IPv4.
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch f := AddressFamily(strings.ToLower(s)); f {
+	case "":
+		return FamilyIPv4, nil
+	case FamilyIPv4, FamilyIPv6, FamilyDual:
+		return f, nil
+	}
+	return "", fmt.Errorf("Invalid address family [%s]", s)
+}
+
+// IPv4 reports whether an IPv4 address is obtained for family
+func (f AddressFamily) IPv4() bool {
+	return f != FamilyIPv6
+}
+
+// IPv6 reports whether an IPv6 address is obtained for family
+func (f AddressFamily) IPv6() bool {
+	return f == FamilyIPv6 || f == FamilyDual
+}
+
 // Allocation is the central data structure that connects a DHCP lease with
 // an hostname
 type Allocation struct {
@@ -41,8 +104,51 @@ type Allocation struct {
 	Hostname  string
 	State     AllocationState
 	Interface net.Interface
+
+	// Lease6 is the DHCPv6 lease of allocations with an IPv6 address family
+	Lease6 *Lease6
+
+	// Family selects the leases obtained for the allocation. Allocations
+	// without family obtain an IPv4 lease.
+	Family AddressFamily `json:",omitempty"`
+
+	// Pool is the name of the pool the addresses are obtained from. The
+	// default pool is used if empty.
+	Pool string `json:",omitempty"`
+
+	// Device selects the virtual device of the allocation. The default
+	// configuration of the controller is used and stored if nil.
+	Device *DeviceConfig `json:",omitempty"`
+
+	// Options are sent to the DHCP server when obtaining leases
+	Options *DHCPOptions `json:",omitempty"`
+
+	// Config is the network configuration received with the IPv4 lease
+	Config *NetworkConfig `json:",omitempty"`
+
+	// Node is the name of the controller node the allocation is bound on.
+	// Unassigned allocations are claimed by the first sharded controller
+	// processing them
+	Node string
+
+	// History are the most recent state transitions, oldest first
+	History []StateTransition `json:",omitempty"`
+
+	// Revision of the stored allocation this object was read from. It is
+	// maintained by the StateManager and used for optimistic concurrency
+	// control with Update
+	Revision int64 `json:"-"`
 }
 
+var (
+	// ErrConflict is returned by Update if the stored allocation has been
+	// modified or removed concurrently
+	ErrConflict = errors.New("Allocation has been modified concurrently")
+
+	// ErrNotFound is returned by Get if the allocation does not exist
+	ErrNotFound = errors.New("Allocation not found")
+)
+
 // AllocationWatcher can be used to watch for state changes
 type AllocationWatcher struct {
 	OnDelete func(*Allocation)
@@ -59,9 +165,9 @@ type MACPoolWatcher struct {
 // StateManager manages the application state
 // It is the central data management object of the application
 // It's responsibilities include:
-// 	- Management of indices
-//  - Allocation management
-//  - MAC table management
+//   - Management of indices
+//   - Allocation management
+//   - MAC table management
 type StateManager interface {
 
 	// Lifecycle management
@@ -74,9 +180,38 @@ type StateManager interface {
 	// Stop stops all life-cycle threads
 	Stop()
 
+	// Leader election
+	// ---------------
+
+	// Campaign blocks until identity is elected leader among all campaigning
+	// controllers or ctx is cancelled. The returned context is cancelled when
+	// the leadership is lost or ctx is cancelled. The leadership is held until
+	// the returned resign function is called.
+	Campaign(ctx context.Context, identity string) (context.Context, func(), error)
+
+	// Node registry
+	// -------------
+
+	// RegisterNode announces node as live until ctx is cancelled or the state
+	// manager is stopped. The registration of an unresponsive node expires.
+	RegisterNode(ctx context.Context, node string) error
+
+	// Nodes returns the names of all live nodes
+	Nodes() ([]string, error)
+
 	// State Watcher
 	// -------------
 
+	// WatchEvents reports changes of the allocations selected by filter on
+	// the returned channel. The channel is closed when ctx is cancelled or
+	// the state manager is stopped
+	WatchEvents(ctx context.Context, filter AllocationFilter) <-chan AllocationEvent
+
+	// WatchMACPoolEvents reports changes of the MAC pool on the returned
+	// channel. The channel is closed when ctx is cancelled or the state
+	// manager is stopped
+	WatchMACPoolEvents(ctx context.Context) <-chan MACPoolEvent
+
 	// WatchAllocation watches the state of a specific allocation. The function
 	// returns a stop function that should be called as soon as the watcher is
 	// not needed anymore
@@ -95,16 +230,24 @@ type StateManager interface {
 	// Allocation Management
 	// ---------------------
 
-	// Put persists an allocation
+	// Put persists an allocation unconditionally
 	Put(allocation *Allocation) error
 
+	// Update persists an allocation if the stored allocation is still at
+	// expectedRevision and returns ErrConflict otherwise. An expectedRevision
+	// of 0 requires that the allocation does not exist yet. Changes of the
+	// stored state that the state machine does not allow return
+	// ErrInvalidTransition. The revision of allocation is set to the new
+	// revision on success
+	Update(allocation *Allocation, expectedRevision int64) error
+
 	// Remove deletes an allocation
 	Remove(allocation *Allocation) error
 
 	// Allocations returns a list of all allocations
 	Allocations() ([]*Allocation, error)
 
-	// Get returns the allocation with id
+	// Get returns the allocation with id or ErrNotFound
 	Get(id uuid.UUID) (*Allocation, error)
 
 	// GetByIP returns the allocation assigned to ip
@@ -119,11 +262,22 @@ type StateManager interface {
 	// PutMAC adds a new MAC to the pool of available MAC addresses
 	PutMAC(mac net.HardwareAddr) error
 
+	// SeedMAC adds mac to the pool of available MAC addresses unless it is
+	// pooled, claimed or used by an allocation already. Unlike PutMAC it
+	// never releases a claim. It reports whether mac was added.
+	SeedMAC(mac net.HardwareAddr) (bool, error)
+
 	// RemoveMAC removes a MAC address from the pool of available MAC addresses
 	RemoveMAC(mac net.HardwareAddr) error
 
-	// PopMAC take a MAC out of the pool and returns it
-	PopMAC() (net.HardwareAddr, error)
+	// Claims returns the MACs taken out of the pool with PopMAC and not
+	// returned since, together with the IDs of the claiming allocations
+	Claims() (map[string]uuid.UUID, error)
+
+	// PopMAC takes a MAC out of the pool and returns it. The MAC is claimed
+	// atomically and the claim is recorded for the allocation with ID claimant.
+	// Only MACs for which accept returns true are taken unless accept is nil.
+	PopMAC(claimant uuid.UUID, accept func(net.HardwareAddr) bool) (net.HardwareAddr, error)
 }
 
 // stateManager implements the StateManager interface
@@ -131,13 +285,33 @@ type stateManager struct {
 
 	// Etcd3 kv
 	kv             clientv3.KV
+	watcher        clientv3.Watcher
 	cli            *clientv3.Client
-	stopChan       []chan interface{}
 	requestTimeout time.Duration
+
+	// ctx is cancelled when the state manager is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 const etcdPrefix = "/kramergroup.science/dhcp-address-space-endpoint"
 
+// minLeaseTTL is the shortest TTL in seconds of the etcd lease of an
+// allocation record. Records of expired leases are removed after it.
+const minLeaseTTL = 1
+
+// expiredRecordGrace is the time the records of allocations are kept after
+// their leases expired
+const expiredRecordGrace = time.Minute
+
+// popMACRetries limits the number of attempts to claim a MAC from the pool
+// if other clients are popping MACs concurrently
+const popMACRetries = 10
+
+// electionTTL is the time in seconds after which the leadership of an
+// unresponsive controller expires
+const electionTTL = 10
+
 // NewAllocation creates a new Allocation record and assigns a UUID
 func NewAllocation(hostname string) *Allocation {
 	return &Allocation{
@@ -147,12 +321,79 @@ func NewAllocation(hostname string) *Allocation {
 	}
 }
 
+// IPs returns the addresses of all leases of the allocation
+func (a *Allocation) IPs() []net.IP {
+	ips := make([]net.IP, 0, 2)
+	if a.Lease != nil {
+		ips = append(ips, a.Lease.FixedAddress)
+	}
+	if a.Lease6 != nil {
+		ips = append(ips, a.Lease6.Address)
+	}
+	return ips
+}
+
+// Expiry returns the time the first lease of the allocation expires and false
+// if the allocation holds no lease
+func (a *Allocation) Expiry() (time.Time, bool) {
+	var expire time.Time
+	if a.Lease != nil {
+		expire = a.Lease.Expire
+	}
+	if a.Lease6 != nil && (expire.IsZero() || a.Lease6.Expire.Before(expire)) {
+		expire = a.Lease6.Expire
+	}
+	return expire, !expire.IsZero()
+}
+
+// RecordExpiry returns the time the stored record of the allocation is
+// removed and false if it is kept. Records are kept for expiredRecordGrace
+// after the first lease expired, so that controllers can handle the expired
+// lease, and while the IPs of lost allocations are reacquired.
+func (a *Allocation) RecordExpiry() (time.Time, bool) {
+	expire, ok := a.Expiry()
+	if !ok || a.State == Lost {
+		return time.Time{}, false
+	}
+	return expire.Add(expiredRecordGrace), true
+}
+
+// Bound reports whether the allocation holds the leases of all its address
+// families
+func (a *Allocation) Bound() bool {
+	return (!a.Family.IPv4() || a.Lease != nil) && (!a.Family.IPv6() || a.Lease6 != nil)
+}
+
+// LeastLoadedNode returns the node with the fewest allocations. Ties are
+// broken by name and an empty string is returned if there are no nodes.
+func LeastLoadedNode(nodes []string, allocations []*Allocation) string {
+	load := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		load[node] = 0
+	}
+	for _, allocation := range allocations {
+		if _, ok := load[allocation.Node]; ok {
+			load[allocation.Node]++
+		}
+	}
+
+	selected := ""
+	for node, n := range load {
+		if selected == "" || n < load[selected] || (n == load[selected] && node < selected) {
+			selected = node
+		}
+	}
+	return selected
+}
+
 // NewStateManager creates a new etcd3-backed application state
 func NewStateManager(etcdEndpoints []string, dialTimeout, requestTimeout time.Duration) (StateManager, error) {
 
+	ctx, cancel := context.WithCancel(context.Background())
 	sm := stateManager{
-		stopChan:       make([]chan interface{}, 0),
 		requestTimeout: requestTimeout,
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 
 	if cli, err := clientv3.New(clientv3.Config{
@@ -164,6 +405,7 @@ func NewStateManager(etcdEndpoints []string, dialTimeout, requestTimeout time.Du
 		return nil, err
 	}
 	sm.kv = clientv3.NewKV(sm.cli)
+	sm.watcher = sm.cli
 
 	return &sm, nil
 }
@@ -171,188 +413,307 @@ func NewStateManager(etcdEndpoints []string, dialTimeout, requestTimeout time.Du
 // MaintainIndices watches the state and ensures consistency of indices
 func (s *stateManager) MaintainIndices() {
 
-	updateIndex := func(a *Allocation) {
-		// Update IP->Allocation.ID lookup table
-		if a.Lease != nil {
+	// Ensure consistency of the IP<->ID lookup
+	events := s.WatchEvents(s.ctx, AllocationFilter{})
+	go func() {
+		for ev := range events {
+			s.updateLookup(ev)
+		}
+	}()
+}
+
+// updateLookup maintains the IP->Allocation.ID lookup table for a changed
+// allocation. The entries of IPs the allocation no longer holds, because it
+// obtained another IP, lost its lease or has been removed, are deleted unless
+// another allocation has taken them over in the meantime.
+func (s *stateManager) updateLookup(ev AllocationEvent) {
+
+	if ev.New != nil {
+		for _, ip := range ev.New.IPs() {
 			ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
-			defer cancel()
-			key := fmt.Sprintf("%s/lookup/%s", etcdPrefix, a.Lease.FixedAddress)
-			_, err := s.kv.Put(ctx, key, a.ID.String())
+			key := fmt.Sprintf("%s/lookup/%s", etcdPrefix, ip)
+			_, err := s.kv.Put(ctx, key, ev.New.ID.String())
+			cancel()
 			if err != nil {
 				log.Printf("State: error updating IP<->ID lookup table [%s]", err.Error())
 			}
 		}
 	}
 
-	deleteIndex := func(a *Allocation) {
-		// Update IP->Allocation.ID lookup table
-		if a.Lease != nil {
-			ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
-			defer cancel()
-			key := fmt.Sprintf("%s/lookup/%s", etcdPrefix, a.Lease.FixedAddress)
-			_, err := s.kv.Delete(ctx, key)
-			if err != nil {
-				log.Printf("State: error deleteing IP<->ID mapping [%s]", err.Error())
-			}
+	for _, ip := range releasedIPs(ev.Old, ev.New) {
+		ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+		key := fmt.Sprintf("%s/lookup/%s", etcdPrefix, ip)
+		_, err := s.kv.Txn(ctx).If(
+			clientv3.Compare(clientv3.Value(key), "=", ev.Old.ID.String()),
+		).Then(
+			clientv3.OpDelete(key),
+		).Commit()
+		cancel()
+		if err != nil {
+			log.Printf("State: error deleteing IP<->ID mapping [%s]", err.Error())
 		}
 	}
+}
 
-	// Ensure consistency of the IP<->ID lookup
-	watcher := AllocationWatcher{
-		OnModify: updateIndex,
-		OnCreate: updateIndex,
-		OnDelete: deleteIndex,
+// releasedIPs returns the IPs held by old that are not held by current. All
+// IPs of old are released if current is nil.
+func releasedIPs(old, current *Allocation) []net.IP {
+	released := make([]net.IP, 0)
+	if old == nil {
+		return released
 	}
-	s.Watch(&watcher)
-
+	held := make(map[string]bool)
+	if current != nil {
+		for _, ip := range current.IPs() {
+			held[ip.String()] = true
+		}
+	}
+	for _, ip := range old.IPs() {
+		if !held[ip.String()] {
+			released = append(released, ip)
+		}
+	}
+	return released
 }
 
-// Stop closes the etcd connection backing State
+// Stop stops all watchers and closes the etcd connection backing State
 func (s *stateManager) Stop() {
-	for _, c := range s.stopChan {
-		c <- true
-	}
+	s.cancel()
 	s.cli.Close()
 }
 
-// WatchAllocation watches state changes of the allocation with the given ID
-func (s *stateManager) WatchAllocation(allocationID uuid.UUID, watcher *AllocationWatcher) func() {
-	stopChan := make(chan interface{})
-	s.stopChan = append(s.stopChan, stopChan)
-	ctx := context.Background()
+// Campaign elects a leader using an etcd election. The leadership is bound to
+// a session lease, which expires electionTTL seconds after the leader stopped
+// responding.
+func (s *stateManager) Campaign(ctx context.Context, identity string) (context.Context, func(), error) {
 
-	key := fmt.Sprintf("%s/allocations/%s", etcdPrefix, allocationID)
-	watchChan := s.cli.Watch(ctx, key, clientv3.WithPrevKV())
+	session, err := concurrency.NewSession(s.cli, concurrency.WithTTL(electionTTL))
+	if err != nil {
+		return nil, nil, err
+	}
+	election := concurrency.NewElection(session, fmt.Sprintf("%s/leader", etcdPrefix))
+	if err := election.Campaign(ctx, identity); err != nil {
+		session.Close()
+		return nil, nil, err
+	}
 
-	stopFunc := func() {
-		stopChan <- true
+	leaderCtx, cancel := watchContext(ctx, s.ctx.Done())
+	go func() {
+		select {
+		case <-session.Done():
+			log.Printf("State: leadership of %s lost", identity)
+			cancel()
+		case <-leaderCtx.Done():
+		}
+	}()
+
+	var once sync.Once
+	resign := func() {
+		once.Do(func() {
+			cancel()
+			rctx, rcancel := context.WithTimeout(context.Background(), s.requestTimeout)
+			defer rcancel()
+			if err := election.Resign(rctx); err != nil {
+				log.Printf("State: error resigning leadership of %s [%s]", identity, err.Error())
+			}
+			session.Close()
+		})
 	}
+	return leaderCtx, resign, nil
+}
 
-	// Start a new thread and watch for changes in etcd
-	go s.watchChannel(watchChan, stopChan, watcher)
+// RegisterNode registers node with a lease that is kept alive until ctx is
+// cancelled. The registration is renewed if the lease expires, e.g. because
+// the connection to etcd was lost for more than electionTTL seconds.
+func (s *stateManager) RegisterNode(ctx context.Context, node string) error {
 
-	return stopFunc
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	lease, keepAlive, err := s.registerNode(ctx, node)
+	if err != nil {
+		cancel()
+		return err
+	}
 
-}
+	go func() {
+		defer cancel()
+		for {
+			for range keepAlive {
+			}
+			if ctx.Err() != nil {
+				s.revokeNode(lease)
+				return
+			}
 
-// Watch uses the supplied AllocationWatcher to watch leases. It returns a function
-// that can be used to stop the AllocationWatcher
-func (s *stateManager) Watch(watcher *AllocationWatcher) func() {
-	stopChan := make(chan interface{})
-	s.stopChan = append(s.stopChan, stopChan)
-	ctx := context.Background()
+			log.Printf("State: registration of node %s expired", node)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryBackoff):
+			}
+			if lease, keepAlive, err = s.registerNode(ctx, node); err != nil {
+				log.Printf("State: error registering node %s [%s]", node, err.Error())
+				closed := make(chan *clientv3.LeaseKeepAliveResponse)
+				close(closed)
+				keepAlive = closed
+			}
+		}
+	}()
+	return nil
+}
 
-	key := fmt.Sprintf("%s/allocations", etcdPrefix)
-	watchChan := s.cli.Watch(ctx, key, clientv3.WithPrefix(), clientv3.WithPrevKV())
+// registerNode puts the node key with a new lease and keeps the lease alive
+// until ctx is cancelled
+func (s *stateManager) registerNode(ctx context.Context, node string) (clientv3.LeaseID, <-chan *clientv3.LeaseKeepAliveResponse, error) {
 
-	stopFunc := func() {
-		stopChan <- true
+	rctx, rcancel := context.WithTimeout(ctx, s.requestTimeout)
+	defer rcancel()
+	lease, err := s.cli.Grant(rctx, electionTTL)
+	if err != nil {
+		return 0, nil, err
+	}
+	key := fmt.Sprintf("%s/nodes/%s", etcdPrefix, node)
+	if _, err := s.kv.Put(rctx, key, node, clientv3.WithLease(lease.ID)); err != nil {
+		return 0, nil, err
 	}
 
-	// Start a new thread and watch for changes in etcd
-	go s.watchChannel(watchChan, stopChan, watcher)
-
-	return stopFunc
+	keepAlive, err := s.cli.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return lease.ID, keepAlive, nil
 }
 
-func (s *stateManager) watchChannel(watchChan clientv3.WatchChan, stopChan chan interface{}, watcher *AllocationWatcher) {
-	for true {
-		select {
-		case w := <-watchChan:
-			for _, ev := range w.Events {
-				//log.Printf("Watch event - Key version: %d, createRev: %d, modRev: %d", ev.Kv.Version, ev.Kv.CreateRevision, ev.Kv.ModRevision)
-				switch ev.Type {
-				case clientv3.EventTypePut:
-					if lease, err := decode(ev.Kv.Value); err == nil {
-						if ev.IsCreate() {
-							if watcher.OnCreate != nil {
-								watcher.OnCreate(lease)
-							}
-						} else if ev.IsModify() {
-							if watcher.OnModify != nil {
-								watcher.OnModify(lease)
-							}
-						}
-					} else {
-						log.Printf("Error decoding allocation from etcd store: %s", err.Error())
-					}
-				case clientv3.EventTypeDelete:
-					var lease *Allocation
-					var err error
-
-					lease, err = decode(ev.PrevKv.Value)
-					if err == nil {
-						if watcher.OnDelete != nil {
-							watcher.OnDelete(lease)
-						}
-					} else {
-						log.Printf("Error decoding allocation from etcd store: %s", err.Error())
-					}
-				}
-			}
-		case <-stopChan:
-			// log.Print("State: watcher stopped")
-			return
-		}
+// revokeNode revokes a node lease unless the state manager has been stopped
+func (s *stateManager) revokeNode(lease clientv3.LeaseID) {
+	if s.ctx.Err() != nil || lease == clientv3.NoLease {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+	defer cancel()
+	if _, err := s.cli.Revoke(ctx, lease); err != nil {
+		log.Printf("State: error revoking node lease [%s]", err.Error())
 	}
 }
 
-func (s *stateManager) WatchMACPool(watcher *MACPoolWatcher) func() {
-	stopChan := make(chan interface{})
-	s.stopChan = append(s.stopChan, stopChan)
-	ctx := context.Background()
+// Nodes returns the names of all registered nodes
+func (s *stateManager) Nodes() ([]string, error) {
 
-	key := fmt.Sprintf("%s/macs", etcdPrefix)
-	watchChan := s.cli.Watch(ctx, key, clientv3.WithPrefix(), clientv3.WithPrevKV())
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+	defer cancel()
+	key := fmt.Sprintf("%s/nodes/", etcdPrefix)
+	gr, err := s.kv.Get(ctx, key, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
 
-	stopFunc := func() {
-		stopChan <- true
+	nodes := make([]string, gr.Count)
+	for i, kv := range gr.Kvs {
+		nodes[i] = string(kv.Value)
 	}
+	return nodes, nil
+}
 
-	// Start a new thread and watch for changes in etcd
-	go s.watchMACPool(watchChan, stopChan, watcher)
+// WatchEvents reports changes of the allocations selected by filter
+func (s *stateManager) WatchEvents(ctx context.Context, filter AllocationFilter) <-chan AllocationEvent {
+	key := fmt.Sprintf("%s/allocations/", etcdPrefix)
+	prefix := true
+	if filter.ID != uuid.Nil {
+		key = fmt.Sprintf("%s/allocations/%s", etcdPrefix, filter.ID)
+		prefix = false
+	}
 
-	return stopFunc
+	events := make(chan AllocationEvent)
+	w := s.newResumableWatch(key, prefix)
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	go func() {
+		defer close(events)
+		defer cancel()
+		w.run(ctx, func(ev etcdEvent) {
+			event, err := ev.allocationEvent()
+			if err != nil {
+				log.Printf("Error decoding allocation from etcd store: %s", err.Error())
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return events
 }
 
-func (s *stateManager) watchMACPool(watchChan clientv3.WatchChan, stopChan chan interface{}, watcher *MACPoolWatcher) {
-	for {
-		select {
-		case w := <-watchChan:
-			for _, ev := range w.Events {
-				//log.Printf("Watch event - Key version: %d, createRev: %d, modRev: %d", ev.Kv.Version, ev.Kv.CreateRevision, ev.Kv.ModRevision)
-				switch ev.Type {
-				case clientv3.EventTypePut:
-					v := strings.Split(string(ev.Kv.Key), "/")
-					mac, err := net.ParseMAC(v[len(v)-1])
-					if err == nil {
-						if ev.IsCreate() && watcher.OnPush != nil {
-							watcher.OnPush(mac)
-						}
-					} else {
-						log.Printf("Error deserialising MAC - %s", err.Error())
-					}
-				case clientv3.EventTypeDelete:
-					v := strings.Split(string(ev.PrevKv.Key), "/")
-					mac, err := net.ParseMAC(v[len(v)-1])
-					if err == nil {
-						if watcher.OnPop != nil {
-							watcher.OnPop(mac)
-						}
-					} else {
-						log.Printf("Error deserialising MAC - %s", err.Error())
-					}
-				}
+// WatchMACPoolEvents reports changes of the MAC pool
+func (s *stateManager) WatchMACPoolEvents(ctx context.Context) <-chan MACPoolEvent {
+	events := make(chan MACPoolEvent)
+	w := s.newResumableWatch(fmt.Sprintf("%s/macs/", etcdPrefix), true)
+	ctx, cancel := watchContext(ctx, s.ctx.Done())
+	go func() {
+		defer close(events)
+		defer cancel()
+		w.run(ctx, func(ev etcdEvent) {
+			event := MACPoolEvent{Type: MACPushed, Revision: ev.revision}
+			key := ev.kv
+			switch {
+			case ev.kv == nil:
+				event.Type = MACPopped
+				key = ev.prev
+			case ev.prev != nil:
+				// MAC is already in the pool
+				return
 			}
-		case <-stopChan:
-			// log.Print("State: watcher stopped")
-			return
-		}
-	}
+			v := strings.Split(string(key.Key), "/")
+			mac, err := net.ParseMAC(v[len(v)-1])
+			if err != nil {
+				log.Printf("Error deserialising MAC - %s", err.Error())
+				return
+			}
+			event.MAC = mac
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return events
+}
+
+// WatchAllocation watches state changes of the allocation with the given ID
+func (s *stateManager) WatchAllocation(allocationID uuid.UUID, watcher *AllocationWatcher) func() {
+	return watchAllocations(s, AllocationFilter{ID: allocationID}, watcher)
+}
+
+// Watch uses the supplied AllocationWatcher to watch leases. It returns a function
+// that can be used to stop the AllocationWatcher
+func (s *stateManager) Watch(watcher *AllocationWatcher) func() {
+	return watchAllocations(s, AllocationFilter{}, watcher)
+}
+
+// WatchMACPool uses the supplied MACPoolWatcher to watch the MAC pool. It returns
+// a function that can be used to stop the MACPoolWatcher
+func (s *stateManager) WatchMACPool(watcher *MACPoolWatcher) func() {
+	return watchMACPool(s, watcher)
 }
 
 // Put a lease into the state store
 func (s *stateManager) Put(allocation *Allocation) error {
+	return s.put(allocation)
+}
+
+// Update puts a lease into the state store if the stored allocation has
+// not been modified since expectedRevision
+func (s *stateManager) Update(allocation *Allocation, expectedRevision int64) error {
+	if expectedRevision != 0 {
+		if err := checkStoredUpdate(s, allocation, expectedRevision); err != nil {
+			return err
+		}
+	}
+	key := fmt.Sprintf("%s/allocations/%s", etcdPrefix, allocation.ID)
+	return s.put(allocation, clientv3.Compare(clientv3.ModRevision(key), "=", expectedRevision))
+}
+
+// put writes the allocation in a transaction guarded by cmps
+func (s *stateManager) put(allocation *Allocation, cmps ...clientv3.Cmp) error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
 	defer cancel()
@@ -365,35 +726,47 @@ func (s *stateManager) Put(allocation *Allocation) error {
 		return err
 	}
 
-	if allocation.Lease != nil {
+	key := fmt.Sprintf("%s/allocations/%s", etcdPrefix, allocation.ID)
+	opts := []clientv3.OpOption{clientv3.WithPrevKV()}
+	var ls *clientv3.LeaseGrantResponse
+	if expire, ok := allocation.RecordExpiry(); ok {
 		// If we have a lease, propagate expiry to the allocation record using etcd leases
-		ttl := int64(time.Until(allocation.Lease.Expire).Seconds())
-		ls, err := s.cli.Grant(ctx, ttl)
+		ttl := int64(time.Until(expire).Seconds())
+		if ttl < minLeaseTTL {
+			ttl = minLeaseTTL
+		}
+		ls, err = s.cli.Grant(ctx, ttl)
 		if err != nil {
 			log.Printf("State: %s", err.Error())
 			return err
 		}
+		opts = append(opts, clientv3.WithLease(ls.ID))
+	}
 
-		// Put
-		key := fmt.Sprintf("%s/allocations/%s", etcdPrefix, allocation.ID)
-		_, err = s.kv.Put(ctx, key, string(b), clientv3.WithLease(ls.ID))
+	tr, err := s.kv.Txn(ctx).If(cmps...).Then(clientv3.OpPut(key, string(b), opts...)).Commit()
+	if err != nil {
+		log.Printf("State: error writing to etcd [%s]", err.Error())
+		return err
+	}
 
-		if err != nil {
-			log.Printf("State: error writing to etcd [%s]", err.Error())
-			return err
+	if !tr.Succeeded {
+		if ls != nil {
+			s.cli.Revoke(ctx, ls.ID)
 		}
-	} else {
-		// Allication has no lease yet, store without etcd lease
-		// Put
-		key := fmt.Sprintf("%s/allocations/%s", etcdPrefix, allocation.ID)
-		_, err := s.kv.Put(ctx, key, string(b))
+		return ErrConflict
+	}
 
-		if err != nil {
-			log.Printf("State: error writing to etcd [%s]", err.Error())
-			return err
+	// The record is no longer attached to the etcd lease of its previous
+	// version - revoke it so that leases do not accumulate with renewals
+	if prev := tr.Responses[0].GetResponsePut().PrevKv; prev != nil && prev.Lease != 0 {
+		if ls == nil || clientv3.LeaseID(prev.Lease) != ls.ID {
+			if _, err := s.cli.Revoke(ctx, clientv3.LeaseID(prev.Lease)); err != nil {
+				log.Printf("State: error revoking lease of previous allocation record [%s]", err.Error())
+			}
 		}
 	}
 
+	allocation.Revision = tr.Header.Revision
 	return nil
 }
 
@@ -402,21 +775,25 @@ func (s *stateManager) Remove(allocation *Allocation) error {
 	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
 	defer cancel()
 
-	_, err := s.kv.Delete(ctx,
-		fmt.Sprintf("%s/allocations/%s", etcdPrefix, allocation.ID))
+	// The lookup entries are removed with the allocation unless another
+	// allocation obtained the IP in the meantime
+	ops := []clientv3.Op{
+		clientv3.OpDelete(fmt.Sprintf("%s/allocations/%s", etcdPrefix, allocation.ID)),
+	}
+	for _, ip := range allocation.IPs() {
+		key := fmt.Sprintf("%s/lookup/%s", etcdPrefix, ip)
+		ops = append(ops, clientv3.OpTxn(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.Value(key), "=", allocation.ID.String())},
+			[]clientv3.Op{clientv3.OpDelete(key)},
+			nil,
+		))
+	}
+
+	_, err := s.kv.Txn(ctx).Then(ops...).Commit()
 	if err != nil {
 		log.Printf("State: error removing IP %s", err.Error())
 		return err
 	}
-
-	if allocation.Lease != nil {
-		_, err := s.kv.Delete(ctx,
-			fmt.Sprintf("%s/lookup/%s", etcdPrefix, allocation.Lease.FixedAddress))
-		if err != nil {
-			log.Printf("State: error updating IP<->ID lookup table [%s]", err.Error())
-			return err
-		}
-	}
 	return nil
 }
 
@@ -442,6 +819,7 @@ func (s *stateManager) Allocations() ([]*Allocation, error) {
 		if err != nil {
 			return nil, err
 		}
+		allocations[i].Revision = item.ModRevision
 	}
 
 	return allocations, nil
@@ -460,9 +838,15 @@ func (s *stateManager) Get(id uuid.UUID) (*Allocation, error) {
 	}
 
 	if gr.Count == 0 {
-		return nil, fmt.Errorf("No allocation for D %s", id.String())
+		return nil, ErrNotFound
+	}
+
+	allocation, err := decode(gr.Kvs[0].Value)
+	if err != nil {
+		return nil, err
 	}
-	return decode(gr.Kvs[0].Value)
+	allocation.Revision = gr.Kvs[0].ModRevision
+	return allocation, nil
 }
 
 func decode(value []byte) (*Allocation, error) {
@@ -472,6 +856,9 @@ func decode(value []byte) (*Allocation, error) {
 }
 
 func encode(allocation *Allocation) ([]byte, error) {
+	if err := allocation.validateState(); err != nil {
+		return nil, err
+	}
 	b := new(bytes.Buffer)
 	err := json.NewEncoder(b).Encode(allocation)
 	return b.Bytes(), err
@@ -545,49 +932,159 @@ func (s *stateManager) PutMAC(mac net.HardwareAddr) error {
 		}
 	}
 
-	// A genuinely new or currently unused MAC - persist
+	// A genuinely new or currently unused MAC - persist and release any claim
 	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
 	defer cancel()
 	key := fmt.Sprintf("%s/macs/%s", etcdPrefix, amac)
-	_, err = s.kv.Put(ctx, key, amac)
+	claimKey := fmt.Sprintf("%s/claims/%s", etcdPrefix, amac)
+	_, err = s.kv.Txn(ctx).Then(
+		clientv3.OpPut(key, amac),
+		clientv3.OpDelete(claimKey),
+	).Commit()
 
 	return err
 }
 
-// RemoveMAC removes a MAC from the pool
+// SeedMAC puts a MAC into the pool of available MAC addresses if it is
+// neither pooled nor claimed. Both are checked in the transaction adding it.
+func (s *stateManager) SeedMAC(mac net.HardwareAddr) (bool, error) {
+
+	if len(mac) == 0 {
+		return false, fmt.Errorf("Empty MAC")
+	}
+	amac := strings.ToLower(mac.String())
+
+	allocations, err := s.Allocations()
+	if err != nil {
+		return false, err
+	}
+	if allocationWithMAC(allocations, amac) != nil {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+	defer cancel()
+	key := fmt.Sprintf("%s/macs/%s", etcdPrefix, amac)
+	claimKey := fmt.Sprintf("%s/claims/%s", etcdPrefix, amac)
+	tr, err := s.kv.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+		clientv3.Compare(clientv3.CreateRevision(claimKey), "=", 0),
+	).Then(
+		clientv3.OpPut(key, amac),
+	).Commit()
+	if err != nil {
+		return false, err
+	}
+	return tr.Succeeded, nil
+}
+
+// RemoveMAC removes a MAC and its claim from the pool
 func (s *stateManager) RemoveMAC(mac net.HardwareAddr) error {
 	amac := strings.ToLower(mac.String())
 
 	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
 	defer cancel()
 	key := fmt.Sprintf("%s/macs/%s", etcdPrefix, amac)
-	_, err := s.kv.Delete(ctx, key)
+	claimKey := fmt.Sprintf("%s/claims/%s", etcdPrefix, amac)
+	_, err := s.kv.Txn(ctx).Then(
+		clientv3.OpDelete(key),
+		clientv3.OpDelete(claimKey),
+	).Commit()
 
 	return err
 }
 
-// PopMAC retrieves a MAC from the pool of available MAC addresses
-func (s *stateManager) PopMAC() (net.HardwareAddr, error) {
+// PopMAC retrieves a MAC from the pool of available MAC addresses. The MAC key
+// is only deleted if it has not been modified since it was read, which ensures
+// that concurrent callers never obtain the same MAC. The claim of the MAC by
+// the allocation with ID claimant is recorded in the same transaction.
+func (s *stateManager) PopMAC(claimant uuid.UUID, accept func(net.HardwareAddr) bool) (net.HardwareAddr, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
 	defer cancel()
 
 	key := fmt.Sprintf("%s/macs", etcdPrefix)
-	gr, err := s.kv.Get(ctx, key, clientv3.WithPrefix(), clientv3.WithLimit(1))
-	if err != nil {
-		return nil, err
+	for i := 0; i < popMACRetries; i++ {
+		opts := []clientv3.OpOption{clientv3.WithPrefix()}
+		if accept == nil {
+			opts = append(opts, clientv3.WithLimit(1))
+		}
+		gr, err := s.kv.Get(ctx, key, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		var kv *mvccpb.KeyValue
+		for _, candidate := range gr.Kvs {
+			if acceptMAC(accept, string(candidate.Value)) {
+				kv = candidate
+				break
+			}
+		}
+		if kv == nil {
+			return nil, errors.New("No available MAC")
+		}
+		claimKey := fmt.Sprintf("%s/claims/%s", etcdPrefix, string(kv.Value))
+		tr, err := s.kv.Txn(ctx).If(
+			clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+		).Then(
+			clientv3.OpDelete(string(kv.Key)),
+			clientv3.OpPut(claimKey, claimant.String()),
+		).Commit()
+		if err != nil {
+			log.Printf("Error deleting MAC key [%s]", string(kv.Key))
+			return nil, err
+		}
+		if tr.Succeeded {
+			return net.ParseMAC(string(kv.Value))
+		}
+		// Somebody else claimed the MAC first - try the next one
 	}
-	if gr.Count < 1 {
-		return nil, errors.New("No available MAC")
+
+	return nil, errors.New("Could not claim MAC - too many concurrent requests")
+}
+
+// allocationWithMAC returns the allocation among allocations whose interface
+// has the MAC amac or nil
+func allocationWithMAC(allocations []*Allocation, amac string) *Allocation {
+	for _, al := range allocations {
+		if strings.ToLower(al.Interface.HardwareAddr.String()) == amac {
+			return al
+		}
 	}
+	return nil
+}
+
+// acceptMAC reports whether the MAC amac is accepted by the PopMAC filter
+// accept
+func acceptMAC(accept func(net.HardwareAddr) bool, amac string) bool {
+	if accept == nil {
+		return true
+	}
+	mac, err := net.ParseMAC(amac)
+	return err == nil && accept(mac)
+}
+
+// Claims returns the claimed MACs and the IDs of the claiming allocations
+func (s *stateManager) Claims() (map[string]uuid.UUID, error) {
 
-	ctx2, cancel2 := context.WithTimeout(context.Background(), s.requestTimeout)
-	defer cancel2()
-	if _, err = s.kv.Delete(ctx2, string(gr.Kvs[0].Key)); err != nil {
-		log.Printf("Error deleting MAC key [%s]", string(gr.Kvs[0].Key))
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+	defer cancel()
+	key := fmt.Sprintf("%s/claims/", etcdPrefix)
+	gr, err := s.kv.Get(ctx, key, clientv3.WithPrefix())
+	if err != nil {
 		return nil, err
 	}
 
-	return net.ParseMAC(string(gr.Kvs[0].Value))
+	claims := make(map[string]uuid.UUID, gr.Count)
+	for _, kv := range gr.Kvs {
+		id, err := uuid.Parse(string(kv.Value))
+		if err != nil {
+			log.Printf("Error deserialising claim of MAC [%s]", string(kv.Key))
+			continue
+		}
+		claims[strings.TrimPrefix(string(kv.Key), key)] = id
+	}
+	return claims, nil
 }
 
 // Custom JSON (un)mashalling
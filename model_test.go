@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"net"
 	"testing"
+	"time"
 
+	dhclient "github.com/digineo/go-dhclient"
 	"github.com/google/uuid"
 )
 
@@ -144,3 +146,104 @@ func assertEqual(alloc, alloc2 *Allocation, t *testing.T) {
 		t.Errorf("Field mismatch [HardwareAddr]: %s / %s", alloc.Interface.HardwareAddr.String(), alloc2.Interface.HardwareAddr.String())
 	}
 }
+
+func TestLeastLoadedNode(t *testing.T) {
+	allocations := []*Allocation{
+		{Node: "a"}, {Node: "a"}, {Node: "b"}, {Node: "c"}, {Node: "gone"}, {},
+	}
+
+	if node := LeastLoadedNode([]string{"a", "b", "c"}, allocations); node != "b" {
+		t.Errorf("Expected b got %s", node)
+	}
+	if node := LeastLoadedNode([]string{"a", "d"}, allocations); node != "d" {
+		t.Errorf("Expected d got %s", node)
+	}
+	if node := LeastLoadedNode(nil, allocations); node != "" {
+		t.Errorf("Expected no node got %s", node)
+	}
+}
+
+func TestAllocationFamilies(t *testing.T) {
+	now := time.Now()
+	alloc := NewAllocation("test")
+	if !alloc.Family.IPv4() || alloc.Family.IPv6() {
+		t.Error("Expected IPv4 for allocations without family")
+	}
+	if _, ok := alloc.Expiry(); ok || alloc.Bound() {
+		t.Error("Expected allocation without leases to be unbound")
+	}
+
+	alloc.Family = FamilyDual
+	alloc.Lease = &dhclient.Lease{FixedAddress: net.ParseIP("192.168.1.100"), Expire: now.Add(time.Hour)}
+	if alloc.Bound() {
+		t.Error("Expected dual-stack allocation without IPv6 lease to be unbound")
+	}
+	alloc.Lease6 = &Lease6{Address: net.ParseIP("2001:db8::100"), Expire: now.Add(time.Minute)}
+	if !alloc.Bound() {
+		t.Error("Expected dual-stack allocation with both leases to be bound")
+	}
+	if ips := alloc.IPs(); len(ips) != 2 || !ips[1].Equal(alloc.Lease6.Address) {
+		t.Errorf("Expected both addresses got %v", ips)
+	}
+	if expire, ok := alloc.Expiry(); !ok || !expire.Equal(alloc.Lease6.Expire) {
+		t.Errorf("Expected expiry of the IPv6 lease got %s", expire)
+	}
+	if expire, ok := alloc.RecordExpiry(); !ok || !expire.Equal(alloc.Lease6.Expire.Add(expiredRecordGrace)) {
+		t.Errorf("Expected record to expire after the IPv6 lease got %s", expire)
+	}
+	alloc.State = Lost
+	if _, ok := alloc.RecordExpiry(); ok {
+		t.Error("Expected record of lost allocation to be kept")
+	}
+	alloc.State = Unbound
+
+	data, err := encode(alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Family != FamilyDual || !decoded.Lease6.Address.Equal(alloc.Lease6.Address) {
+		t.Errorf("Expected %+v got %+v", alloc.Lease6, decoded.Lease6)
+	}
+
+	if _, err := ParseAddressFamily("ipx"); err == nil {
+		t.Error("Expected error for invalid family")
+	}
+	if f, _ := ParseAddressFamily("IPv6"); f != FamilyIPv6 {
+		t.Errorf("Expected ipv6 got %s", f)
+	}
+}
+
+func TestReleasedIPs(t *testing.T) {
+	old := NewAllocation("test")
+	old.Family = FamilyDual
+	old.Lease = &dhclient.Lease{FixedAddress: net.ParseIP("192.168.1.100")}
+	old.Lease6 = &Lease6{Address: net.ParseIP("2001:db8::100")}
+
+	// The allocation obtained another IPv4 address on rebind
+	rebound := *old
+	rebound.Lease = &dhclient.Lease{FixedAddress: net.ParseIP("192.168.1.101")}
+	if ips := releasedIPs(old, &rebound); len(ips) != 1 || !ips[0].Equal(old.Lease.FixedAddress) {
+		t.Errorf("Expected previous IPv4 address to be released got %v", ips)
+	}
+
+	// The allocation lost its IPv6 lease
+	lost := *old
+	lost.Lease6 = nil
+	if ips := releasedIPs(old, &lost); len(ips) != 1 || !ips[0].Equal(old.Lease6.Address) {
+		t.Errorf("Expected IPv6 address to be released got %v", ips)
+	}
+
+	if ips := releasedIPs(old, old); len(ips) != 0 {
+		t.Errorf("Expected no released IPs got %v", ips)
+	}
+	if ips := releasedIPs(old, nil); len(ips) != 2 {
+		t.Errorf("Expected all IPs of removed allocation to be released got %v", ips)
+	}
+	if ips := releasedIPs(nil, old); len(ips) != 0 {
+		t.Errorf("Expected no released IPs of created allocation got %v", ips)
+	}
+}
@@ -0,0 +1,103 @@
+package dhcpmanager
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Namespace is a named network namespace holding the virtual devices of a
+// DHCPController. Devices in the namespace are not visible to network
+// managers of the host. A nil Namespace refers to the namespace of the
+// controller.
+type Namespace struct {
+	Name   string
+	handle netns.NsHandle
+	nl     *netlink.Handle
+}
+
+// OpenNamespace opens the network namespace name and creates it if it does
+// not exist. The namespace is kept when the controller terminates so that
+// devices can be adopted after a restart.
+func OpenNamespace(name string) (*Namespace, error) {
+
+	handle, err := netns.GetFromName(name)
+	if err != nil {
+		// NewNamed enters the new namespace. The goroutine exits with its
+		// thread locked, which terminates the thread.
+		created := make(chan error)
+		go func() {
+			runtime.LockOSThread()
+			var err error
+			handle, err = netns.NewNamed(name)
+			created <- err
+		}()
+		if err := <-created; err != nil {
+			return nil, err
+		}
+		log.Printf("Created network namespace %s", name)
+	}
+
+	nl, err := netlink.NewHandleAt(handle)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &Namespace{Name: name, handle: handle, nl: nl}, nil
+}
+
+// Close releases the handles of the namespace
+func (ns *Namespace) Close() {
+	if ns == nil {
+		return
+	}
+	ns.nl.Close()
+	ns.handle.Close()
+}
+
+// Handle returns the netlink handle of the namespace
+func (ns *Namespace) Handle() *netlink.Handle {
+	if ns == nil {
+		return &netlink.Handle{}
+	}
+	return ns.nl
+}
+
+// Do runs fn with the calling goroutine in the namespace. Sockets opened by
+// fn stay in the namespace, but goroutines started by fn do not run in it.
+func (ns *Namespace) Do(fn func() error) error {
+	if ns == nil {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err := netns.Set(ns.handle); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+
+	err = fn()
+	if errSet := netns.Set(origin); errSet != nil {
+		// Keep the thread locked, it is terminated with the goroutine
+		log.Printf("Warning: Could not leave network namespace %s - %s", ns.Name, errSet.Error())
+		return err
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// nsFd returns the namespace to move new links into
+func (ns *Namespace) nsFd() interface{} {
+	if ns == nil {
+		return nil
+	}
+	return netlink.NsFd(ns.handle)
+}
@@ -0,0 +1,134 @@
+package dhcpmanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/gopacket/layers"
+)
+
+// DHCP option 81 (RFC 4702) and its flags
+const (
+	dhcpOptClientFQDN layers.DHCPOpt = 81
+
+	fqdnFlagServerUpdate byte = 0x01
+	fqdnFlagEncoding     byte = 0x04
+)
+
+// requestedParams are requested from the DHCP server in addition to the
+// lease to fill the NetworkConfig of allocations
+var requestedParams = []layers.DHCPOpt{
+	layers.DHCPOptSubnetMask,
+	layers.DHCPOptRouter,
+	layers.DHCPOptDNS,
+	layers.DHCPOptDomainName,
+	layers.DHCPOptNTPServers,
+}
+
+// DHCPOptions are sent to the DHCP server when obtaining the leases of an
+// allocation. Empty options are not sent.
+type DHCPOptions struct {
+	// ClientID is sent as client identifier (option 61). MAC addresses are
+	// sent with hardware type ethernet, other values as opaque string.
+	ClientID string `json:",omitempty"`
+
+	// VendorClass is sent as vendor class identifier (option 60)
+	VendorClass string `json:",omitempty"`
+
+	// FQDN is sent as client FQDN (option 81, DHCPv6 option 39) asking the
+	// server to update the DNS records
+	FQDN string `json:",omitempty"`
+}
+
+// NetworkConfig is the network configuration received from the DHCP server
+// with a lease
+type NetworkConfig struct {
+	DNS     []net.IP `json:",omitempty"`
+	Domain  string   `json:",omitempty"`
+	Routers []net.IP `json:",omitempty"`
+	NTP     []net.IP `json:",omitempty"`
+}
+
+// Validate checks that the options can be encoded in DHCP messages
+func (o *DHCPOptions) Validate() error {
+	if len(o.ClientID) > 254 {
+		return errors.New("Client identifier too long")
+	}
+	if len(o.VendorClass) > 255 {
+		return errors.New("Vendor class too long")
+	}
+	if o.FQDN != "" {
+		name := strings.TrimSuffix(o.FQDN, ".")
+		if len(name) > 253 {
+			return errors.New("FQDN too long")
+		}
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return fmt.Errorf("Invalid FQDN [%s]", o.FQDN)
+			}
+		}
+	}
+	return nil
+}
+
+// apply adds the options and the parameter request list to client
+func (o *DHCPOptions) apply(client DHCPClient) {
+	for _, param := range requestedParams {
+		client.AddParamRequest(param)
+	}
+	if o == nil {
+		return
+	}
+	if o.ClientID != "" {
+		client.AddOption(layers.DHCPOptClientID, encodeClientID(o.ClientID))
+	}
+	if o.VendorClass != "" {
+		client.AddOption(layers.DHCPOptClassID, []byte(o.VendorClass))
+	}
+	if o.FQDN != "" {
+		data := []byte{fqdnFlagServerUpdate | fqdnFlagEncoding, 0, 0} // RCODE1 and RCODE2 are deprecated
+		client.AddOption(dhcpOptClientFQDN, append(data, encodeDomainName(o.FQDN, true)...))
+	}
+}
+
+// encodeClientID encodes a client identifier with the type byte of RFC 2132
+func encodeClientID(id string) []byte {
+	if mac, err := net.ParseMAC(id); err == nil && len(mac) == 6 {
+		return append([]byte{dhcpEthernet}, mac...)
+	}
+	return append([]byte{0}, id...)
+}
+
+// encodeDomainName encodes name in DNS wire format. Fully qualified names
+// are terminated with the root label.
+func encodeDomainName(name string, qualified bool) []byte {
+	data := make([]byte, 0, len(name)+2)
+	for _, label := range splitLabels(name) {
+		data = append(append(data, byte(len(label))), label...)
+	}
+	if qualified {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// NewNetworkConfig extracts the network configuration from lease
+func NewNetworkConfig(lease *dhclient.Lease) *NetworkConfig {
+	config := &NetworkConfig{
+		DNS:     lease.DNS,
+		Domain:  lease.DomainName,
+		Routers: lease.Router,
+	}
+	for _, option := range lease.OtherOptions {
+		if option.Type != layers.DHCPOptNTPServers {
+			continue
+		}
+		for i := 0; i+4 <= len(option.Data); i += 4 {
+			config.NTP = append(config.NTP, net.IP(option.Data[i:i+4]))
+		}
+	}
+	return config
+}
@@ -0,0 +1,84 @@
+package dhcpmanager
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	dhclient "github.com/digineo/go-dhclient"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDHCPOptions(t *testing.T) {
+	options := &DHCPOptions{
+		ClientID:    "56:6a:e2:0b:01:8d",
+		VendorClass: "metallb",
+		FQDN:        "svc.example.com",
+	}
+	client := &dhclient.Client{}
+	options.apply(client)
+
+	expected := map[layers.DHCPOpt][]byte{
+		layers.DHCPOptClientID: {1, 0x56, 0x6a, 0xe2, 0x0b, 0x01, 0x8d},
+		layers.DHCPOptClassID:  []byte("metallb"),
+		dhcpOptClientFQDN:      {0x05, 0, 0, 3, 's', 'v', 'c', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0},
+	}
+	for _, option := range client.DHCPOptions {
+		if data, ok := expected[option.Type]; ok {
+			if !bytes.Equal(option.Data, data) {
+				t.Errorf("Expected option %d to be %v got %v", option.Type, data, option.Data)
+			}
+			delete(expected, option.Type)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("Options %v not sent", expected)
+	}
+
+	if !bytes.Equal(encodeClientID("host-1"), []byte{0, 'h', 'o', 's', 't', '-', '1'}) {
+		t.Errorf("Invalid client identifier %v", encodeClientID("host-1"))
+	}
+}
+
+func TestDHCPOptionsValidate(t *testing.T) {
+	valid := []DHCPOptions{
+		{},
+		{FQDN: "svc.example.com."},
+		{ClientID: "host-1", VendorClass: "metallb"},
+	}
+	for _, o := range valid {
+		if err := o.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid - %s", o, err.Error())
+		}
+	}
+
+	invalid := []DHCPOptions{
+		{FQDN: "svc..example.com"},
+		{FQDN: string(bytes.Repeat([]byte("a"), 64)) + ".com"},
+		{ClientID: string(make([]byte, 255))},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", o)
+		}
+	}
+}
+
+func TestNewNetworkConfig(t *testing.T) {
+	lease := &dhclient.Lease{
+		DNS:        []net.IP{net.ParseIP("192.168.1.1")},
+		Router:     []net.IP{net.ParseIP("192.168.1.254")},
+		DomainName: "example.com",
+		OtherOptions: []layers.DHCPOption{
+			layers.NewDHCPOption(layers.DHCPOptNTPServers, []byte{192, 168, 1, 2, 192, 168, 1, 3}),
+		},
+	}
+
+	config := NewNetworkConfig(lease)
+	if config.Domain != "example.com" || len(config.DNS) != 1 || len(config.Routers) != 1 {
+		t.Errorf("Invalid network configuration %+v", config)
+	}
+	if len(config.NTP) != 2 || !config.NTP[1].Equal(net.ParseIP("192.168.1.3")) {
+		t.Errorf("Invalid NTP servers %v", config.NTP)
+	}
+}
@@ -0,0 +1,71 @@
+package dhcpmanager
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultPool is the name of the pool used by allocations without pool
+const DefaultPool = "default"
+
+// Pool is a named parent interface on which addresses are obtained from the
+// DHCP server of the attached network
+type Pool struct {
+	Name string
+
+	// Interface is the name of the parent interface
+	Interface string
+
+	// MACs are the MAC addresses of the pool's virtual devices. The MACs are
+	// taken from the shared MAC pool of the state store.
+	MACs []net.HardwareAddr
+
+	// Device is the default configuration of the pool's virtual devices
+	Device DeviceConfig
+}
+
+// PoolName returns the name of the pool name refers to. Empty names refer to
+// the default pool.
+func PoolName(name string) string {
+	if name == "" {
+		return DefaultPool
+	}
+	return name
+}
+
+// Pool returns the pool with name. An empty name selects the default pool.
+func (c *DHCPController) Pool(name string) (*Pool, error) {
+	if pool, ok := c.pools[PoolName(name)]; ok {
+		return pool, nil
+	}
+	return nil, fmt.Errorf("Unknown pool [%s]", name)
+}
+
+// Pools returns the names of all pools
+func (c *DHCPController) Pools() []string {
+	names := make([]string, 0, len(c.pools))
+	for name := range c.pools {
+		names = append(names, name)
+	}
+	return names
+}
+
+// AcceptsMAC returns a filter for the MACs of pool name. MACs of the shared
+// MAC pool that are not listed in any pool belong to the default pool.
+func (c *DHCPController) AcceptsMAC(name string) func(net.HardwareAddr) bool {
+	owners := make(map[string]string)
+	for _, pool := range c.pools {
+		for _, mac := range pool.MACs {
+			owners[strings.ToLower(mac.String())] = pool.Name
+		}
+	}
+	name = PoolName(name)
+	return func(mac net.HardwareAddr) bool {
+		owner, ok := owners[strings.ToLower(mac.String())]
+		if !ok {
+			return name == DefaultPool
+		}
+		return owner == name
+	}
+}
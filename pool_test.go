@@ -0,0 +1,50 @@
+package dhcpmanager
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPools(t *testing.T) {
+	public, _ := net.ParseMAC("56:6a:e2:0b:01:8d")
+	mgmt, _ := net.ParseMAC("30:ba:33:c2:e3:c2")
+	dynamic, _ := net.ParseMAC("22:67:23:92:3b:e4")
+
+	c := NewDHCPController([]Pool{
+		{Name: DefaultPool, Interface: "eth0", MACs: []net.HardwareAddr{public}},
+		{Name: "mgmt", Interface: "eth1", MACs: []net.HardwareAddr{mgmt}, Device: DeviceConfig{Mode: VLAN, VLAN: 100}},
+	}, time.Second, true, false, true, false)
+
+	if pool, err := c.Pool(""); err != nil || pool.Interface != "eth0" {
+		t.Errorf("Expected default pool got %+v (%v)", pool, err)
+	}
+	if _, err := c.Pool("unknown"); err == nil {
+		t.Error("Expected error for unknown pool")
+	}
+	if device, err := c.Device("mgmt", nil); err != nil || device.Mode != VLAN {
+		t.Errorf("Expected VLAN device for pool mgmt got %+v (%v)", device, err)
+	}
+
+	sm := NewInMemoryStateManager()
+	defer sm.Stop()
+	for _, mac := range []net.HardwareAddr{public, mgmt, dynamic} {
+		sm.PutMAC(mac)
+	}
+
+	claimed, err := sm.PopMAC(NewAllocation("test").ID, c.AcceptsMAC("mgmt"))
+	if err != nil || claimed.String() != mgmt.String() {
+		t.Fatalf("Expected MAC %s for pool mgmt got %s (%v)", mgmt, claimed, err)
+	}
+	if _, err := sm.PopMAC(NewAllocation("test").ID, c.AcceptsMAC("mgmt")); err == nil {
+		t.Error("Expected pool mgmt to be exhausted")
+	}
+
+	// MACs registered without pool belong to the default pool
+	for i := 0; i < 2; i++ {
+		claimed, err := sm.PopMAC(NewAllocation("test").ID, c.AcceptsMAC(""))
+		if err != nil || claimed.String() == mgmt.String() {
+			t.Errorf("Expected MAC of the default pool got %s (%v)", claimed, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package dhcpmanager
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	dhclient "github.com/digineo/go-dhclient"
+)
+
+// DHCP message types (RFC 2132, option 53) sent by the DHCPController
+const (
+	dhcpDecline byte = 4
+	dhcpRelease byte = 7
+)
+
+// DHCP options used in DHCPRELEASE and DHCPDECLINE messages
+const (
+	dhcpOptRequestedIP byte = 50
+	dhcpOptMessageType byte = 53
+	dhcpOptServerID    byte = 54
+	dhcpOptClientID    byte = 61
+	dhcpOptEnd         byte = 255
+)
+
+const (
+	dhcpServerPort   = 67
+	dhcpBootRequest  = 1
+	dhcpEthernet     = 1
+	dhcpMagicCookie  = 0x63825363
+	dhcpHeaderLength = 236
+	dhcpSendTimeout  = time.Second
+)
+
+// newDHCPMessage builds a DHCPRELEASE or DHCPDECLINE message for lease held
+// by the client with hardware address mac (RFC 2131, section 4.4.4 and 4.4.6).
+// The client identifier clientID is included if not nil, because servers
+// identify the lease by the identifier it was obtained with.
+func newDHCPMessage(msgType byte, lease *dhclient.Lease, mac net.HardwareAddr, clientID []byte) ([]byte, error) {
+
+	ip := lease.FixedAddress.To4()
+	server := lease.ServerID.To4()
+	if ip == nil || server == nil {
+		return nil, errors.New("Lease without IPv4 address or server identifier")
+	}
+	if len(mac) > 16 {
+		return nil, errors.New("Hardware address too long")
+	}
+
+	xid := make([]byte, 4)
+	if _, err := rand.Read(xid); err != nil {
+		return nil, err
+	}
+	m := &dhcpv4Message{
+		Op:     dhcpBootRequest,
+		XID:    binary.BigEndian.Uint32(xid),
+		CHAddr: mac,
+		Options: []dhcpv4Option{
+			{Code: dhcpOptMessageType, Data: []byte{msgType}},
+			{Code: dhcpOptServerID, Data: server},
+		},
+	}
+	if msgType == dhcpRelease {
+		m.CIAddr = ip
+	}
+	if msgType == dhcpDecline {
+		m.Options = append(m.Options, dhcpv4Option{Code: dhcpOptRequestedIP, Data: ip})
+	}
+	if clientID != nil {
+		m.Options = append(m.Options, dhcpv4Option{Code: dhcpOptClientID, Data: clientID})
+	}
+	return m.marshal(), nil
+}
+
+// sendDHCPMessage sends a DHCP message to the server that issued lease from
+// namespace ns. The server does not respond to DHCPRELEASE and DHCPDECLINE
+// messages.
+func sendDHCPMessage(msgType byte, lease *dhclient.Lease, mac net.HardwareAddr, clientID []byte, ns *Namespace) error {
+
+	msg, err := newDHCPMessage(msgType, lease, mac, clientID)
+	if err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	err = ns.Do(func() error {
+		var err error
+		conn, err = net.DialUDP("udp4", nil, &net.UDPAddr{IP: lease.ServerID, Port: dhcpServerPort})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(dhcpSendTimeout))
+	_, err = conn.Write(msg)
+	return err
+}
@@ -0,0 +1,88 @@
+package dhcpmanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	dhclient "github.com/digineo/go-dhclient"
+)
+
+func TestNewDHCPMessage(t *testing.T) {
+	mac, _ := net.ParseMAC("56:6a:e2:0b:01:8d")
+	lease := &dhclient.Lease{
+		FixedAddress: net.ParseIP("192.168.1.100"),
+		ServerID:     net.ParseIP("192.168.1.1"),
+	}
+
+	msg, err := newDHCPMessage(dhcpRelease, lease, mac, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg[0] != dhcpBootRequest || msg[1] != dhcpEthernet || msg[2] != 6 {
+		t.Errorf("Invalid header %v", msg[:4])
+	}
+	if !net.IP(msg[12:16]).Equal(lease.FixedAddress) {
+		t.Errorf("Expected ciaddr %s got %s", lease.FixedAddress, net.IP(msg[12:16]))
+	}
+	if !bytes.Equal(msg[28:34], mac) {
+		t.Errorf("Expected chaddr %s got %s", mac, net.HardwareAddr(msg[28:34]))
+	}
+	if binary.BigEndian.Uint32(msg[236:240]) != dhcpMagicCookie {
+		t.Error("Missing magic cookie")
+	}
+	options := []byte{dhcpOptMessageType, 1, dhcpRelease, dhcpOptServerID, 4, 192, 168, 1, 1, dhcpOptEnd}
+	if !bytes.Equal(msg[240:], options) {
+		t.Errorf("Expected options %v got %v", options, msg[240:])
+	}
+
+	msg, err = newDHCPMessage(dhcpDecline, lease, mac, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net.IP(msg[12:16]).Equal(net.IPv4zero) {
+		t.Errorf("Expected empty ciaddr in decline got %s", net.IP(msg[12:16]))
+	}
+	options = []byte{dhcpOptMessageType, 1, dhcpDecline, dhcpOptServerID, 4, 192, 168, 1, 1,
+		dhcpOptRequestedIP, 4, 192, 168, 1, 100, dhcpOptEnd}
+	if !bytes.Equal(msg[240:], options) {
+		t.Errorf("Expected options %v got %v", options, msg[240:])
+	}
+
+	if _, err := newDHCPMessage(dhcpRelease, &dhclient.Lease{FixedAddress: lease.FixedAddress}, mac, nil); err == nil {
+		t.Error("Expected error for lease without server identifier")
+	}
+}
+
+func TestNewDHCPMessageClientID(t *testing.T) {
+	mac, _ := net.ParseMAC("56:6a:e2:0b:01:8d")
+	lease := &dhclient.Lease{
+		FixedAddress: net.ParseIP("192.168.1.100"),
+		ServerID:     net.ParseIP("192.168.1.1"),
+	}
+
+	// Leases obtained with a client identifier are released with it
+	clientID := encodeClientID("web")
+	msg, err := newDHCPMessage(dhcpRelease, lease, mac, clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := []byte{dhcpOptMessageType, 1, dhcpRelease, dhcpOptServerID, 4, 192, 168, 1, 1,
+		dhcpOptClientID, 4, 0, 'w', 'e', 'b', dhcpOptEnd}
+	if !bytes.Equal(msg[240:], options) {
+		t.Errorf("Expected options %v got %v", options, msg[240:])
+	}
+
+	msg, err = newDHCPMessage(dhcpDecline, lease, mac, clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseDHCPv4Message(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := m.option(dhcpOptClientID); !bytes.Equal(id, clientID) {
+		t.Errorf("Expected client identifier %v in decline got %v", clientID, id)
+	}
+}
@@ -0,0 +1,190 @@
+package dhcpmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// maxStateHistory is the number of transitions kept in the history of an
+// allocation
+const maxStateHistory = 16
+
+// ErrInvalidTransition is returned by Transition for state changes that the
+// state machine does not allow
+var ErrInvalidTransition = errors.New("Invalid state transition")
+
+// stateNames are the names of the states used in JSON and logs
+var stateNames = map[AllocationState]string{
+	Unbound:   "unbound",
+	Binding:   "binding",
+	Bound:     "bound",
+	Renewing:  "renewing",
+	Rebinding: "rebinding",
+	Lost:      "lost",
+	Stale:     "stale",
+	Stopped:   "stopped",
+	Failed:    "failed",
+	Releasing: "releasing",
+	Released:  "released",
+}
+
+// transitions are the states an allocation can move to from each state:
+//
+//	unbound -> binding -> bound -> releasing -> released
+//
+// Bound allocations are renewing, rebinding or lost while their leases are
+// not renewed, stale if the leases cannot be kept and stopped while no
+// controller runs. Allocations that cannot be bound fail. All allocations
+// except released ones can be returned.
+var transitions = map[AllocationState][]AllocationState{
+	Unbound:   {Binding, Failed, Releasing},
+	Binding:   {Bound, Failed, Releasing},
+	Bound:     {Renewing, Rebinding, Lost, Stale, Stopped, Releasing},
+	Renewing:  {Bound, Rebinding, Lost, Stale, Stopped, Releasing},
+	Rebinding: {Bound, Lost, Stale, Stopped, Releasing},
+	Lost:      {Bound, Stale, Stopped, Releasing},
+	Stopped:   {Bound, Failed, Releasing},
+	Stale:     {Releasing},
+	Failed:    {Releasing},
+	Releasing: {Released},
+	Released:  {},
+}
+
+// StateTransition is a state change recorded in the history of an allocation
+type StateTransition struct {
+	From   AllocationState
+	To     AllocationState
+	Time   time.Time
+	Reason string `json:",omitempty"`
+}
+
+func (s AllocationState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("AllocationState(%d)", int(s))
+}
+
+// ParseAllocationState parses the name of a state
+func ParseAllocationState(name string) (AllocationState, error) {
+	for state, n := range stateNames {
+		if n == name {
+			return state, nil
+		}
+	}
+	return Unbound, fmt.Errorf("Unknown allocation state [%s]", name)
+}
+
+// MarshalJSON encodes the state as its name
+func (s AllocationState) MarshalJSON() ([]byte, error) {
+	name, ok := stateNames[s]
+	if !ok {
+		return nil, fmt.Errorf("Unknown allocation state %d", int(s))
+	}
+	return json.Marshal(name)
+}
+
+// UnmarshalJSON decodes the name of a state. The numbers stored by previous
+// versions are accepted as well.
+func (s *AllocationState) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		n, err := strconv.Atoi(string(b))
+		if err != nil {
+			return fmt.Errorf("Invalid allocation state %s", b)
+		}
+		if _, ok := stateNames[AllocationState(n)]; !ok {
+			return fmt.Errorf("Unknown allocation state %d", n)
+		}
+		*s = AllocationState(n)
+		return nil
+	}
+	state, err := ParseAllocationState(name)
+	if err != nil {
+		return err
+	}
+	*s = state
+	return nil
+}
+
+// Active reports whether an allocation in state s is bound to a device and
+// its DHCP clients are running
+func (s AllocationState) Active() bool {
+	return s == Bound || s == Renewing || s == Rebinding || s == Lost
+}
+
+// CanTransition reports whether an allocation in state s can move to next
+func (s AllocationState) CanTransition(next AllocationState) bool {
+	for _, state := range transitions[s] {
+		if state == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the allocation to state next and records the change with
+// reason in its history. Moving to the current state does nothing and
+// changes not allowed by the state machine return ErrInvalidTransition.
+func (a *Allocation) Transition(next AllocationState, reason string) error {
+	if a.State == next {
+		return nil
+	}
+	if !a.State.CanTransition(next) {
+		return fmt.Errorf("Allocation %s from %s to %s - %w", a.ID, a.State, next, ErrInvalidTransition)
+	}
+
+	a.History = append(a.History, StateTransition{From: a.State, To: next, Time: time.Now(), Reason: reason})
+	if len(a.History) > maxStateHistory {
+		a.History = append([]StateTransition(nil), a.History[len(a.History)-maxStateHistory:]...)
+	}
+	a.State = next
+	return nil
+}
+
+// checkUpdate returns ErrInvalidTransition if the state machine does not
+// allow an update of the stored allocation to the state of allocation
+func checkUpdate(stored, allocation *Allocation) error {
+	if stored == nil || stored.State == allocation.State || stored.State.CanTransition(allocation.State) {
+		return nil
+	}
+	return fmt.Errorf("Allocation %s from %s to %s - %w", allocation.ID, stored.State, allocation.State, ErrInvalidTransition)
+}
+
+// checkStoredUpdate checks the update of the allocation stored by sm at
+// expectedRevision to allocation. Stores that only replace the allocation if
+// it is still at expectedRevision use it to check the state change before
+// writing.
+func checkStoredUpdate(sm StateManager, allocation *Allocation, expectedRevision int64) error {
+	stored, err := sm.Get(allocation.ID)
+	if err == ErrNotFound {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	if stored.Revision != expectedRevision {
+		return ErrConflict
+	}
+	return checkUpdate(stored, allocation)
+}
+
+// validateState checks that the state of an allocation with a history has
+// been reached by its last transition. Allocations without history have not
+// changed their state since they were created or stored by a previous
+// version.
+func (a *Allocation) validateState() error {
+	if _, ok := stateNames[a.State]; !ok {
+		return fmt.Errorf("Unknown allocation state %d", int(a.State))
+	}
+	if len(a.History) == 0 {
+		return nil
+	}
+	if last := a.History[len(a.History)-1]; last.To != a.State {
+		return fmt.Errorf("Allocation %s in state %s without transition from %s - %w", a.ID, a.State, last.To, ErrInvalidTransition)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package dhcpmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAllocationTransition(t *testing.T) {
+	allocation := NewAllocation("web")
+
+	for _, state := range []AllocationState{Binding, Bound, Renewing, Bound, Releasing, Released} {
+		if err := allocation.Transition(state, fmt.Sprintf("to %s", state)); err != nil {
+			t.Fatal(err)
+		}
+		if allocation.State != state {
+			t.Errorf("Expected state %s got %s", state, allocation.State)
+		}
+	}
+	if len(allocation.History) != 6 {
+		t.Fatalf("Expected 6 transitions got %d", len(allocation.History))
+	}
+	last := allocation.History[5]
+	if last.From != Releasing || last.To != Released || last.Reason != "to released" || last.Time.IsZero() {
+		t.Errorf("Unexpected transition %+v", last)
+	}
+
+	// Moving to the current state is not recorded
+	if err := allocation.Transition(Released, "again"); err != nil || len(allocation.History) != 6 {
+		t.Errorf("Expected no transition got %v", err)
+	}
+
+	// Released allocations cannot be bound again
+	err := allocation.Transition(Bound, "rebound")
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected invalid transition got %v", err)
+	}
+	if allocation.State != Released || len(allocation.History) != 6 {
+		t.Errorf("Invalid transition changed the allocation")
+	}
+}
+
+func TestAllocationHistoryBounded(t *testing.T) {
+	allocation := NewAllocation("web")
+	allocation.Transition(Binding, "binding")
+	allocation.Transition(Bound, "bound")
+	for i := 0; i < maxStateHistory; i++ {
+		allocation.Transition(Renewing, fmt.Sprintf("renewing %d", i))
+		allocation.Transition(Bound, fmt.Sprintf("renewed %d", i))
+	}
+
+	if len(allocation.History) != maxStateHistory {
+		t.Fatalf("Expected %d transitions got %d", maxStateHistory, len(allocation.History))
+	}
+	if first := allocation.History[0]; first.Reason != "renewing 8" {
+		t.Errorf("Expected oldest transitions to be dropped got %+v", first)
+	}
+	if err := allocation.validateState(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMarshallingAllocationState(t *testing.T) {
+	allocation := NewAllocation("web")
+	allocation.Transition(Binding, "binding")
+
+	data, err := json.Marshal(allocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields struct {
+		State   string
+		History []struct{ From, To string }
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields.State != "binding" || len(fields.History) != 1 || fields.History[0].From != "unbound" {
+		t.Errorf("Expected named states got %s", data)
+	}
+
+	// States stored as numbers by previous versions are accepted
+	var state AllocationState
+	if err := json.Unmarshal([]byte("7"), &state); err != nil || state != Lost {
+		t.Errorf("Expected state %s got %s (%v)", Lost, state, err)
+	}
+	for _, invalid := range []string{`"bogus"`, "42", "true"} {
+		if err := json.Unmarshal([]byte(invalid), &state); err == nil {
+			t.Errorf("Expected error decoding state %s", invalid)
+		}
+	}
+}
+
+func TestStoreRejectsUntrackedState(t *testing.T) {
+	sm := NewInMemoryStateManager()
+	defer sm.Stop()
+
+	allocation := NewAllocation("web")
+	allocation.Transition(Binding, "binding")
+	if err := sm.Put(allocation); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := sm.Get(allocation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored.State = Released
+	if err := sm.Update(stored, stored.Revision); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected invalid transition got %v", err)
+	}
+	stored.State = Binding
+	if err := stored.Transition(Bound, "bound"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Update(stored, stored.Revision); err != nil {
+		t.Error(err)
+	}
+
+	// Updates are checked against the stored state regardless of the history
+	stored.History = nil
+	stored.State = Unbound
+	if err := sm.Update(stored, stored.Revision); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected invalid transition without history got %v", err)
+	}
+	stored.State = Bound
+	stored.History = append(stored.History, StateTransition{From: Bound, To: Released})
+	stored.State = Released
+	if err := sm.Update(stored, stored.Revision); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected invalid transition with appended history got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package dhcpmanager
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// OpenStateManager creates the StateManager selected by the store URL.
+// Supported stores are
+//
+//   - etcd://host1:2379,host2:2379 - etcd3 (the default if store is empty)
+//   - bolt:///path/to/state.db - a local bolt database file
+//   - kubernetes://namespace - custom resources in a Kubernetes namespace. The
+//     in-cluster configuration is used unless a kubeconfig is given with
+//     kubernetes://namespace?kubeconfig=/path/to/kubeconfig
+//   - memory:// - in-memory state (not persisted, not shared between processes)
+//
+// The etcd endpoints are used if store is empty or does not provide hosts.
+func OpenStateManager(store string, etcdEndpoints []string, dialTimeout, requestTimeout time.Duration) (StateManager, error) {
+
+	if store == "" {
+		return NewStateManager(etcdEndpoints, dialTimeout, requestTimeout)
+	}
+
+	u, err := url.Parse(store)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid store [%s] - %s", store, err.Error())
+	}
+
+	switch u.Scheme {
+	case "etcd":
+		if u.Host != "" {
+			etcdEndpoints = strings.Split(u.Host, ",")
+		}
+		return NewStateManager(etcdEndpoints, dialTimeout, requestTimeout)
+	case "bolt":
+		if u.Path == "" {
+			return nil, fmt.Errorf("Invalid store [%s] - missing database path", store)
+		}
+		return NewBoltStateManager(u.Path, requestTimeout)
+	case "kubernetes":
+		namespace := u.Host
+		if namespace == "" {
+			namespace = "default"
+		}
+		config, err := clientcmd.BuildConfigFromFlags("", u.Query().Get("kubeconfig"))
+		if err != nil {
+			return nil, err
+		}
+		// Requests are limited to requestTimeout by their contexts. A client
+		// timeout would also cut off the long-running watch requests.
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return NewKubernetesStateManager(client, namespace, requestTimeout), nil
+	case "memory":
+		return NewInMemoryStateManager(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported store [%s]", store)
+	}
+}
@@ -0,0 +1,210 @@
+package dhcpmanager
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// watchRetryBackoff is the time to wait before re-establishing a failed watch
+const watchRetryBackoff = time.Second
+
+// etcdEvent is a change of a watched key. Events are either derived from
+// etcd watch events or synthesised after a relist.
+type etcdEvent struct {
+	kv       *mvccpb.KeyValue // the current key value, nil if the key has been deleted
+	prev     *mvccpb.KeyValue // the previous key value, nil if the key has been created
+	revision int64            // the revision of the change
+}
+
+// allocationEvent decodes the allocations of ev
+func (ev etcdEvent) allocationEvent() (AllocationEvent, error) {
+	event := AllocationEvent{Type: EventModified, Revision: ev.revision}
+	var err error
+	if ev.kv == nil {
+		event.Type = EventDeleted
+	} else if event.New, err = decodeKeyValue(ev.kv); err != nil {
+		return event, err
+	}
+	if ev.prev == nil {
+		event.Type = EventCreated
+	} else if event.Old, err = decodeKeyValue(ev.prev); err != nil {
+		return event, err
+	}
+	return event, nil
+}
+
+func decodeKeyValue(kv *mvccpb.KeyValue) (*Allocation, error) {
+	allocation, err := decode(kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	allocation.Revision = kv.ModRevision
+	return allocation, nil
+}
+
+// resumableWatch watches a key or prefix in etcd. It keeps track of the last
+// seen revision and the known state of all watched keys, which allows it to
+// resume watching after disconnects without missing events. If the revision
+// to resume from has been compacted, the current state is relisted and all
+// differences to the known state are reported as synthetic events.
+type resumableWatch struct {
+	sm       *stateManager
+	key      string
+	prefix   bool
+	revision int64
+	known    map[string]*mvccpb.KeyValue
+}
+
+// newResumableWatch lists the current state of key. Watching starts from the
+// revision of the listing, so no change after this call is missed.
+func (s *stateManager) newResumableWatch(key string, prefix bool) *resumableWatch {
+	w := &resumableWatch{
+		sm:     s,
+		key:    key,
+		prefix: prefix,
+		known:  make(map[string]*mvccpb.KeyValue),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+	defer cancel()
+	gr, err := s.kv.Get(ctx, key, w.options()...)
+	if err != nil {
+		// Start watching from the current revision without known state
+		log.Printf("State: error listing %s [%s]", key, err.Error())
+		return w
+	}
+	for _, kv := range gr.Kvs {
+		w.known[string(kv.Key)] = kv
+	}
+	w.revision = gr.Header.Revision + 1
+	return w
+}
+
+func (w *resumableWatch) options() []clientv3.OpOption {
+	if w.prefix {
+		return []clientv3.OpOption{clientv3.WithPrefix()}
+	}
+	return []clientv3.OpOption{}
+}
+
+// run watches until ctx is cancelled and hands all events to handle
+func (w *resumableWatch) run(ctx context.Context, handle func(etcdEvent)) {
+	for {
+		opts := append(w.options(), clientv3.WithPrevKV())
+		if w.revision > 0 {
+			opts = append(opts, clientv3.WithRev(w.revision))
+		}
+
+		wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		err := w.consume(ctx, w.sm.watcher.Watch(wctx, w.key, opts...), handle)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == rpctypes.ErrCompacted {
+			log.Printf("State: watch revision %d of %s compacted - relisting", w.revision, w.key)
+			if err = w.relist(ctx, handle); err == nil {
+				continue
+			}
+		}
+
+		log.Printf("State: watch of %s interrupted at revision %d [%s]", w.key, w.revision, err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryBackoff):
+		}
+	}
+}
+
+// consume handles watch responses until the watch fails or ctx is cancelled
+func (w *resumableWatch) consume(ctx context.Context, watchChan clientv3.WatchChan, handle func(etcdEvent)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case resp, ok := <-watchChan:
+			if !ok {
+				return errors.New("watch channel closed")
+			}
+			if resp.CompactRevision != 0 {
+				return rpctypes.ErrCompacted
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			if resp.Canceled {
+				return errors.New("watch canceled")
+			}
+			for _, ev := range resp.Events {
+				w.apply(ev, handle)
+			}
+		}
+	}
+}
+
+// apply updates the known state with ev and hands it on to handle
+func (w *resumableWatch) apply(ev *clientv3.Event, handle func(etcdEvent)) {
+	key := string(ev.Kv.Key)
+	w.revision = ev.Kv.ModRevision + 1
+
+	prev := ev.PrevKv
+	if prev == nil {
+		prev = w.known[key]
+	}
+
+	switch ev.Type {
+	case clientv3.EventTypePut:
+		w.known[key] = ev.Kv
+		handle(etcdEvent{kv: ev.Kv, prev: prev, revision: ev.Kv.ModRevision})
+	case clientv3.EventTypeDelete:
+		delete(w.known, key)
+		if prev != nil {
+			handle(etcdEvent{prev: prev, revision: ev.Kv.ModRevision})
+		}
+	}
+}
+
+// relist replaces the known state with the current state and reports
+// all differences as events
+func (w *resumableWatch) relist(ctx context.Context, handle func(etcdEvent)) error {
+	rctx, cancel := context.WithTimeout(ctx, w.sm.requestTimeout)
+	defer cancel()
+
+	gr, err := w.sm.kv.Get(rctx, w.key, w.options()...)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]*mvccpb.KeyValue)
+	for _, kv := range gr.Kvs {
+		current[string(kv.Key)] = kv
+	}
+
+	for key, kv := range current {
+		prev, known := w.known[key]
+		switch {
+		case !known:
+			handle(etcdEvent{kv: kv, revision: gr.Header.Revision})
+		case prev.ModRevision != kv.ModRevision:
+			handle(etcdEvent{kv: kv, prev: prev, revision: gr.Header.Revision})
+		}
+	}
+	for key, prev := range w.known {
+		if _, ok := current[key]; !ok {
+			handle(etcdEvent{prev: prev, revision: gr.Header.Revision})
+		}
+	}
+
+	w.known = current
+	w.revision = gr.Header.Revision + 1
+	return nil
+}
@@ -0,0 +1,143 @@
+package dhcpmanager
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestResumableWatchApply(t *testing.T) {
+
+	w := &resumableWatch{known: make(map[string]*mvccpb.KeyValue)}
+	var events []etcdEvent
+	handle := func(ev etcdEvent) { events = append(events, ev) }
+
+	kv := &mvccpb.KeyValue{Key: []byte("a"), ModRevision: 5}
+	w.apply(&clientv3.Event{Type: clientv3.EventTypePut, Kv: kv}, handle)
+	w.apply(&clientv3.Event{Type: clientv3.EventTypePut, Kv: &mvccpb.KeyValue{Key: []byte("a"), ModRevision: 6}}, handle)
+	w.apply(&clientv3.Event{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte("a"), ModRevision: 7}}, handle)
+
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events got %d", len(events))
+	}
+	if events[0].prev != nil || events[0].kv == nil {
+		t.Error("Expected first put to be a create")
+	}
+	if events[1].prev != kv || events[1].kv == nil {
+		t.Error("Expected second put to be a modify")
+	}
+	if events[2].kv != nil || events[2].prev.ModRevision != 6 {
+		t.Error("Expected delete carrying the last known value")
+	}
+	if w.revision != 8 {
+		t.Errorf("Expected resume revision 8 got %d", w.revision)
+	}
+}
+
+// fakeEtcd serves listings and watches of resumableWatch. Every watch request
+// receives the next channel of watches.
+type fakeEtcd struct {
+	clientv3.KV
+	clientv3.Watcher
+
+	mu        sync.Mutex
+	kvs       []*mvccpb.KeyValue
+	revision  int64
+	watches   chan clientv3.WatchChan
+	revisions chan int64
+}
+
+func (f *fakeEtcd) set(revision int64, kvs ...*mvccpb.KeyValue) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revision = revision
+	f.kvs = kvs
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &clientv3.GetResponse{
+		Header: &etcdserverpb.ResponseHeader{Revision: f.revision},
+		Kvs:    f.kvs,
+	}, nil
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	f.revisions <- clientv3.OpGet(key, opts...).Rev()
+	return <-f.watches
+}
+
+func TestResumableWatchCompaction(t *testing.T) {
+
+	etcd := &fakeEtcd{
+		watches:   make(chan clientv3.WatchChan, 2),
+		revisions: make(chan int64, 2),
+	}
+	sm := &stateManager{kv: etcd, watcher: etcd, requestTimeout: time.Second}
+	a := &mvccpb.KeyValue{Key: []byte("a"), ModRevision: 2}
+	b := &mvccpb.KeyValue{Key: []byte("b"), ModRevision: 3}
+	etcd.set(3, a, b)
+
+	w := sm.newResumableWatch("", true)
+	events := make(chan etcdEvent, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := make(chan clientv3.WatchResponse, 2)
+	second := make(chan clientv3.WatchResponse)
+	etcd.watches <- first
+	etcd.watches <- second
+	go w.run(ctx, func(ev etcdEvent) { events <- ev })
+
+	// Watching starts after the listing
+	if rev := <-etcd.revisions; rev != 4 {
+		t.Errorf("Expected watch from revision 4 got %d", rev)
+	}
+
+	// c is created, a is modified and b deleted while the watch is behind.
+	// The revision to resume from is compacted before the changes are seen.
+	c := &mvccpb.KeyValue{Key: []byte("c"), ModRevision: 4}
+	first <- clientv3.WatchResponse{Events: []*clientv3.Event{{Type: clientv3.EventTypePut, Kv: c}}}
+	a2 := &mvccpb.KeyValue{Key: []byte("a"), ModRevision: 6}
+	etcd.set(9, a2, c)
+	first <- clientv3.WatchResponse{CompactRevision: 8}
+
+	// The watch relists and resumes after the listing
+	if rev := <-etcd.revisions; rev != 10 {
+		t.Errorf("Expected watch from revision 10 got %d", rev)
+	}
+
+	received := make(map[string]etcdEvent)
+	for len(received) < 3 {
+		select {
+		case ev := <-events:
+			key := ev.prev
+			if ev.kv != nil {
+				key = ev.kv
+			}
+			received[string(key.Key)] = ev
+		case <-time.After(time.Second):
+			t.Fatalf("Expected 3 events got %v", received)
+		}
+	}
+	if ev := received["c"]; ev.prev != nil || ev.kv != c {
+		t.Errorf("Expected create of c got %+v", ev)
+	}
+	if ev := received["a"]; ev.prev != a || ev.kv != a2 || ev.revision != 9 {
+		t.Errorf("Expected synthetic modify of a got %+v", ev)
+	}
+	if ev := received["b"]; ev.prev != b || ev.kv != nil || ev.revision != 9 {
+		t.Errorf("Expected synthetic delete of b got %+v", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("Unexpected event %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}